@@ -0,0 +1,146 @@
+package codanet
+
+import (
+	"context"
+	gonet "net"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// how often expireBans checks for expired bans
+const banExpiryInterval = time.Second
+
+// Ban is an entry of the ban table: either a peer or an IP range, banned
+// until Expires or, if that is zero, until the gating config is replaced
+type Ban struct {
+	Peer    peer.ID
+	IPNet   *gonet.IPNet
+	Expires time.Time
+	Reason  string
+}
+
+func (b Ban) key() string {
+	if b.IPNet != nil {
+		return "ip:" + b.IPNet.String()
+	}
+	return "peer:" + b.Peer.String()
+}
+
+// BanPeerUntil bans p until expires. A permanent ban of p is left as it is.
+func (gs *CodaGatingState) BanPeerUntil(p peer.ID, expires time.Time, reason string) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	ban := Ban{Peer: p, Expires: expires, Reason: reason}
+	if _, timed := gs.timedBans[ban.key()]; !timed && gs.BannedPeers.Contains(p) {
+		return
+	}
+
+	gs.BannedPeers.Add(p)
+	gs.timedBans[ban.key()] = ban
+}
+
+// BanIPNetUntil bans the addresses in ipnet until expires. A permanent ban of
+// the same range is left as it is.
+func (gs *CodaGatingState) BanIPNetUntil(ipnet gonet.IPNet, expires time.Time, reason string) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	ban := Ban{IPNet: &ipnet, Expires: expires, Reason: reason}
+	if _, timed := gs.timedBans[ban.key()]; !timed {
+		if action, ok := gs.BannedAddrFilters.ActionForFilter(ipnet); ok && action == ma.ActionDeny {
+			return
+		}
+	}
+
+	gs.BannedAddrFilters.AddFilter(ipnet, ma.ActionDeny)
+	gs.timedBans[ban.key()] = ban
+}
+
+// Bans returns the ban table: the timed bans along with the permanent ones
+func (gs *CodaGatingState) Bans() []Ban {
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
+
+	var bans []Ban
+	for _, p := range gs.BannedPeers.Peers() {
+		ban := Ban{Peer: p}
+		if timed, ok := gs.timedBans[ban.key()]; ok {
+			ban = timed
+		}
+		bans = append(bans, ban)
+	}
+	for _, ipnet := range gs.BannedAddrFilters.FiltersForAction(ma.ActionDeny) {
+		ipnet := ipnet
+		ban := Ban{IPNet: &ipnet}
+		if timed, ok := gs.timedBans[ban.key()]; ok {
+			ban = timed
+		}
+		bans = append(bans, ban)
+	}
+	return bans
+}
+
+// ExpireBans lifts the timed bans that expired by now, calls OnBanExpired with
+// each of them and returns them
+func (gs *CodaGatingState) ExpireBans(now time.Time) (expired []Ban) {
+	defer func() {
+		for _, ban := range expired {
+			gs.OnBanExpired(ban)
+		}
+	}()
+
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	expiredPeers := make(map[peer.ID]bool)
+	for key, ban := range gs.timedBans {
+		if ban.Expires.After(now) {
+			continue
+		}
+
+		delete(gs.timedBans, key)
+		expired = append(expired, ban)
+		if ban.IPNet != nil {
+			gs.BannedAddrFilters.RemoveLiteral(*ban.IPNet)
+		} else {
+			expiredPeers[ban.Peer] = true
+		}
+	}
+
+	if len(expiredPeers) == 0 {
+		return expired
+	}
+
+	// peer.Set can't remove peers, so replace it with one without them
+	bannedPeers := peer.NewSet()
+	for _, p := range gs.BannedPeers.Peers() {
+		if !expiredPeers[p] {
+			bannedPeers.Add(p)
+		}
+	}
+	gs.BannedPeers = bannedPeers
+	return expired
+}
+
+// expireBans lifts the timed bans of h.GatingState as they expire, until ctx
+// is done
+func (h *Helper) expireBans(ctx context.Context) {
+	ticker := time.NewTicker(banExpiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if expired := h.GatingState.ExpireBans(now); len(expired) > 0 {
+				if err := h.saveGatingState(); err != nil {
+					logger.Errorf("failed to save gating state after lifting expired bans: %s", err)
+				}
+			}
+		}
+	}
+}
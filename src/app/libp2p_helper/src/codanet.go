@@ -10,6 +10,7 @@ import (
 	"math/rand"
 	gonet "net"
 	"path"
+	"sync"
 	"time"
 
 	dsb "github.com/ipfs/go-ds-badger"
@@ -38,6 +39,8 @@ import (
 	"golang.org/x/crypto/blake2b"
 
 	libp2pmplex "github.com/libp2p/go-libp2p-mplex"
+	noise "github.com/libp2p/go-libp2p-noise"
+	tls "github.com/libp2p/go-libp2p-tls"
 	mplex "github.com/libp2p/go-mplex"
 )
 
@@ -63,14 +66,31 @@ var (
 		"100.64.0.0/10",
 		"198.18.0.0/15",
 		"169.254.0.0/16",
+		"fc00::/7",  // IPv6 unique local
+		"fe80::/10", // IPv6 link-local
 	}
 
+	// every IPv4 and IPv6 address; filters match one family at a time
+	allIPCIDRs = []string{"0.0.0.0/0", "::/0"}
+
 	pxProtocolID        = protocol.ID("/mina/peer-exchange")
 	NodeStatusProtocolID = protocol.ID("/mina/node-status")
 
 	privateIpFilter *ma.Filters = nil
 )
 
+// isAllIPs checks if ipnet covers every address of its family, as the isolate
+// option bans
+func isAllIPs(ipnet gonet.IPNet) bool {
+	for _, cidr := range allIPCIDRs {
+		all := parseCIDR(cidr)
+		if ipnet.String() == all.String() {
+			return true
+		}
+	}
+	return false
+}
+
 func initPrivateIpFilter() {
 	privateIpFilter = ma.NewFilters()
 	if WithPrivate {
@@ -87,53 +107,224 @@ func isPrivateAddr(addr ma.Multiaddr) bool {
 }
 
 type CodaConnectionManager struct {
-	ctx              context.Context
-	host             host.Host
+	ctx  context.Context
+	host host.Host
+	// p2pManager is replaced by SetLimits, so it's only accessed under mutex
+	mutex            sync.RWMutex
 	p2pManager       *p2pconnmgr.BasicConnMgr
+	protections      map[peer.ID]map[string]struct{}
+	decayingTags     map[string]*codaDecayingTag
 	minaPeerExchange bool
 	getRandomPeers   getRandomPeersFunc
-	OnConnect        func(network.Network, network.Conn)
-	OnDisconnect     func(network.Network, network.Conn)
+	// OnConnect is called for each new connection that is kept, and
+	// OnDisconnect once it is closed, with the reason the helper closed it
+	// for, if it did
+	OnConnect    func(network.Network, network.Conn)
+	OnDisconnect func(net network.Network, c network.Conn, reason string)
+	// the connections OnConnect was called for, with the reason they are
+	// being closed for, if known
+	reportedMutex sync.Mutex
+	reported      map[network.Conn]string
+	// the slots reserved for outbound connections, and the peers holding
+	// them, see outbound.go
+	outboundMutex    sync.Mutex
+	reservedOutbound int
+	reserved         map[peer.ID]bool
 }
 
-func newCodaConnectionManager(maxConnections int, minaPeerExchange bool) *CodaConnectionManager {
-	noop := func(net network.Network, c network.Conn) {}
+// The connection manager limits used when the daemon doesn't set them. The
+// high water mark has no default: it's the max_connections the helper is
+// configured with.
+const (
+	DefaultLowWater    = 25
+	DefaultGracePeriod = time.Millisecond
+)
 
+func newCodaConnectionManager(lowWater int, maxConnections int, gracePeriod time.Duration, minaPeerExchange bool) *CodaConnectionManager {
 	return &CodaConnectionManager{
-		p2pManager:       p2pconnmgr.NewConnManager(25, maxConnections, time.Duration(1*time.Millisecond)),
-		OnConnect:        noop,
-		OnDisconnect:     noop,
+		p2pManager:       p2pconnmgr.NewConnManager(lowWater, maxConnections, gracePeriod),
+		protections:      make(map[peer.ID]map[string]struct{}),
+		decayingTags:     make(map[string]*codaDecayingTag),
+		reserved:         make(map[peer.ID]bool),
+		reported:         make(map[network.Conn]string),
+		OnConnect:        func(network.Network, network.Conn) {},
+		OnDisconnect:     func(network.Network, network.Conn, string) {},
 		minaPeerExchange: minaPeerExchange,
 	}
 }
 
+func (cm *CodaConnectionManager) manager() *p2pconnmgr.BasicConnMgr {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.p2pManager
+}
+
+// SetLimits changes the watermarks and grace period of the connection
+// manager. BasicConnMgr can't change those once created, so this replaces it
+// with a new one that takes over the open connections, tags, protections and
+// decaying tags of the old one.
+func (cm *CodaConnectionManager) SetLimits(net network.Network, lowWater int, highWater int, gracePeriod time.Duration) error {
+	cm.mutex.Lock()
+	old := cm.p2pManager
+	next := p2pconnmgr.NewConnManager(lowWater, highWater, gracePeriod)
+
+	for _, c := range net.Conns() {
+		next.Notifee().Connected(net, c)
+	}
+
+	for _, p := range net.Peers() {
+		info := old.GetTagInfo(p)
+		if info == nil {
+			continue
+		}
+		for tag, value := range info.Tags {
+			if _, decaying := cm.decayingTags[tag]; !decaying {
+				next.TagPeer(p, tag, value)
+			}
+		}
+	}
+
+	for p, tags := range cm.protections {
+		for tag := range tags {
+			next.Protect(p, tag)
+		}
+	}
+
+	var errs []error
+	for _, tag := range cm.decayingTags {
+		if err := tag.moveTo(next, old, net.Peers()); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	cm.p2pManager = next
+	cm.mutex.Unlock()
+
+	if err := old.Close(); err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to carry connection manager state over: %v", errs)
+	}
+	return nil
+}
+
 // proxy connmgr.ConnManager interface to p2pconnmgr.BasicConnMgr
 func (cm *CodaConnectionManager) TagPeer(p peer.ID, tag string, weight int) {
-	cm.p2pManager.TagPeer(p, tag, weight)
+	cm.manager().TagPeer(p, tag, weight)
 }
-func (cm *CodaConnectionManager) UntagPeer(p peer.ID, tag string) { cm.p2pManager.UntagPeer(p, tag) }
+func (cm *CodaConnectionManager) UntagPeer(p peer.ID, tag string) { cm.manager().UntagPeer(p, tag) }
 func (cm *CodaConnectionManager) UpsertTag(p peer.ID, tag string, upsert func(int) int) {
-	cm.p2pManager.UpsertTag(p, tag, upsert)
+	cm.manager().UpsertTag(p, tag, upsert)
 }
 func (cm *CodaConnectionManager) GetTagInfo(p peer.ID) *connmgr.TagInfo {
-	return cm.p2pManager.GetTagInfo(p)
+	return cm.manager().GetTagInfo(p)
+}
+func (cm *CodaConnectionManager) TrimOpenConns(ctx context.Context) { cm.manager().TrimOpenConns(ctx) }
+func (cm *CodaConnectionManager) Protect(p peer.ID, tag string) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	if cm.protections[p] == nil {
+		cm.protections[p] = make(map[string]struct{})
+	}
+	cm.protections[p][tag] = struct{}{}
+	cm.p2pManager.Protect(p, tag)
 }
-func (cm *CodaConnectionManager) TrimOpenConns(ctx context.Context) { cm.p2pManager.TrimOpenConns(ctx) }
-func (cm *CodaConnectionManager) Protect(p peer.ID, tag string)     { cm.p2pManager.Protect(p, tag) }
 func (cm *CodaConnectionManager) Unprotect(p peer.ID, tag string) bool {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
+	delete(cm.protections[p], tag)
+	if len(cm.protections[p]) == 0 {
+		delete(cm.protections, p)
+	}
 	return cm.p2pManager.Unprotect(p, tag)
 }
 func (cm *CodaConnectionManager) IsProtected(p peer.ID, tag string) bool {
-	return cm.p2pManager.IsProtected(p, tag)
+	return cm.manager().IsProtected(p, tag)
 }
-func (cm *CodaConnectionManager) Close() error { return cm.p2pManager.Close() }
+func (cm *CodaConnectionManager) Close() error { return cm.manager().Close() }
 
 // proxy connmgr.Decayer interface to p2pconnmgr.BasicConnMgr (which implements connmgr.Decayer via struct inheritance)
 func (cm *CodaConnectionManager) RegisterDecayingTag(name string, interval time.Duration, decayFn connmgr.DecayFn, bumpFn connmgr.BumpFn) (connmgr.DecayingTag, error) {
+	cm.mutex.Lock()
+	defer cm.mutex.Unlock()
+
 	// casting to Decayer here should always succeed
 	decayer, _ := interface{}(cm.p2pManager).(connmgr.Decayer)
 	tag, err := decayer.RegisterDecayingTag(name, interval, decayFn, bumpFn)
-	return tag, err
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped := &codaDecayingTag{cm: cm, tag: tag, decayFn: decayFn, bumpFn: bumpFn}
+	cm.decayingTags[name] = wrapped
+	return wrapped, nil
+}
+
+// DecayingTag returns the decaying tag registered under name, if any
+func (cm *CodaConnectionManager) DecayingTag(name string) (connmgr.DecayingTag, bool) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+
+	tag, ok := cm.decayingTags[name]
+	if !ok {
+		return nil, false
+	}
+	return tag, true
+}
+
+// codaDecayingTag forwards to the decaying tag registered with the current
+// p2pManager, so that tags handed out (e.g. to pubsub) survive SetLimits
+type codaDecayingTag struct {
+	cm      *CodaConnectionManager
+	tag     connmgr.DecayingTag
+	decayFn connmgr.DecayFn
+	bumpFn  connmgr.BumpFn
+}
+
+func (t *codaDecayingTag) current() connmgr.DecayingTag {
+	t.cm.mutex.RLock()
+	defer t.cm.mutex.RUnlock()
+	return t.tag
+}
+
+func (t *codaDecayingTag) Name() string                    { return t.current().Name() }
+func (t *codaDecayingTag) Interval() time.Duration         { return t.current().Interval() }
+func (t *codaDecayingTag) Bump(p peer.ID, delta int) error { return t.current().Bump(p, delta) }
+func (t *codaDecayingTag) Remove(p peer.ID) error          { return t.current().Remove(p) }
+func (t *codaDecayingTag) Close() error {
+	t.cm.mutex.Lock()
+	defer t.cm.mutex.Unlock()
+
+	delete(t.cm.decayingTags, t.tag.Name())
+	return t.tag.Close()
+}
+
+// moveTo registers the tag with next, bumping it to the values it had in old.
+// The caller must hold cm.mutex.
+func (t *codaDecayingTag) moveTo(next *p2pconnmgr.BasicConnMgr, old *p2pconnmgr.BasicConnMgr, peers []peer.ID) error {
+	name := t.tag.Name()
+	tag, err := next.RegisterDecayingTag(name, t.tag.Interval(), t.decayFn, t.bumpFn)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range peers {
+		info := old.GetTagInfo(p)
+		if info == nil {
+			continue
+		}
+		if value, ok := info.Tags[name]; ok && value != 0 {
+			if err := tag.Bump(p, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	t.tag = tag
+	return nil
 }
 
 // redirect Notifee() to self for notification interception
@@ -141,28 +332,50 @@ func (cm *CodaConnectionManager) Notifee() network.Notifiee { return cm }
 
 // proxy Notifee notifications to p2pconnmgr.BasicConnMgr, intercepting Connected and Disconnected
 func (cm *CodaConnectionManager) Listen(net network.Network, addr ma.Multiaddr) {
-	cm.p2pManager.Notifee().Listen(net, addr)
+	cm.manager().Notifee().Listen(net, addr)
 }
 func (cm *CodaConnectionManager) ListenClose(net network.Network, addr ma.Multiaddr) {
-	cm.p2pManager.Notifee().ListenClose(net, addr)
+	cm.manager().Notifee().ListenClose(net, addr)
 }
 func (cm *CodaConnectionManager) OpenedStream(net network.Network, stream network.Stream) {
-	cm.p2pManager.Notifee().OpenedStream(net, stream)
+	cm.manager().Notifee().OpenedStream(net, stream)
 }
 func (cm *CodaConnectionManager) ClosedStream(net network.Network, stream network.Stream) {
-	cm.p2pManager.Notifee().ClosedStream(net, stream)
+	cm.manager().Notifee().ClosedStream(net, stream)
 }
 func (cm *CodaConnectionManager) Connected(net network.Network, c network.Conn) {
 	logger.Debugf("%s connected to %s", c.LocalPeer(), c.RemotePeer())
-	cm.OnConnect(net, c)
+	// holding the lock means SetLimits either sees this connection in
+	// net.Conns() or the new manager is the one notified
+	cm.mutex.RLock()
 	cm.p2pManager.Notifee().Connected(net, c)
+	cm.mutex.RUnlock()
+	cm.trackOutbound(net, c)
+
+	info := cm.GetInfo()
+	surplus := cm.inboundSurplus(net, c, info.HighWater)
+	tooMany := cm.minaPeerExchange && len(net.Peers()) > info.HighWater
+
+	// a connection about to be closed again isn't reported at all, rather
+	// than as connecting and then disconnecting right away
+	if !surplus && !tooMany {
+		cm.reportedMutex.Lock()
+		cm.reported[c] = ""
+		cm.reportedMutex.Unlock()
+		cm.OnConnect(net, c)
+	}
 
 	if !cm.minaPeerExchange {
+		if surplus {
+			logger.Debugf("node=%s disconnecting from peer=%s; inbound slots are full", c.LocalPeer(), c.RemotePeer())
+			go func() {
+				_ = cm.closeConn(c, CloseInboundSurplus)
+			}()
+		}
 		return
 	}
 
-	info := cm.GetInfo()
-	if len(net.Peers()) <= info.HighWater {
+	if !surplus && !tooMany {
 		return
 	}
 
@@ -170,11 +383,15 @@ func (cm *CodaConnectionManager) Connected(net network.Network, c network.Conn)
 
 	logger.Debugf("node=%s disconnecting from peer=%s; max peers=%d peercount=%d", c.LocalPeer(), c.RemotePeer(), info.HighWater, len(net.Peers()))
 
+	reason := CloseTooManyPeers
+	if surplus {
+		reason = CloseInboundSurplus
+	}
 	defer func() {
 		go func() {
 			// small delay to allow for remote peer to read from stream
 			time.Sleep(time.Millisecond * 400)
-			_ = c.Close()
+			_ = cm.closeConn(c, reason)
 		}()
 	}()
 
@@ -210,13 +427,71 @@ func (cm *CodaConnectionManager) Connected(net network.Network, c network.Conn)
 }
 
 func (cm *CodaConnectionManager) Disconnected(net network.Network, c network.Conn) {
-	cm.OnDisconnect(net, c)
+	cm.reportedMutex.Lock()
+	reason, reported := cm.reported[c]
+	delete(cm.reported, c)
+	cm.reportedMutex.Unlock()
+	if reported {
+		cm.OnDisconnect(net, c, reason)
+	}
+
+	cm.mutex.RLock()
 	cm.p2pManager.Notifee().Disconnected(net, c)
+	cm.mutex.RUnlock()
+	cm.trackOutbound(net, c)
+}
+
+// The reasons the connection manager closes connections for, besides the
+// gating rules a connection no longer passes
+const (
+	CloseInboundSurplus = "inbound_surplus"
+	CloseTooManyPeers   = "too_many_peers"
+)
+
+// closeConn closes c, giving reason as the reason it was closed for
+func (cm *CodaConnectionManager) closeConn(c network.Conn, reason string) error {
+	cm.reportedMutex.Lock()
+	if _, ok := cm.reported[c]; ok {
+		cm.reported[c] = reason
+	}
+	cm.reportedMutex.Unlock()
+
+	return c.Close()
+}
+
+// IsReported reports whether OnConnect was called for any open connection to
+// p
+func (cm *CodaConnectionManager) IsReported(p peer.ID) bool {
+	cm.reportedMutex.Lock()
+	defer cm.reportedMutex.Unlock()
+
+	for c := range cm.reported {
+		if c.RemotePeer() == p {
+			return true
+		}
+	}
+	return false
+}
+
+// ForgetReported forgets the reported connections to p, so that OnDisconnect
+// isn't called for them, returning whether there were any
+func (cm *CodaConnectionManager) ForgetReported(p peer.ID) bool {
+	cm.reportedMutex.Lock()
+	defer cm.reportedMutex.Unlock()
+
+	forgot := false
+	for c := range cm.reported {
+		if c.RemotePeer() == p {
+			delete(cm.reported, c)
+			forgot = true
+		}
+	}
+	return forgot
 }
 
 // proxy remaining p2pconnmgr.BasicConnMgr methods for access
 func (cm *CodaConnectionManager) GetInfo() p2pconnmgr.CMInfo {
-	return cm.p2pManager.GetInfo()
+	return cm.manager().GetInfo()
 }
 
 // Helper contains all the daemon state
@@ -235,18 +510,121 @@ type Helper struct {
 	BandwidthCounter  *metrics.BandwidthCounter
 	Seeds             []peer.AddrInfo
 	NodeStatus        string
+
+	// opened by MakeHelper, closed by Close
+	datastores []*dsb.Datastore
+	// read by the host's AddrsFactory
+	external *advertisedAddr
+	// stops expireBans
+	stopBanExpiry context.CancelFunc
+	// where GatingState is saved, empty if it isn't
+	gatingStatePath string
+	// serializes saves of GatingState
+	gatingStateMutex sync.Mutex
+}
+
+// advertisedAddr is the external address we advertise in addition to the
+// ones we listen on, if any
+type advertisedAddr struct {
+	mutex sync.RWMutex
+	addr  ma.Multiaddr
+}
+
+func (e *advertisedAddr) get() ma.Multiaddr {
+	e.mutex.RLock()
+	defer e.mutex.RUnlock()
+	return e.addr
+}
+
+// ExternalAddr returns the external address the host advertises, or nil
+func (h *Helper) ExternalAddr() ma.Multiaddr {
+	return h.external.get()
+}
+
+// SetExternalAddr changes the external address the host advertises. Peers
+// learn about it the next time the host checks its addresses for changes.
+func (h *Helper) SetExternalAddr(addr ma.Multiaddr) {
+	h.external.mutex.Lock()
+	defer h.external.mutex.Unlock()
+	h.external.addr = addr
+}
+
+// Close tears down what MakeHelper and beginAdvertising set up: mDNS, the
+// DHT, the host with all its connections, then the peerstore and finally the
+// badger datastores backing it and the DHT, so that those are left in a clean
+// state.
+func (h *Helper) Close() error {
+	var errs []error
+
+	h.stopBanExpiry()
+
+	if h.Mdns != nil {
+		if err := (*h.Mdns).Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing mDNS: %w", err))
+		}
+	}
+
+	if h.Dht != nil {
+		if err := h.Dht.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing DHT: %w", err))
+		}
+	}
+
+	if err := h.Host.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing host: %w", err))
+	}
+
+	if err := h.Host.Peerstore().Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing peerstore: %w", err))
+	}
+
+	for _, ds := range h.datastores {
+		if err := ds.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("closing datastore: %w", err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close helper cleanly: %v", errs)
+	}
+	return nil
 }
 
 // this type implements the ConnectionGating interface
 // https://godoc.org/github.com/libp2p/go-libp2p-core/connmgr#ConnectionGating
 // the comments of the functions below are taken from those docs.
+//
+// The host keeps using the CodaGatingState it was made with, so changes to
+// the rules must be made in place with Update, which holds mutex against the
+// Intercept* functions reading them.
 type CodaGatingState struct {
 	logger                  logging.EventLogger
+	mutex                   sync.RWMutex
 	KnownPrivateAddrFilters *ma.Filters
 	BannedAddrFilters       *ma.Filters
 	TrustedAddrFilters      *ma.Filters
 	BannedPeers             *peer.Set
 	TrustedPeers            *peer.Set
+	// the bans in BannedPeers and BannedAddrFilters that expire, by banKey
+	timedBans map[string]Ban
+	// called with each timed ban once it has been lifted
+	OnBanExpired func(Ban)
+	// the latest decisions of the Intercept* functions
+	events *gatingEventLog
+	// what InterceptUpgraded allows
+	UpgradePolicy UpgradePolicy
+	// called with each connection InterceptUpgraded rejects, and why. The
+	// connection never makes it to the host, so there is no notification of
+	// it being closed.
+	OnUpgradeRejected func(network.Conn, control.DisconnectReason)
+	// what was negotiated for the connections being upgraded
+	upgrades *upgradeTable
+	// the network of the host using the gating state, once there is one
+	network network.Network
+	// caps on the inbound connections InterceptSecured allows
+	InboundLimits InboundLimits
+	// the inbound connections allowed but not yet in the network
+	inbound *inboundTracker
 }
 
 // NewCodaGatingState returns a new CodaGatingState
@@ -271,7 +649,9 @@ func NewCodaGatingState(bannedAddrFilters *ma.Filters, trustedAddrFilters *ma.Fi
 
 	// we initialize the known private addr filters to reject all ip addresses initially
 	knownPrivateAddrFilters := ma.NewFilters()
-	knownPrivateAddrFilters.AddFilter(parseCIDR("0.0.0.0/0"), ma.ActionDeny)
+	for _, cidr := range allIPCIDRs {
+		knownPrivateAddrFilters.AddFilter(parseCIDR(cidr), ma.ActionDeny)
+	}
 
 	return &CodaGatingState{
 		logger:                  logger,
@@ -280,7 +660,73 @@ func NewCodaGatingState(bannedAddrFilters *ma.Filters, trustedAddrFilters *ma.Fi
 		KnownPrivateAddrFilters: knownPrivateAddrFilters,
 		BannedPeers:             bannedPeers,
 		TrustedPeers:            trustedPeers,
+		timedBans:               make(map[string]Ban),
+		OnBanExpired:            func(Ban) {},
+		events:                  &gatingEventLog{},
+		OnUpgradeRejected:       func(network.Conn, control.DisconnectReason) {},
+		upgrades:                newUpgradeTable(),
+		inbound:                 newInboundTracker(),
+	}
+}
+
+// Update atomically replaces the banned and trusted addresses and peers, the
+// timed bans among them, the upgrade policy and the inbound limits with those
+// of newState.
+// Private addresses already marked as known stay known.
+func (gs *CodaGatingState) Update(newState *CodaGatingState) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+	newState.mutex.RLock()
+	defer newState.mutex.RUnlock()
+
+	gs.BannedAddrFilters = newState.BannedAddrFilters
+	gs.TrustedAddrFilters = newState.TrustedAddrFilters
+	gs.BannedPeers = newState.BannedPeers
+	gs.TrustedPeers = newState.TrustedPeers
+	gs.timedBans = make(map[string]Ban, len(newState.timedBans))
+	for key, ban := range newState.timedBans {
+		gs.timedBans[key] = ban
+	}
+	gs.UpgradePolicy = newState.UpgradePolicy
+	gs.InboundLimits = newState.InboundLimits
+}
+
+// TrustPeer adds p to the trusted peers
+func (gs *CodaGatingState) TrustPeer(p peer.ID) {
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
+
+	gs.TrustedPeers.Add(p)
+}
+
+// DistrustPeer undoes TrustPeer
+func (gs *CodaGatingState) DistrustPeer(p peer.ID) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	trusted := peer.NewSet()
+	for _, other := range gs.TrustedPeers.Peers() {
+		if other != p {
+			trusted.Add(other)
+		}
 	}
+	gs.TrustedPeers = trusted
+}
+
+// AllowsConn checks if the current rules allow an established connection,
+// i.e. if it would pass InterceptSecured if it was made now
+func (gs *CodaGatingState) AllowsConn(c network.Conn) bool {
+	allow, _ := gs.connRule(c)
+	return allow
+}
+
+// connRule decides like AllowsConn, and also says which rule the decision was
+// made by
+func (gs *CodaGatingState) connRule(c network.Conn) (bool, GatingRule) {
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
+
+	return gs.peerWithAddrRule(c.RemotePeer(), c.RemoteMultiaddr())
 }
 
 func (gs *CodaGatingState) MarkPrivateAddrAsKnown(addr ma.Multiaddr) {
@@ -309,11 +755,6 @@ func (gs *CodaGatingState) isPeerBanned(p peer.ID) bool {
 	return gs.BannedPeers.Contains(p)
 }
 
-// checks if a peer id is allowed to dial/accept
-func (gs *CodaGatingState) isAllowedPeer(p peer.ID) bool {
-	return gs.isPeerTrusted(p) || !gs.isPeerBanned(p)
-}
-
 func (gs *CodaGatingState) isAddrTrusted(addr ma.Multiaddr) bool {
 	return !gs.TrustedAddrFilters.AddrBlocked(addr)
 }
@@ -324,29 +765,81 @@ func (gs *CodaGatingState) isAddrBanned(addr ma.Multiaddr) bool {
 
 // checks if an address is allowed to dial/accept
 func (gs *CodaGatingState) isAllowedAddr(addr ma.Multiaddr) bool {
-	publicOrKnownPrivate := !isPrivateAddr(addr) || !gs.KnownPrivateAddrFilters.AddrBlocked(addr)
-	return gs.isAddrTrusted(addr) || (!gs.isAddrBanned(addr) && publicOrKnownPrivate)
+	allow, _ := gs.addrRule(addr)
+	return allow
 }
 
 // checks if a peer is allowed to dial/accept; if the peer is in the trustlist, the address checks are overriden
 func (gs *CodaGatingState) isAllowedPeerWithAddr(p peer.ID, addr ma.Multiaddr) bool {
-	return gs.isPeerTrusted(p) || (gs.isAllowedPeer(p) && gs.isAllowedAddr(addr))
+	allow, _ := gs.peerWithAddrRule(p, addr)
+	return allow
+}
+
+// the *Rule functions decide like the is* functions above, and also say which
+// rule the decision was made by
+
+func (gs *CodaGatingState) peerRule(p peer.ID) (bool, GatingRule) {
+	if gs.isPeerTrusted(p) {
+		return true, RuleTrustedPeer
+	}
+	if gs.isPeerBanned(p) {
+		return false, RuleBannedPeer
+	}
+	return true, RuleDefault
+}
+
+func (gs *CodaGatingState) acceptRule(addr ma.Multiaddr) (bool, GatingRule) {
+	if gs.isAddrTrusted(addr) {
+		return true, RuleTrustedIP
+	}
+	if gs.isAddrBanned(addr) {
+		return false, gs.banRule(addr)
+	}
+	return true, RuleDefault
 }
 
-func (gs *CodaGatingState) logGate() {
-	gs.logger.Debugf("gated a connection with config: %+v", gs)
+func (gs *CodaGatingState) addrRule(addr ma.Multiaddr) (bool, GatingRule) {
+	if allow, rule := gs.acceptRule(addr); rule != RuleDefault {
+		return allow, rule
+	}
+	if isPrivateAddr(addr) && gs.KnownPrivateAddrFilters.AddrBlocked(addr) {
+		return false, RuleUnknownPrivateAddr
+	}
+	return true, RuleDefault
+}
+
+func (gs *CodaGatingState) peerWithAddrRule(p peer.ID, addr ma.Multiaddr) (bool, GatingRule) {
+	if allow, rule := gs.peerRule(p); rule != RuleDefault {
+		return allow, rule
+	}
+	return gs.addrRule(addr)
+}
+
+// banRule tells apart an address banned by a range covering it from one
+// banned because the node is isolated. addr must be banned.
+func (gs *CodaGatingState) banRule(addr ma.Multiaddr) GatingRule {
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return RuleBannedIP
+	}
+	for _, ipnet := range gs.BannedAddrFilters.FiltersForAction(ma.ActionDeny) {
+		if ipnet.Contains(ip) && !isAllIPs(ipnet) {
+			return RuleBannedIP
+		}
+	}
+	return RuleIsolate
 }
 
 // InterceptPeerDial tests whether we're permitted to Dial the specified peer.
 //
 // This is called by the network.Network implementation when dialling a peer.
 func (gs *CodaGatingState) InterceptPeerDial(p peer.ID) (allow bool) {
-	allow = gs.isAllowedPeer(p)
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
 
-	if !allow {
-		gs.logger.Infof("disallowing peer dial to: %v (peer)", p)
-		gs.logGate()
-	}
+	var rule GatingRule
+	allow, rule = gs.peerRule(p)
+	gs.record(StagePeerDial, p, nil, allow, rule)
 
 	return
 }
@@ -357,12 +850,12 @@ func (gs *CodaGatingState) InterceptPeerDial(p peer.ID) (allow bool) {
 // This is called by the network.Network implementation after it has
 // resolved the peer's addrs, and prior to dialling each.
 func (gs *CodaGatingState) InterceptAddrDial(id peer.ID, addr ma.Multiaddr) (allow bool) {
-	allow = gs.isAllowedPeerWithAddr(id, addr)
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
 
-	if !allow {
-		gs.logger.Infof("disallowing peer dial to: %v + %v (peer + address)", id, addr)
-		gs.logGate()
-	}
+	var rule GatingRule
+	allow, rule = gs.peerWithAddrRule(id, addr)
+	gs.record(StageAddrDial, id, addr, allow, rule)
 
 	return
 }
@@ -372,13 +865,13 @@ func (gs *CodaGatingState) InterceptAddrDial(id peer.ID, addr ma.Multiaddr) (all
 // This is called by the upgrader, or by the transport directly (e.g. QUIC,
 // Bluetooth), straight after it has accepted a connection from its socket.
 func (gs *CodaGatingState) InterceptAccept(addrs network.ConnMultiaddrs) (allow bool) {
-	remoteAddr := addrs.RemoteMultiaddr()
-	allow = gs.isAddrTrusted(remoteAddr) || !gs.isAddrBanned(remoteAddr)
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
 
-	if !allow {
-		gs.logger.Infof("refusing to accept inbound connection from addr: %v", remoteAddr)
-		gs.logGate()
-	}
+	remoteAddr := addrs.RemoteMultiaddr()
+	var rule GatingRule
+	allow, rule = gs.acceptRule(remoteAddr)
+	gs.record(StageAccept, "", remoteAddr, allow, rule)
 
 	// If we are receiving a connection, and the remote address is private,
 	// then we infer that we should be able to connect to that private address.
@@ -395,17 +888,23 @@ func (gs *CodaGatingState) InterceptAccept(addrs network.ConnMultiaddrs) (allow
 // This is called by the upgrader, after it has performed the security
 // handshake, and before it negotiates the muxer, or by the directly by the
 // transport, at the exact same checkpoint.
-func (gs *CodaGatingState) InterceptSecured(_ network.Direction, id peer.ID, addrs network.ConnMultiaddrs) (allow bool) {
-	// note: we don't care about the direction (inbound/outbound). all
+func (gs *CodaGatingState) InterceptSecured(dir network.Direction, id peer.ID, addrs network.ConnMultiaddrs) (allow bool) {
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
+
+	// note: the rules don't care about the direction (inbound/outbound). all
 	// connections in coda are symmetric: if i am allowed to connect to
-	// you, you are allowed to connect to me.
+	// you, you are allowed to connect to me. only the number of inbound
+	// connections is limited, as we don't choose who connects to us.
 	remoteAddr := addrs.RemoteMultiaddr()
-	allow = gs.isAllowedPeerWithAddr(id, remoteAddr)
-
-	if !allow {
-		gs.logger.Infof("refusing to accept inbound connection from authenticated addr: %v", remoteAddr)
-		gs.logGate()
+	var rule GatingRule
+	allow, rule = gs.peerWithAddrRule(id, remoteAddr)
+	if allow && dir == network.DirInbound {
+		if inboundAllow, inboundRule := gs.inboundRule(id, remoteAddr); !inboundAllow {
+			allow, rule = inboundAllow, inboundRule
+		}
 	}
+	gs.record(StageSecured, id, remoteAddr, allow, rule)
 
 	return
 }
@@ -416,13 +915,47 @@ func (gs *CodaGatingState) InterceptSecured(_ network.Direction, id peer.ID, add
 // When rejecting a connection, the gater can return a DisconnectReason.
 // Refer to the godoc on the ConnectionGating type for more information.
 //
-// NOTE: the go-libp2p implementation currently IGNORES the disconnect reason.
-func (gs *CodaGatingState) InterceptUpgraded(network.Conn) (allow bool, reason control.DisconnectReason) {
-	allow = true
-	reason = control.DisconnectReason(0)
+// NOTE: the go-libp2p implementation currently IGNORES the disconnect reason,
+// which is why it is passed to OnUpgradeRejected as well.
+func (gs *CodaGatingState) InterceptUpgraded(c network.Conn) (allow bool, reason control.DisconnectReason) {
+	gs.mutex.RLock()
+	allow, reason = gs.upgradeRule(c)
+	gs.mutex.RUnlock()
+
+	rule := RuleDefault
+	if !allow {
+		rule = DisconnectReasonRule(reason)
+	}
+	gs.record(StageUpgraded, c.RemotePeer(), c.RemoteMultiaddr(), allow, rule)
+
+	if !allow {
+		gs.OnUpgradeRejected(c, reason)
+	}
 	return
 }
 
+// UpdateGatingState applies the rules of newState to the live host, closes
+// the connections they no longer allow and saves them to the statedir, if
+// the helper persists its gating state. Failing to save doesn't keep the
+// rules from applying.
+func (h *Helper) UpdateGatingState(newState *CodaGatingState) error {
+	h.GatingState.Update(newState)
+
+	for _, c := range h.Host.Network().Conns() {
+		allow, rule := h.GatingState.connRule(c)
+		if allow {
+			continue
+		}
+
+		logger.Infof("closing connection to %s at %s, which is no longer allowed", c.RemotePeer(), c.RemoteMultiaddr())
+		if err := h.ConnectionManager.closeConn(c, string(rule)); err != nil {
+			logger.Debugf("failed to close connection to %s: %s", c.RemotePeer(), err)
+		}
+	}
+
+	return h.saveGatingState()
+}
+
 func (h *Helper) getRandomPeers(num int, from peer.ID) []peer.AddrInfo {
 	peers := h.Host.Peerstore().Peers()
 	if len(peers)-2 < num {
@@ -542,31 +1075,43 @@ func (h *Helper) handleNodeStatusStreams(s network.Stream) {
 	logger.Debugf("wrote node status to stream %s", s.Protocol())
 }
 
-// MakeHelper does all the initialization to run one host
-func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Multiaddr, statedir string, pk crypto.PrivKey, networkID string, seeds []peer.AddrInfo, gatingState *CodaGatingState, maxConnections int, minaPeerExchange bool) (*Helper, error) {
+// MakeHelper does all the initialization to run one host. maxConnections,
+// lowWater and gracePeriod are the limits of the connection manager, see
+// p2pconnmgr.NewConnManager. With persistGatingState, the gating state saved
+// in statedir by a previous run is added to gatingState before the host is
+// created, and kept up to date.
+func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Multiaddr, statedir string, pk crypto.PrivKey, networkID string, seeds []peer.AddrInfo, gatingState *CodaGatingState, maxConnections int, lowWater int, gracePeriod time.Duration, minaPeerExchange bool, persistGatingState bool) (*Helper, error) {
 	me, err := peer.IDFromPrivateKey(pk)
 	if err != nil {
-		return nil, err
+		return nil, withCode(ErrCodeInitFailed, err)
 	}
 
 	initPrivateIpFilter()
 
+	var gatingStatePath string
+	if persistGatingState {
+		if err := loadGatingState(gatingState, statedir, time.Now()); err != nil {
+			return nil, withCode(ErrCodeInitFailed, err)
+		}
+		gatingStatePath = path.Join(statedir, gatingStateFile)
+	}
+
 	dso := dsb.DefaultOptions
 
 	ds, err := dsb.NewDatastore(path.Join(statedir, "libp2p-peerstore-v0"), &dso)
 	if err != nil {
-		return nil, err
+		return nil, withCode(ErrCodeInitFailed, err)
 	}
 
 	dsoDht := dsb.DefaultOptions
 	dsDht, err := dsb.NewDatastore(path.Join(statedir, "libp2p-dht-v0"), &dsoDht)
 	if err != nil {
-		return nil, err
+		return nil, withCode(ErrCodeInitFailed, err)
 	}
 
 	ps, err := pstoreds.NewPeerstore(ctx, ds, pstoreds.DefaultOpts())
 	if err != nil {
-		return nil, err
+		return nil, withCode(ErrCodeInitFailed, err)
 	}
 
 	rendezvousString := fmt.Sprintf("/coda/0.0.1/%s", networkID)
@@ -580,11 +1125,23 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 
 	mplex.MaxMessageSize = 1 << 30
 
-	connManager := newCodaConnectionManager(maxConnections, minaPeerExchange)
+	connManager := newCodaConnectionManager(lowWater, maxConnections, gracePeriod, minaPeerExchange)
+	external := &advertisedAddr{addr: externalAddr}
 	bandwidthCounter := metrics.NewBandwidthCounter()
 
+	noiseTpt, err := noise.New(pk)
+	if err != nil {
+		return nil, withCode(ErrCodeInitFailed, err)
+	}
+	tlsTpt, err := tls.New(pk)
+	if err != nil {
+		return nil, withCode(ErrCodeInitFailed, err)
+	}
+
 	host, err := p2p.New(ctx,
-		p2p.Muxer("/coda/mplex/1.0.0", libp2pmplex.DefaultTransport),
+		p2p.Muxer("/coda/mplex/1.0.0", gatingState.tagMuxer("/coda/mplex/1.0.0", libp2pmplex.DefaultTransport)),
+		p2p.Security(noise.ID, gatingState.tagSecurity(noise.ID, noiseTpt)),
+		p2p.Security(tls.ID, gatingState.tagSecurity(tls.ID, tlsTpt)),
 		p2p.Identity(pk),
 		p2p.Peerstore(ps),
 		p2p.DisableRelay(),
@@ -592,8 +1149,8 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 		p2p.ConnectionManager(connManager),
 		p2p.ListenAddrs(listenOn...),
 		p2p.AddrsFactory(func(as []ma.Multiaddr) []ma.Multiaddr {
-			if externalAddr != nil {
-				as = append(as, externalAddr)
+			if addr := external.get(); addr != nil {
+				as = append(as, addr)
 			}
 
 			return as
@@ -619,9 +1176,11 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 	)
 
 	if err != nil {
-		return nil, err
+		return nil, withCode(ErrCodeInitFailed, err)
 	}
 
+	gatingState.setNetwork(host.Network())
+
 	// nil fields are initialized by beginAdvertising
 	h := &Helper{
 		Host:              host,
@@ -637,8 +1196,19 @@ func MakeHelper(ctx context.Context, listenOn []ma.Multiaddr, externalAddr ma.Mu
 		ConnectionManager: connManager,
 		BandwidthCounter:  bandwidthCounter,
 		Seeds:             seeds,
+		datastores:        []*dsb.Datastore{ds, dsDht},
+		external:          external,
+		gatingStatePath:   gatingStatePath,
 	}
 
+	if err := h.saveGatingState(); err != nil {
+		logger.Errorf("failed to save gating state: %s", err)
+	}
+
+	banExpiryCtx, stopBanExpiry := context.WithCancel(ctx)
+	h.stopBanExpiry = stopBanExpiry
+	go h.expireBans(banExpiryCtx)
+
 	if !minaPeerExchange {
 		return h, nil
 	}
@@ -1,10 +1,24 @@
 package codanet
 
 import (
+	"context"
+	crand "crypto/rand"
+	"errors"
+	"fmt"
+	"io/ioutil"
 	gonet "net"
+	"path"
+	"sync"
 	"testing"
+	"time"
 
+	dsb "github.com/ipfs/go-ds-badger"
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/crypto"
+	"github.com/libp2p/go-libp2p-core/network"
 	peer "github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/routing"
+	swarm "github.com/libp2p/go-libp2p-swarm"
 	ma "github.com/multiformats/go-multiaddr"
 
 	"github.com/stretchr/testify/require"
@@ -39,6 +53,486 @@ func TestTrustedPrivateConnectionGating(t *testing.T) {
 	require.True(t, allowed)
 }
 
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		code ErrorCode
+	}{
+		{context.DeadlineExceeded, ErrCodeTimeout},
+		{fmt.Errorf("opening stream: %w", context.DeadlineExceeded), ErrCodeTimeout},
+		{&swarm.DialError{Peer: peer.ID("testid"), Cause: swarm.ErrGaterDisallowedConnection}, ErrCodeGated},
+		{&swarm.DialError{Peer: peer.ID("testid"), Cause: swarm.ErrNoAddresses}, ErrCodePeerUnreachable},
+		{&swarm.DialError{Peer: peer.ID("testid")}, ErrCodePeerUnreachable},
+		{swarm.ErrDialBackoff, ErrCodePeerUnreachable},
+		{routing.ErrNotFound, ErrCodePeerUnreachable},
+		{withCode(ErrCodeInitFailed, errors.New("no statedir")), ErrCodeInitFailed},
+		{errors.New("something else"), ErrCodeLibp2p},
+	} {
+		require.Equal(t, tc.code, ClassifyError(tc.err), tc.err.Error())
+	}
+}
+
+func TestHelperClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+
+	pk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	require.NoError(t, err)
+
+	h, err := MakeHelper(context.Background(), []ma.Multiaddr{addr}, nil, dir, pk, "test", nil, NewCodaGatingState(nil, nil, nil, nil), 50, DefaultLowWater, DefaultGracePeriod, false, false)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	// badger holds a lock on its directory until it is closed cleanly
+	for _, name := range []string{"libp2p-peerstore-v0", "libp2p-dht-v0"} {
+		dso := dsb.DefaultOptions
+		ds, err := dsb.NewDatastore(path.Join(dir, name), &dso)
+		require.NoError(t, err, name)
+		require.NoError(t, ds.Close())
+	}
+}
+
+type testConnAddrs struct {
+	local  ma.Multiaddr
+	remote ma.Multiaddr
+}
+
+func (a testConnAddrs) LocalMultiaddr() ma.Multiaddr  { return a.local }
+func (a testConnAddrs) RemoteMultiaddr() ma.Multiaddr { return a.remote }
+
+func TestIPv6PrivateConnectionGating(t *testing.T) {
+	initPrivateIpFilter()
+
+	gs := NewCodaGatingState(nil, nil, nil, nil)
+	for _, cidr := range allIPCIDRs {
+		gs.TrustedAddrFilters.AddFilter(parseCIDR(cidr), ma.ActionDeny)
+	}
+
+	local, err := ma.NewMultiaddr("/ip6/2001:db8::2/tcp/8302")
+	require.NoError(t, err)
+	public, err := ma.NewMultiaddr("/ip6/2001:db8::1/tcp/8302")
+	require.NoError(t, err)
+	require.False(t, isPrivateAddr(public))
+	require.True(t, gs.InterceptAddrDial(peer.ID("testid"), public))
+
+	for _, addr := range []string{"/ip6/fd00::1/tcp/8302", "/ip6/fe80::1/tcp/8302"} {
+		private, err := ma.NewMultiaddr(addr)
+		require.NoError(t, err)
+
+		require.True(t, isPrivateAddr(private), addr)
+		require.False(t, gs.InterceptAddrDial(peer.ID("testid"), private), addr)
+
+		// having been dialled from a private address makes it known
+		require.True(t, gs.InterceptAccept(testConnAddrs{local: local, remote: private}), addr)
+		require.True(t, gs.InterceptAddrDial(peer.ID("testid"), private), addr)
+	}
+}
+
+func TestTimedBans(t *testing.T) {
+	initPrivateIpFilter()
+
+	gs := NewCodaGatingState(nil, nil, nil, nil)
+	for _, cidr := range allIPCIDRs {
+		gs.TrustedAddrFilters.AddFilter(parseCIDR(cidr), ma.ActionDeny)
+	}
+
+	var expired []Ban
+	gs.OnBanExpired = func(ban Ban) { expired = append(expired, ban) }
+
+	timed := peer.ID("timed")
+	permanent := peer.ID("permanent")
+	ipnet := parseCIDR("1.2.3.0/24")
+	addr, err := ma.NewMultiaddr("/ip4/1.2.3.4/tcp/80")
+	require.NoError(t, err)
+
+	now := time.Now()
+	gs.BannedPeers.Add(permanent)
+	gs.BanPeerUntil(timed, now.Add(time.Minute), "test")
+	gs.BanPeerUntil(permanent, now.Add(time.Minute), "test")
+	gs.BanIPNetUntil(ipnet, now.Add(2*time.Minute), "test")
+	require.Len(t, gs.Bans(), 3)
+
+	gs.ExpireBans(now.Add(90 * time.Second))
+	require.Equal(t, []Ban{{Peer: timed, Expires: now.Add(time.Minute), Reason: "test"}}, expired)
+	require.True(t, gs.InterceptPeerDial(timed))
+	require.False(t, gs.InterceptPeerDial(permanent))
+	require.False(t, gs.InterceptAddrDial(timed, addr))
+
+	gs.ExpireBans(now.Add(3 * time.Minute))
+	require.Len(t, expired, 2)
+	require.True(t, gs.InterceptAddrDial(timed, addr))
+	require.Equal(t, []Ban{{Peer: permanent}}, gs.Bans())
+}
+
+func TestGatingStatePersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+
+	pk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	addr, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/0")
+	require.NoError(t, err)
+
+	banned, err := peer.Decode("12D3KooWGnQ4vat8EybAeFEK3jk78vmwDu9qMhZzcyQBPb16VCnS")
+	require.NoError(t, err)
+	trusted, err := peer.Decode("12D3KooWJDGPa2hiYCJ2o7XPqEq2tjrWpFJzqa4dy538Gfs7Vn2r")
+	require.NoError(t, err)
+
+	h, err := MakeHelper(context.Background(), []ma.Multiaddr{addr}, nil, dir, pk, "test", nil, NewCodaGatingState(nil, nil, nil, nil), 50, DefaultLowWater, DefaultGracePeriod, false, true)
+	require.NoError(t, err)
+
+	expires := time.Unix(0, time.Now().Add(time.Hour).UnixNano()/int64(time.Millisecond)*int64(time.Millisecond))
+	newState := NewCodaGatingState(nil, nil, nil, nil)
+	newState.TrustedPeers.Add(trusted)
+	newState.BanPeerUntil(banned, expires, "spamming")
+	newState.BannedAddrFilters.AddFilter(parseCIDR("1.2.3.0/24"), ma.ActionDeny)
+	// isolation isn't carried over to the next run
+	newState.BannedAddrFilters.AddFilter(parseCIDR("0.0.0.0/0"), ma.ActionDeny)
+	require.NoError(t, h.UpdateGatingState(newState))
+	require.NoError(t, h.Close())
+
+	gs := NewCodaGatingState(nil, nil, nil, nil)
+	h, err = MakeHelper(context.Background(), []ma.Multiaddr{addr}, nil, dir, pk, "test", nil, gs, 50, DefaultLowWater, DefaultGracePeriod, false, true)
+	require.NoError(t, err)
+	require.NoError(t, h.Close())
+
+	ipnet := parseCIDR("1.2.3.0/24")
+	require.ElementsMatch(t, []Ban{
+		{Peer: banned, Expires: expires, Reason: "spamming"},
+		{IPNet: &ipnet},
+	}, gs.Bans())
+	require.True(t, gs.TrustedPeers.Contains(trusted))
+
+	// bans that expired while the helper wasn't running are dropped
+	gs = NewCodaGatingState(nil, nil, nil, nil)
+	require.NoError(t, loadGatingState(gs, dir, expires))
+	require.Equal(t, []Ban{{IPNet: &ipnet}}, gs.Bans())
+
+	// a corrupt file is ignored rather than keeping the helper from starting,
+	// even if only part of it can't be decoded
+	corrupt := `{"bans":[{"ip":"1.2.3.0/24"}],"trusted_peers":["not a peer"],"trusted_ips":[]}`
+	require.NoError(t, ioutil.WriteFile(path.Join(dir, gatingStateFile), []byte(corrupt), 0600))
+	gs = NewCodaGatingState(nil, nil, nil, nil)
+	h, err = MakeHelper(context.Background(), []ma.Multiaddr{addr}, nil, dir, pk, "test", nil, gs, 50, DefaultLowWater, DefaultGracePeriod, false, true)
+	require.NoError(t, err)
+	require.Empty(t, gs.Bans())
+
+	// concurrent saves don't trip over each other's temporary file
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.NoError(t, h.saveGatingState())
+		}()
+	}
+	wg.Wait()
+	require.NoError(t, h.Close())
+	bz, err := ioutil.ReadFile(path.Join(dir, gatingStateFile))
+	require.NoError(t, err)
+	_, err = decodeGatingState(gs, bz, time.Now())
+	require.NoError(t, err)
+}
+
+// newTestHelper makes a helper listening on ip, and dialling from it
+func newTestHelper(t *testing.T, gs *CodaGatingState, ip string) *Helper {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+
+	pk, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+
+	// with a single listener, the tcp transport dials from the unspecified
+	// address, so the kernel picks the IP to dial from. with listeners on
+	// two ports, it dials from one of them.
+	var addrs []ma.Multiaddr
+	for i := 0; i < 2; i++ {
+		addr, err := ma.NewMultiaddr(fmt.Sprintf("/ip4/%s/tcp/0", ip))
+		require.NoError(t, err)
+		addrs = append(addrs, addr)
+	}
+
+	h, err := MakeHelper(context.Background(), addrs, nil, dir, pk, "test", nil, gs, 50, DefaultLowWater, DefaultGracePeriod, false, false)
+	require.NoError(t, err)
+	return h
+}
+
+func TestUpgradePolicy(t *testing.T) {
+	NoDHT = true
+	defer func() {
+		NoDHT = false
+	}()
+
+	gs := NewCodaGatingState(nil, nil, nil, nil)
+	var mutex sync.Mutex
+	var rejected []control.DisconnectReason
+	gs.OnUpgradeRejected = func(_ network.Conn, reason control.DisconnectReason) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		rejected = append(rejected, reason)
+	}
+
+	// MakeHelper sets the mplex message size limit, which running hosts
+	// read, so all helpers are made up front
+	server := newTestHelper(t, gs, "127.0.0.1")
+	defer server.Close()
+	client := newTestHelper(t, NewCodaGatingState(nil, nil, nil, nil), "127.0.0.1")
+	defer client.Close()
+	other := newTestHelper(t, NewCodaGatingState(nil, nil, nil, nil), "127.0.0.1")
+	defer other.Close()
+
+	setPolicy := func(policy UpgradePolicy) {
+		newState := NewCodaGatingState(nil, nil, nil, nil)
+		for _, cidr := range allIPCIDRs {
+			newState.TrustedAddrFilters.AddFilter(parseCIDR(cidr), ma.ActionDeny)
+		}
+		newState.UpgradePolicy = policy
+		require.NoError(t, server.UpdateGatingState(newState))
+	}
+
+	// the client is given one of the server's addresses at a time, so that
+	// it doesn't make a connection to each
+	connect := func(client *Helper) {
+		client.Host.Peerstore().ClearAddrs(server.Host.ID())
+		_ = client.Host.Connect(context.Background(), peer.AddrInfo{ID: server.Host.ID(), Addrs: server.Host.Addrs()[:1]})
+	}
+
+	expectRejected := func(client *Helper, reason control.DisconnectReason) {
+		mutex.Lock()
+		rejected = nil
+		mutex.Unlock()
+
+		connect(client)
+		require.Eventually(t, func() bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return len(rejected) > 0 && rejected[len(rejected)-1] == reason
+		}, 10*time.Second, 10*time.Millisecond, DisconnectReasonRule(reason))
+		require.Empty(t, server.Host.Network().ConnsToPeer(client.Host.ID()))
+		require.NoError(t, client.Host.Network().ClosePeer(server.Host.ID()))
+	}
+
+	// the client offers noise first
+	setPolicy(UpgradePolicy{AllowedSecurity: []string{"/tls/1.0.0"}})
+	expectRejected(client, DisconnectSecurityNotAllowed)
+
+	setPolicy(UpgradePolicy{AllowedMuxers: []string{"/yamux/1.0.0"}})
+	expectRejected(client, DisconnectMuxerNotAllowed)
+
+	setPolicy(UpgradePolicy{AllowedMuxers: []string{"/coda/mplex/1.0.0"}, AllowedSecurity: []string{"/noise"}, MaxConnsPerIP: 1})
+	connect(client)
+	require.Len(t, server.Host.Network().ConnsToPeer(client.Host.ID()), 1)
+
+	// a second peer on the same IP is one too many
+	expectRejected(other, DisconnectTooManyConnsPerIP)
+
+	rules := make(map[GatingRule]bool)
+	for _, event := range gs.Events() {
+		if event.Stage == StageUpgraded && !event.Allowed {
+			rules[event.Rule] = true
+		}
+	}
+	require.Equal(t, map[GatingRule]bool{RuleSecurityNotAllowed: true, RuleMuxerNotAllowed: true, RuleTooManyConnsPerIP: true}, rules)
+
+	// trusted peers don't count against the limit
+	gs.TrustPeer(other.Host.ID())
+	connect(other)
+	require.Len(t, server.Host.Network().ConnsToPeer(other.Host.ID()), 1)
+}
+
+func TestInboundLimits(t *testing.T) {
+	// the DHT would redial closed connections
+	NoDHT = true
+	defer func() {
+		NoDHT = false
+	}()
+
+	gs := NewCodaGatingState(nil, nil, nil, nil)
+	for _, cidr := range allIPCIDRs {
+		gs.TrustedAddrFilters.AddFilter(parseCIDR(cidr), ma.ActionDeny)
+	}
+	gs.InboundLimits = InboundLimits{PerIP: 2, PerSubnet: 3}
+
+	// every address in 127.0.0.0/8 is loopback, so hosts can dial from
+	// different IPs and subnets. MakeHelper sets the mplex message size
+	// limit, which running hosts read, so all helpers are made up front.
+	server := newTestHelper(t, gs, "127.0.0.1")
+	defer server.Close()
+	var clients []*Helper
+	for _, ip := range []string{"127.0.0.2", "127.0.0.2", "127.0.0.2", "127.0.0.3", "127.0.0.4", "127.0.1.2", "127.0.0.5"} {
+		client := newTestHelper(t, NewCodaGatingState(nil, nil, nil, nil), ip)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	// the client is given one of the server's addresses at a time, so that
+	// it doesn't make a connection to each, and a rejected dial doesn't keep
+	// it from dialling again
+	connect := func(client *Helper) {
+		client.Host.Peerstore().ClearAddrs(server.Host.ID())
+		client.Host.Network().(*swarm.Swarm).Backoff().Clear(server.Host.ID())
+		_ = client.Host.Connect(context.Background(), peer.AddrInfo{ID: server.Host.ID(), Addrs: server.Host.Addrs()[:1]})
+	}
+	expectConnected := func(client *Helper) {
+		connect(client)
+		require.Eventually(t, func() bool {
+			return len(server.Host.Network().ConnsToPeer(client.Host.ID())) == 1
+		}, 10*time.Second, 10*time.Millisecond)
+	}
+	expectRejected := func(client *Helper, rule GatingRule) {
+		connect(client)
+		events := gs.Events()
+		last := events[len(events)-1]
+		require.Equal(t, StageSecured, last.Stage)
+		require.Equal(t, client.Host.ID(), last.Peer)
+		require.Equal(t, rule, last.Rule)
+		require.Empty(t, server.Host.Network().ConnsToPeer(client.Host.ID()))
+	}
+
+	expectConnected(clients[0])
+	expectConnected(clients[1])
+	expectRejected(clients[2], RuleTooManyInboundPerIP)
+	expectConnected(clients[3])
+	expectRejected(clients[4], RuleTooManyInboundPerSubnet)
+	// a different /24
+	expectConnected(clients[5])
+
+	// trusted peers are exempt
+	gs.TrustPeer(clients[4].Host.ID())
+	expectConnected(clients[4])
+
+	// outbound connections are not limited
+	server.Host.Peerstore().AddAddrs(clients[6].Host.ID(), clients[6].Host.Addrs(), time.Minute)
+	_, err := server.Host.Network().DialPeer(context.Background(), clients[6].Host.ID())
+	require.NoError(t, err)
+
+	// closed connections no longer count
+	require.NoError(t, server.Host.Network().ClosePeer(clients[0].Host.ID()))
+	expectConnected(clients[2])
+}
+
+func TestBanDisconnectReason(t *testing.T) {
+	NoDHT = true
+	defer func() {
+		NoDHT = false
+	}()
+
+	server := newTestHelper(t, NewCodaGatingState(nil, nil, nil, nil), "127.0.0.1")
+	defer server.Close()
+	client := newTestHelper(t, NewCodaGatingState(nil, nil, nil, nil), "127.0.0.1")
+	defer client.Close()
+
+	reasons := make(chan string, 1)
+	server.ConnectionManager.OnDisconnect = func(_ network.Network, _ network.Conn, reason string) {
+		reasons <- reason
+	}
+
+	require.NoError(t, client.Host.Connect(context.Background(), peer.AddrInfo{ID: server.Host.ID(), Addrs: server.Host.Addrs()[:1]}))
+	require.Eventually(t, func() bool {
+		return server.ConnectionManager.IsReported(client.Host.ID())
+	}, 10*time.Second, 10*time.Millisecond)
+
+	newState := NewCodaGatingState(nil, nil, nil, nil)
+	newState.BannedPeers.Add(client.Host.ID())
+	require.NoError(t, server.UpdateGatingState(newState))
+
+	select {
+	case reason := <-reasons:
+		require.Equal(t, string(RuleBannedPeer), reason)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the banned peer was not disconnected")
+	}
+	require.False(t, server.ConnectionManager.IsReported(client.Host.ID()))
+}
+
+func TestReservedOutbound(t *testing.T) {
+	NoDHT = true
+	defer func() {
+		NoDHT = false
+	}()
+
+	server := newTestHelper(t, NewCodaGatingState(nil, nil, nil, nil), "127.0.0.1")
+	defer server.Close()
+	var clients []*Helper
+	for i := 0; i < 4; i++ {
+		client := newTestHelper(t, NewCodaGatingState(nil, nil, nil, nil), "127.0.0.1")
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	var mutex sync.Mutex
+	reported := make(map[peer.ID]bool)
+	server.ConnectionManager.OnConnect = func(_ network.Network, c network.Conn) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		reported[c.RemotePeer()] = true
+	}
+
+	// 3 slots, 1 of them for outbound connections
+	net := server.Host.Network()
+	require.NoError(t, server.ConnectionManager.SetLimits(net, 1, 3, DefaultGracePeriod))
+	server.ConnectionManager.SetReservedOutbound(net, 1)
+
+	connect := func(client *Helper) {
+		client.Host.Peerstore().ClearAddrs(server.Host.ID())
+		require.NoError(t, client.Host.Connect(context.Background(), peer.AddrInfo{ID: server.Host.ID(), Addrs: server.Host.Addrs()[:1]}))
+	}
+
+	connect(clients[0])
+	connect(clients[1])
+	require.Eventually(t, func() bool {
+		inbound, _ := ConnCounts(net)
+		return inbound == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// the third inbound connection would take the reserved slot
+	connect(clients[2])
+	require.Eventually(t, func() bool {
+		return len(net.ConnsToPeer(clients[2].Host.ID())) == 0
+	}, 10*time.Second, 10*time.Millisecond)
+	// and is never reported, as it's closed right away
+	mutex.Lock()
+	require.True(t, reported[clients[1].Host.ID()])
+	require.False(t, reported[clients[2].Host.ID()])
+	mutex.Unlock()
+
+	dial := func(client *Helper) {
+		server.Host.Peerstore().AddAddrs(client.Host.ID(), client.Host.Addrs()[:1], time.Minute)
+		_, err := net.DialPeer(context.Background(), client.Host.ID())
+		require.NoError(t, err)
+	}
+
+	// an outbound one gets it, and is protected from trimming
+	dial(clients[3])
+	require.True(t, server.ConnectionManager.IsProtected(clients[3].Host.ID(), reservedOutboundTag))
+
+	// outbound connections beyond the reserved slots are only tagged
+	dial(clients[2])
+	require.False(t, server.ConnectionManager.IsProtected(clients[2].Host.ID(), reservedOutboundTag))
+	require.Equal(t, outboundTagWeight, server.ConnectionManager.GetTagInfo(clients[2].Host.ID()).Tags[outboundTag])
+	inbound, outbound := ConnCounts(net)
+	require.Equal(t, 2, inbound)
+	require.Equal(t, 2, outbound)
+
+	// so trimming closes the inbound connections first
+	time.Sleep(DefaultGracePeriod)
+	server.ConnectionManager.TrimOpenConns(context.Background())
+	require.Eventually(t, func() bool {
+		inbound, outbound := ConnCounts(net)
+		return inbound == 0 && outbound == 2
+	}, 10*time.Second, 10*time.Millisecond)
+
+	// the reservation goes with the connection
+	require.NoError(t, net.ClosePeer(clients[3].Host.ID()))
+	require.Eventually(t, func() bool {
+		return !server.ConnectionManager.IsProtected(clients[3].Host.ID(), reservedOutboundTag)
+	}, 10*time.Second, 10*time.Millisecond)
+}
+
 /*
 func TestAcceptedPrivateConnectionGating(t *testing.T) {
   initPrivateIpFilter()
@@ -0,0 +1,98 @@
+package codanet
+
+import (
+	"context"
+	"errors"
+
+	"github.com/libp2p/go-libp2p-core/routing"
+	swarm "github.com/libp2p/go-libp2p-swarm"
+	multistream "github.com/multiformats/go-multistream"
+)
+
+// ErrorCode is a machine-readable classification of a helper error. The
+// daemon receives it alongside the error message, and can branch on it
+// instead of matching on error strings.
+type ErrorCode string
+
+const (
+	// the request itself was at fault
+	ErrCodeBadInput        ErrorCode = "bad-input"
+	ErrCodeUnknownMethod   ErrorCode = "unknown-method"
+	ErrCodeVersionMismatch ErrorCode = "version-mismatch"
+
+	// the request refers to state the helper doesn't have (yet)
+	ErrCodeNotConfigured       ErrorCode = "not-configured"
+	ErrCodeUnknownStream       ErrorCode = "unknown-stream"
+	ErrCodeUnknownSubscription ErrorCode = "unknown-subscription"
+	ErrCodeUnknownValidation   ErrorCode = "unknown-validation"
+	ErrCodeUnknownRequest      ErrorCode = "unknown-request"
+
+	// the network didn't cooperate
+	ErrCodePeerUnreachable      ErrorCode = "peer-unreachable"
+	ErrCodeTimeout              ErrorCode = "timeout"
+	ErrCodeGated                ErrorCode = "gated"
+	ErrCodeProtocolNotSupported ErrorCode = "protocol-not-supported"
+	ErrCodeLibp2p               ErrorCode = "libp2p"
+
+	// the daemon cancelled the request
+	ErrCodeCancelled ErrorCode = "cancelled"
+
+	// the helper is at fault
+	ErrCodeInitFailed ErrorCode = "init-failed"
+	ErrCodeInternal   ErrorCode = "internal"
+
+	// the helper is serving another control client
+	ErrCodeBusy ErrorCode = "busy"
+)
+
+// CodedError attaches an ErrorCode to an error
+type CodedError struct {
+	Code ErrorCode
+	Err  error
+}
+
+func (e *CodedError) Error() string { return e.Err.Error() }
+func (e *CodedError) Unwrap() error { return e.Err }
+
+func withCode(code ErrorCode, err error) error {
+	return &CodedError{Code: code, Err: err}
+}
+
+// ClassifyError returns the code of the first CodedError in err's chain. If
+// there is none, it recognizes the errors libp2p returns for dials and
+// stream negotiation, and falls back to ErrCodeLibp2p.
+func ClassifyError(err error) ErrorCode {
+	var coded *CodedError
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+
+	var timeout interface{ Timeout() bool }
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrCodeCancelled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, swarm.ErrDialTimeout):
+		return ErrCodeTimeout
+	case errors.Is(err, swarm.ErrGaterDisallowedConnection):
+		return ErrCodeGated
+	case errors.Is(err, multistream.ErrNotSupported):
+		return ErrCodeProtocolNotSupported
+	case errors.As(err, &timeout) && timeout.Timeout():
+		return ErrCodeTimeout
+	case errors.Is(err, swarm.ErrDialBackoff),
+		errors.Is(err, swarm.ErrNoAddresses),
+		errors.Is(err, swarm.ErrNoGoodAddresses),
+		errors.Is(err, swarm.ErrAllDialsFailed),
+		errors.Is(err, swarm.ErrNoTransport),
+		errors.Is(err, swarm.ErrDialToSelf),
+		errors.Is(err, routing.ErrNotFound):
+		return ErrCodePeerUnreachable
+	}
+
+	var dialErr *swarm.DialError
+	if errors.As(err, &dialErr) {
+		return ErrCodePeerUnreachable
+	}
+
+	return ErrCodeLibp2p
+}
@@ -0,0 +1,118 @@
+package codanet
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// GatingStage is the Intercept* function a gating decision was made in
+type GatingStage string
+
+const (
+	StagePeerDial GatingStage = "peer_dial"
+	StageAddrDial GatingStage = "addr_dial"
+	StageAccept   GatingStage = "accept"
+	StageSecured  GatingStage = "secured"
+	StageUpgraded GatingStage = "upgraded"
+)
+
+// GatingRule is the rule a gating decision was made by
+type GatingRule string
+
+const (
+	RuleTrustedPeer        GatingRule = "trusted_peer"
+	RuleTrustedIP          GatingRule = "trusted_ip"
+	RuleBannedPeer         GatingRule = "banned_peer"
+	RuleBannedIP           GatingRule = "banned_ip"
+	RuleUnknownPrivateAddr GatingRule = "unknown_private_addr"
+	RuleIsolate            GatingRule = "isolate"
+	RuleMuxerNotAllowed    GatingRule = "muxer_not_allowed"
+	RuleSecurityNotAllowed GatingRule = "security_not_allowed"
+	RuleTooManyConnsPerIP  GatingRule = "too_many_conns_per_ip"
+	// the InboundLimits
+	RuleTooManyInboundPerIP     GatingRule = "too_many_inbound_per_ip"
+	RuleTooManyInboundPerSubnet GatingRule = "too_many_inbound_per_subnet"
+	// no rule matched, so the connection is allowed
+	RuleDefault GatingRule = "default"
+)
+
+// GatingEvent records a gating decision. Peer is empty at StageAccept, and
+// Addr is nil at StagePeerDial.
+type GatingEvent struct {
+	Time    time.Time
+	Stage   GatingStage
+	Peer    peer.ID
+	Addr    ma.Multiaddr
+	Allowed bool
+	Rule    GatingRule
+}
+
+// how many of the latest gating decisions are kept
+const gatingEventsCapacity = 1024
+
+var gatingDecisionsMetric = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "gating_decisions_total",
+	Help: "Number of connection gating decisions, by stage, decision and the rule they were made by.",
+}, []string{"stage", "decision", "rule"})
+
+func init() {
+	prometheus.MustRegister(gatingDecisionsMetric)
+}
+
+// gatingEventLog is a ring buffer of the latest gating decisions
+type gatingEventLog struct {
+	mutex  sync.Mutex
+	events []GatingEvent
+	next   int
+}
+
+func (l *gatingEventLog) add(event GatingEvent) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if len(l.events) < gatingEventsCapacity {
+		l.events = append(l.events, event)
+		return
+	}
+	l.events[l.next] = event
+	l.next = (l.next + 1) % gatingEventsCapacity
+}
+
+// list returns the events, oldest first
+func (l *gatingEventLog) list() []GatingEvent {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	events := make([]GatingEvent, 0, len(l.events))
+	events = append(events, l.events[l.next:]...)
+	return append(events, l.events[:l.next]...)
+}
+
+func (gs *CodaGatingState) record(stage GatingStage, p peer.ID, addr ma.Multiaddr, allow bool, rule GatingRule) {
+	decision := "allow"
+	if !allow {
+		decision = "deny"
+		// the events and the metric keep track of denials, which can come in
+		// floods, so they are only logged when debugging
+		gs.logger.Debugf("gated %s of peer %s at %v by rule %s", stage, p, addr, rule)
+	}
+	gatingDecisionsMetric.WithLabelValues(string(stage), decision, string(rule)).Inc()
+
+	gs.events.add(GatingEvent{
+		Time:    time.Now(),
+		Stage:   stage,
+		Peer:    p,
+		Addr:    addr,
+		Allowed: allow,
+		Rule:    rule,
+	})
+}
+
+// Events returns the latest gating decisions, oldest first
+func (gs *CodaGatingState) Events() []GatingEvent {
+	return gs.events.list()
+}
@@ -0,0 +1,197 @@
+package codanet
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"path"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// When asked to, MakeHelper keeps the ban and trust lists in the statedir, so
+// that a restarted helper doesn't redial the peers it banned before the
+// daemon gets around to setting its gating config again. The file is
+// rewritten whenever the gating state changes, and what it holds is added to
+// the gating config the helper starts with.
+
+const gatingStateFile = "libp2p-gating-v0.json"
+
+type storedBan struct {
+	PeerID      string `json:"peer_id,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	ExpiresAtMs int64  `json:"expires_at_ms,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+type storedGatingState struct {
+	Bans         []storedBan `json:"bans"`
+	TrustedPeers []string    `json:"trusted_peers"`
+	TrustedIPs   []string    `json:"trusted_ips"`
+}
+
+func (gs *CodaGatingState) stored() storedGatingState {
+	state := storedGatingState{Bans: []storedBan{}, TrustedPeers: []string{}, TrustedIPs: []string{}}
+
+	for _, ban := range gs.Bans() {
+		var entry storedBan
+		if ban.IPNet != nil {
+			// isolation is a setting of the current run, not a ban
+			if isAllIPs(*ban.IPNet) {
+				continue
+			}
+			entry.IP = ban.IPNet.String()
+		} else {
+			entry.PeerID = peer.Encode(ban.Peer)
+		}
+		if !ban.Expires.IsZero() {
+			entry.ExpiresAtMs = ban.Expires.UnixNano() / int64(time.Millisecond)
+		}
+		entry.Reason = ban.Reason
+		state.Bans = append(state.Bans, entry)
+	}
+
+	gs.mutex.RLock()
+	defer gs.mutex.RUnlock()
+
+	for _, p := range gs.TrustedPeers.Peers() {
+		state.TrustedPeers = append(state.TrustedPeers, peer.Encode(p))
+	}
+	for _, ipnet := range gs.TrustedAddrFilters.FiltersForAction(ma.ActionAccept) {
+		state.TrustedIPs = append(state.TrustedIPs, ipnet.String())
+	}
+
+	return state
+}
+
+// saveGatingState writes the gating state to the statedir, if the helper
+// was asked to persist it
+func (h *Helper) saveGatingState() error {
+	if h.gatingStatePath == "" {
+		return nil
+	}
+
+	// saves come from both the daemon's calls and the ban expiry, and share
+	// the temporary file
+	h.gatingStateMutex.Lock()
+	defer h.gatingStateMutex.Unlock()
+
+	bz, err := json.Marshal(h.GatingState.stored())
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a crash can't leave a
+	// truncated file behind
+	tmp := h.gatingStatePath + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(bz); err != nil {
+		_ = f.Close()
+		return err
+	}
+	// the contents must be on disk before the rename is
+	if err := f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.gatingStatePath)
+}
+
+// loadGatingState adds the bans and trust entries stored in statedir to gs,
+// leaving out bans that expired by now. A missing file is not an error, and
+// neither is one that can't be decoded: gs is then left as it was, since the
+// daemon sets its gating config again anyway.
+func loadGatingState(gs *CodaGatingState, statedir string, now time.Time) error {
+	bz, err := ioutil.ReadFile(path.Join(statedir, gatingStateFile))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	apply, err := decodeGatingState(gs, bz, now)
+	if err != nil {
+		logger.Warningf("ignoring the stored gating state: %s", err)
+		return nil
+	}
+	for _, f := range apply {
+		f()
+	}
+	return nil
+}
+
+// decodeGatingState decodes the stored gating state in bz, returning the
+// changes to make to gs so that nothing is added unless all of it decodes
+func decodeGatingState(gs *CodaGatingState, bz []byte, now time.Time) ([]func(), error) {
+	var state storedGatingState
+	if err := json.Unmarshal(bz, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %w", gatingStateFile, err)
+	}
+
+	var apply []func()
+	for _, entry := range state.Bans {
+		entry := entry
+		expires := time.Time{}
+		if entry.ExpiresAtMs != 0 {
+			expires = time.Unix(0, entry.ExpiresAtMs*int64(time.Millisecond))
+			if !expires.After(now) {
+				continue
+			}
+		}
+
+		if entry.IP != "" {
+			_, ipnet, err := gonet.ParseCIDR(entry.IP)
+			if err != nil {
+				return nil, err
+			}
+			apply = append(apply, func() {
+				if expires.IsZero() {
+					gs.BannedAddrFilters.AddFilter(*ipnet, ma.ActionDeny)
+				} else {
+					gs.BanIPNetUntil(*ipnet, expires, entry.Reason)
+				}
+			})
+			continue
+		}
+
+		id, err := peer.Decode(entry.PeerID)
+		if err != nil {
+			return nil, err
+		}
+		apply = append(apply, func() {
+			if expires.IsZero() {
+				gs.BannedPeers.Add(id)
+			} else {
+				gs.BanPeerUntil(id, expires, entry.Reason)
+			}
+		})
+	}
+
+	for _, encoded := range state.TrustedPeers {
+		id, err := peer.Decode(encoded)
+		if err != nil {
+			return nil, err
+		}
+		apply = append(apply, func() { gs.TrustedPeers.Add(id) })
+	}
+
+	for _, cidr := range state.TrustedIPs {
+		_, ipnet, err := gonet.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		apply = append(apply, func() { gs.TrustedAddrFilters.AddFilter(*ipnet, ma.ActionAccept) })
+	}
+
+	return apply, nil
+}
@@ -99,7 +99,7 @@ func main() {
 		Command:     "generate_methodidx",
 		PackageName: "main",
 		TypesAndValues: map[string][]string{
-			"methodIdx": []string{"configure", "listen", "publish", "subscribe", "unsubscribe", "validationComplete", "generateKeypair", "openStream", "closeStream", "resetStream", "sendStreamMsg", "removeStreamHandler", "addStreamHandler", "listeningAddrs", "addPeer", "beginAdvertising", "findPeer", "listPeers", "setGatingConfig", "setNodeStatus", "getPeerNodeStatus"},
+			"methodIdx": []string{"configure", "listen", "publish", "subscribe", "unsubscribe", "validationComplete", "generateKeypair", "openStream", "closeStream", "resetStream", "sendStreamMsg", "removeStreamHandler", "addStreamHandler", "listeningAddrs", "addPeer", "beginAdvertising", "findPeer", "listPeers", "setGatingConfig", "setNodeStatus", "getPeerNodeStatus", "hello", "cancelRequest", "shutdown", "reconfigure", "listBans", "getGatingEvents", "getConnectionManagerStatus", "protectPeer", "unprotectPeer", "tagPeer", "untagPeer", "registerDecayingTag", "bumpDecayingTag", "getPeerScores", "validationCompleteBatch"},
 		},
 	}
 
@@ -0,0 +1,145 @@
+package codanet
+
+import (
+	gonet "net"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// An attacker with many peer IDs behind one IP or one subnet could fill all
+// of our connection slots, so InterceptSecured caps the inbound connections
+// from each. Connections of trusted peers and from trusted IPs neither count
+// against the caps nor are held to them.
+
+// InboundLimits caps the inbound connections from a single IP and from a
+// single subnet, a /24 for IPv4 and a /48 for IPv6. Zero is no limit.
+type InboundLimits struct {
+	PerIP     int
+	PerSubnet int
+}
+
+// how long a connection InterceptSecured allowed is counted before it shows
+// up in the network, in case its upgrade fails. Accepting a connection,
+// upgrade included, times out after as long.
+const inboundPendingTimeout = time.Minute
+
+const (
+	ipv4SubnetBits = 24
+	ipv6SubnetBits = 48
+)
+
+func subnetOf(ip gonet.IP) *gonet.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		mask := gonet.CIDRMask(ipv4SubnetBits, 32)
+		return &gonet.IPNet{IP: ip4.Mask(mask), Mask: mask}
+	}
+	mask := gonet.CIDRMask(ipv6SubnetBits, 128)
+	return &gonet.IPNet{IP: ip.Mask(mask), Mask: mask}
+}
+
+type pendingInbound struct {
+	ip    gonet.IP
+	since time.Time
+}
+
+// inboundTracker keeps the connections InterceptSecured allowed until they
+// are added to the network, so that connections being upgraded concurrently
+// can't get past the caps together
+type inboundTracker struct {
+	mutex   sync.Mutex
+	pending map[string]pendingInbound
+}
+
+func newInboundTracker() *inboundTracker {
+	return &inboundTracker{pending: make(map[string]pendingInbound)}
+}
+
+// added is called once a connection is added to the network
+func (t *inboundTracker) added(_ network.Network, c network.Conn) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.pending, c.RemoteMultiaddr().String())
+}
+
+// setNetwork gives the gating state the network whose connections count
+// towards UpgradePolicy.MaxConnsPerIP and the inbound limits
+func (gs *CodaGatingState) setNetwork(n network.Network) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	gs.network = n
+	n.Notify(&network.NotifyBundle{ConnectedF: gs.inbound.added})
+}
+
+// inboundRule checks an inbound connection from p at addr against the
+// inbound limits. gs.mutex must be held.
+func (gs *CodaGatingState) inboundRule(p peer.ID, addr ma.Multiaddr) (bool, GatingRule) {
+	limits := gs.InboundLimits
+	if limits.PerIP <= 0 && limits.PerSubnet <= 0 {
+		return true, RuleDefault
+	}
+	if gs.isPeerTrusted(p) || gs.isAddrTrusted(addr) {
+		return true, RuleDefault
+	}
+
+	ip, err := manet.ToIP(addr)
+	if err != nil {
+		return true, RuleDefault
+	}
+	subnet := subnetOf(ip)
+
+	t := gs.inbound
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	// the IPs of the inbound connections that count against the caps, by
+	// remote address
+	counted := make(map[string]gonet.IP)
+	if gs.network != nil {
+		for _, c := range gs.network.Conns() {
+			if c.Stat().Direction != network.DirInbound {
+				continue
+			}
+			if gs.isPeerTrusted(c.RemotePeer()) || gs.isAddrTrusted(c.RemoteMultiaddr()) {
+				continue
+			}
+			if otherIP, err := manet.ToIP(c.RemoteMultiaddr()); err == nil {
+				counted[c.RemoteMultiaddr().String()] = otherIP
+			}
+		}
+	}
+	now := time.Now()
+	for key, pending := range t.pending {
+		if now.Sub(pending.since) > inboundPendingTimeout {
+			delete(t.pending, key)
+			continue
+		}
+		counted[key] = pending.ip
+	}
+
+	perIP, perSubnet := 0, 0
+	for _, otherIP := range counted {
+		if otherIP.Equal(ip) {
+			perIP++
+		}
+		if subnet.Contains(otherIP) {
+			perSubnet++
+		}
+	}
+
+	if limits.PerIP > 0 && perIP >= limits.PerIP {
+		return false, RuleTooManyInboundPerIP
+	}
+	if limits.PerSubnet > 0 && perSubnet >= limits.PerSubnet {
+		return false, RuleTooManyInboundPerSubnet
+	}
+
+	t.pending[addr.String()] = pendingInbound{ip: ip, since: now}
+	return true, RuleDefault
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Subscriptions on high-volume topics, like transactions and snark work, can
+// opt into batched validation: instead of a validate upcall per message, the
+// helper gathers the messages that arrive within a short window and sends
+// them in one validateBatch upcall, which the daemon answers with one
+// validationCompleteBatch call. Each message keeps its own seqno and
+// expiration, and can still be completed on its own with validationComplete.
+
+// the most messages a validateBatch upcall holds if subscribe doesn't say
+const defaultMaxBatchSize = 256
+
+type batchedValidation struct {
+	Sender     *codaPeerInfo `json:"sender"`
+	Expiration int64         `json:"expiration"`
+	Data       []byte        `json:"data"`
+	Seqno      int           `json:"seqno"`
+}
+
+type validateBatchUpcall struct {
+	Upcall   string              `json:"upcall"`
+	Idx      int                 `json:"subscription_idx"`
+	Messages []batchedValidation `json:"messages"`
+}
+
+// validationBatcher gathers the validate upcalls of a subscription
+type validationBatcher struct {
+	app     *app
+	idx     func() int
+	window  time.Duration
+	maxSize int
+
+	mutex   sync.Mutex
+	pending []batchedValidation
+	timer   *time.Timer
+}
+
+func newValidationBatcher(app *app, idx func() int, window time.Duration, maxSize int) *validationBatcher {
+	if maxSize <= 0 {
+		maxSize = defaultMaxBatchSize
+	}
+	return &validationBatcher{app: app, idx: idx, window: window, maxSize: maxSize}
+}
+
+// add queues upcall for the next batch, which is sent once it's full or the
+// window since its first message has passed
+func (b *validationBatcher) add(upcall *validateUpcall) {
+	b.mutex.Lock()
+	b.pending = append(b.pending, batchedValidation{
+		Sender:     upcall.Sender,
+		Expiration: upcall.Expiration,
+		Data:       upcall.Data,
+		Seqno:      upcall.Seqno,
+	})
+
+	if len(b.pending) < b.maxSize {
+		if b.timer == nil {
+			b.timer = time.AfterFunc(b.window, b.flush)
+		}
+		b.mutex.Unlock()
+		return
+	}
+
+	batch := b.take()
+	b.mutex.Unlock()
+	b.send(batch)
+}
+
+func (b *validationBatcher) flush() {
+	b.mutex.Lock()
+	batch := b.take()
+	b.mutex.Unlock()
+	b.send(batch)
+}
+
+// take returns the pending batch and starts a new one. b.mutex must be held.
+func (b *validationBatcher) take() []batchedValidation {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.pending
+	b.pending = nil
+	return batch
+}
+
+// send writes the upcall outside of b.mutex, as writing can block on a full
+// out queue
+func (b *validationBatcher) send(batch []batchedValidation) {
+	if len(batch) == 0 {
+		return
+	}
+	b.app.writeMsg(&validateBatchUpcall{Upcall: upcallValidateBatch, Idx: b.idx(), Messages: batch})
+}
+
+type validationCompleteBatchMsg struct {
+	Results []validationCompleteMsg `json:"results"`
+}
+
+type validationCompleteBatchResult struct {
+	// the seqnos that weren't waiting for validation, because they were
+	// already completed or never existed
+	Unknown []int `json:"unknown_seqnos"`
+}
+
+func (m *validationCompleteBatchMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	result := validationCompleteBatchResult{Unknown: []int{}}
+	for _, r := range m.Results {
+		if !app.completeValidation(r.Seqno, r.Valid) {
+			result.Unknown = append(result.Unknown, r.Seqno)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchedValidation(t *testing.T) {
+	var err error
+	topic := "testtopic"
+
+	appA := newTestApp(t, nil)
+	appA.NoUpcalls = false
+	appA.OutQueue = newOutQueue(defaultOutQueueSize, overflowBlock)
+	appA.P2p.Pubsub, err = pubsub.NewGossipSub(appA.Ctx, appA.P2p.Host)
+	require.NoError(t, err)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, appAInfos)
+	appB.P2p.Pubsub, err = pubsub.NewGossipSub(appB.Ctx, appB.P2p.Host)
+	require.NoError(t, err)
+	require.NoError(t, appB.P2p.Host.Connect(appB.Ctx, appAInfos[0]))
+
+	_, err = (&subscribeMsg{Topic: topic, Subscription: 3, BatchWindowMs: 200, MaxBatchSize: 3}).run(context.Background(), appA)
+	require.NoError(t, err)
+	topicB, err := appB.P2p.Pubsub.Join(topic)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(topicB.ListPeers()) == 1
+	}, testTimeout, 10*time.Millisecond)
+
+	go func() {
+		for i := 1; i <= 4; i++ {
+			seqs <- i
+		}
+	}()
+
+	// a full batch is sent right away
+	for i := 0; i < 3; i++ {
+		require.NoError(t, topicB.Publish(appB.Ctx, []byte(fmt.Sprintf("tx %d", i))))
+	}
+	batch, ok := nextMsg(t, appA).(*validateBatchUpcall)
+	require.True(t, ok)
+	require.Equal(t, "validateBatch", batch.Upcall)
+	require.Equal(t, 3, batch.Idx)
+	require.Len(t, batch.Messages, 3)
+
+	results := []validationCompleteMsg{{Seqno: 99, Valid: acceptResult}}
+	for _, msg := range batch.Messages {
+		require.Equal(t, appB.P2p.Host.ID().String(), msg.Sender.PeerID)
+		results = append(results, validationCompleteMsg{Seqno: msg.Seqno, Valid: acceptResult})
+	}
+	ret, err := (&validationCompleteBatchMsg{Results: results}).run(context.Background(), appA)
+	require.NoError(t, err)
+	require.Equal(t, validationCompleteBatchResult{Unknown: []int{99}}, ret)
+
+	// anything less waits for the window to pass
+	require.NoError(t, topicB.Publish(appB.Ctx, []byte("tx 3")))
+	batch, ok = nextMsg(t, appA).(*validateBatchUpcall)
+	require.True(t, ok)
+	require.Len(t, batch.Messages, 1)
+	require.Equal(t, []byte("tx 3"), batch.Messages[0].Data)
+
+	ret, err = (&validationCompleteBatchMsg{Results: []validationCompleteMsg{{Seqno: batch.Messages[0].Seqno, Valid: rejectResult}}}).run(context.Background(), appA)
+	require.NoError(t, err)
+	require.Equal(t, validationCompleteBatchResult{Unknown: []int{}}, ret)
+
+	appA.ValidatorMutex.Lock()
+	defer appA.ValidatorMutex.Unlock()
+	require.Empty(t, appA.Validators)
+}
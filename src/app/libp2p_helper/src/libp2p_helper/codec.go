@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// The helper speaks one of two wire formats with the daemon. Both carry the
+// same envelope, result and upcall types.
+//
+// - json lines (the default): one JSON object per line, with blobs base64'd.
+//
+// - framed: every message is a frame consisting of a 4-byte big-endian frame
+//   length, a 4-byte big-endian header length, the JSON header and then the
+//   message's raw blobs (see blobCarrier), each preceded by its 4-byte
+//   big-endian length. Blob fields are left null in the header. This avoids
+//   both the base64 overhead and scanning/parsing multi-MB JSON strings for
+//   large blocks. The header itself stays JSON: it is small next to the
+//   blobs, and it lets both modes share the message types.
+//
+// The daemon selects the framed mode by writing framedPreamble as the very
+// first bytes on stdin. The helper acknowledges by writing the same preamble
+// on stdout before any frame. Anything else (i.e. a JSON object) selects json
+// lines mode, so daemons unaware of framing keep working unchanged.
+//
+// The daemon (mina_net2) still speaks json lines: Child_processes only hands
+// it the helper's stdout line by line, so it can't read frames until that
+// gives access to the raw pipe. Until then framed mode is there for clients
+// of the control socket, and for the daemon once it can use it.
+
+type wireMode int
+
+const (
+	jsonLinesMode wireMode = iota
+	framedMode
+)
+
+func (m wireMode) String() string {
+	switch m {
+	case jsonLinesMode:
+		return "json lines"
+	case framedMode:
+		return "framed"
+	default:
+		return fmt.Sprintf("%d", int(m))
+	}
+}
+
+// a leading NUL byte can never start a JSON line, which makes the preamble
+// unambiguous
+const framedPreamble = "\x00mina-framed/1\n"
+
+// maxMessageSize bounds a single json line or frame
+const maxMessageSize = (1024 * 1024) * 1024
+
+// blobCarrier is implemented by messages with opaque binary payloads. In
+// framed mode the payloads travel raw after the JSON header, in the order
+// blobs returns them.
+type blobCarrier interface {
+	blobs() []*[]byte
+}
+
+func (m *publishMsg) blobs() []*[]byte        { return []*[]byte{&m.Data} }
+func (m *sendStreamMsgMsg) blobs() []*[]byte  { return []*[]byte{&m.Data} }
+func (m *validateUpcall) blobs() []*[]byte    { return []*[]byte{&m.Data} }
+func (m *incomingMsgUpcall) blobs() []*[]byte { return []*[]byte{&m.Data} }
+
+func (m *validateBatchUpcall) blobs() []*[]byte {
+	blobs := make([]*[]byte, len(m.Messages))
+	for i := range m.Messages {
+		blobs[i] = &m.Messages[i].Data
+	}
+	return blobs
+}
+
+// takeBlobs clears the blob fields of msg, returning their contents and a
+// function that puts them back
+func takeBlobs(msg interface{}) ([][]byte, func()) {
+	carrier, ok := msg.(blobCarrier)
+	if !ok {
+		return nil, func() {}
+	}
+	fields := carrier.blobs()
+	blobs := make([][]byte, len(fields))
+	for i, field := range fields {
+		blobs[i], *field = *field, nil
+	}
+	return blobs, func() {
+		for i, field := range fields {
+			*field = blobs[i]
+		}
+	}
+}
+
+// putBlobs fills in the blob fields of msg, whose header was just decoded,
+// from the blobs of its frame. blobs is nil in json lines mode, where the
+// header held them.
+func putBlobs(msg interface{}, blobs [][]byte) error {
+	if blobs == nil {
+		return nil
+	}
+	var fields []*[]byte
+	if carrier, ok := msg.(blobCarrier); ok {
+		fields = carrier.blobs()
+	}
+	if len(fields) != len(blobs) {
+		return fmt.Errorf("expected %d blobs but the frame has %d", len(fields), len(blobs))
+	}
+	for i, field := range fields {
+		*field = blobs[i]
+	}
+	return nil
+}
+
+// negotiateWireMode inspects the first bytes the daemon sent without
+// consuming anything that belongs to the first request.
+func negotiateWireMode(in *bufio.Reader, out *bufio.Writer) (wireMode, error) {
+	first, err := in.Peek(1)
+	if err != nil {
+		return jsonLinesMode, err
+	}
+
+	if first[0] != framedPreamble[0] {
+		return jsonLinesMode, nil
+	}
+
+	preamble, err := in.Peek(len(framedPreamble))
+	if err != nil {
+		return jsonLinesMode, err
+	}
+	if string(preamble) != framedPreamble {
+		return jsonLinesMode, fmt.Errorf("unknown wire mode preamble %q", preamble)
+	}
+	if _, err := in.Discard(len(framedPreamble)); err != nil {
+		return jsonLinesMode, err
+	}
+
+	if _, err := out.WriteString(framedPreamble); err != nil {
+		return framedMode, err
+	}
+	return framedMode, out.Flush()
+}
+
+// request is a single call read off the wire, with its envelope not yet
+// decoded
+type request struct {
+	Header []byte
+	Blobs  [][]byte // nil in json lines mode
+}
+
+type requestReader interface {
+	// next returns io.EOF once the daemon closed its end
+	next() (*request, error)
+}
+
+type msgWriter interface {
+	write(msg interface{}) error
+}
+
+func newCodec(mode wireMode, in *bufio.Reader, out *bufio.Writer) (requestReader, msgWriter) {
+	if mode == framedMode {
+		return &framedReader{in: in}, &framedWriter{out: out}
+	}
+
+	lines := bufio.NewScanner(in)
+	lines.Buffer(make([]byte, 64*1024), maxMessageSize)
+	return &jsonLinesReader{lines: lines}, &jsonLinesWriter{out: out}
+}
+
+type jsonLinesReader struct {
+	lines *bufio.Scanner
+}
+
+func (r *jsonLinesReader) next() (*request, error) {
+	if !r.lines.Scan() {
+		if err := r.lines.Err(); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+
+	// the scanner reuses its buffer, so hold on to a copy
+	return &request{Header: append([]byte(nil), r.lines.Bytes()...)}, nil
+}
+
+type jsonLinesWriter struct {
+	out *bufio.Writer
+}
+
+func (w *jsonLinesWriter) write(msg interface{}) error {
+	bytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	n, err := w.out.Write(bytes)
+	if err != nil {
+		return err
+	}
+
+	if n != len(bytes) {
+		// TODO: handle this correctly.
+		return io.ErrShortWrite
+	}
+
+	if err := w.out.WriteByte(0x0a); err != nil {
+		return err
+	}
+
+	return w.out.Flush()
+}
+
+type framedReader struct {
+	in *bufio.Reader
+}
+
+func (r *framedReader) next() (*request, error) {
+	var lens [8]byte
+	if _, err := io.ReadFull(r.in, lens[:4]); err != nil {
+		return nil, err
+	}
+
+	frameLen := binary.BigEndian.Uint32(lens[:4])
+	if frameLen > maxMessageSize || frameLen < 4 {
+		return nil, fmt.Errorf("invalid frame length %d", frameLen)
+	}
+
+	frame := make([]byte, frameLen)
+	if _, err := io.ReadFull(r.in, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	headerLen := binary.BigEndian.Uint32(frame[:4])
+	if headerLen > frameLen-4 {
+		return nil, fmt.Errorf("header length %d exceeds frame length %d", headerLen, frameLen)
+	}
+
+	req := &request{Header: frame[4 : 4+headerLen], Blobs: [][]byte{}}
+	for rest := frame[4+headerLen:]; len(rest) > 0; {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("truncated blob length")
+		}
+		blobLen := binary.BigEndian.Uint32(rest[:4])
+		if blobLen > uint32(len(rest)-4) {
+			return nil, fmt.Errorf("blob length %d exceeds the rest of the frame", blobLen)
+		}
+		req.Blobs = append(req.Blobs, rest[4:4+blobLen])
+		rest = rest[4+blobLen:]
+	}
+	return req, nil
+}
+
+type framedWriter struct {
+	out *bufio.Writer
+}
+
+func (w *framedWriter) write(msg interface{}) error {
+	blobs, restore := takeBlobs(msg)
+	defer restore()
+
+	hdr, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	return writeFrame(w.out, hdr, blobs)
+}
+
+func writeFrame(out *bufio.Writer, hdr []byte, blobs [][]byte) error {
+	frameLen := 4 + len(hdr)
+	for _, blob := range blobs {
+		frameLen += 4 + len(blob)
+	}
+	if frameLen > maxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum frame size", frameLen)
+	}
+
+	var lens [8]byte
+	binary.BigEndian.PutUint32(lens[:4], uint32(frameLen))
+	binary.BigEndian.PutUint32(lens[4:], uint32(len(hdr)))
+
+	parts := [][]byte{lens[:], hdr}
+	for _, blob := range blobs {
+		var blobLen [4]byte
+		binary.BigEndian.PutUint32(blobLen[:], uint32(len(blob)))
+		parts = append(parts, blobLen[:], blob)
+	}
+	for _, part := range parts {
+		if _, err := out.Write(part); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
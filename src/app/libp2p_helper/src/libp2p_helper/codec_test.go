@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"codanet"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+var wireModes = []wireMode{jsonLinesMode, framedMode}
+
+// encodeRequest writes env the way the daemon would in the given mode
+func encodeRequest(t *testing.T, mode wireMode, out *bufio.Writer, env envelope) {
+	if mode == jsonLinesMode {
+		_, w := newCodec(mode, bufio.NewReader(&bytes.Buffer{}), out)
+		require.NoError(t, w.write(env))
+		return
+	}
+
+	blobs, restore := takeBlobs(env.Body)
+	defer restore()
+	hdr, err := json.Marshal(env)
+	require.NoError(t, err)
+	require.NoError(t, writeFrame(out, hdr, blobs))
+}
+
+// encodeRequests encodes the envelopes in headers, which carry no blobs, the
+// way the daemon would in the given mode
+func encodeRequests(t *testing.T, mode wireMode, headers []string) *bufio.Reader {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	for _, hdr := range headers {
+		if mode == jsonLinesMode {
+			_, err := out.WriteString(hdr + "\n")
+			require.NoError(t, err)
+		} else {
+			require.NoError(t, writeFrame(out, []byte(hdr), nil))
+		}
+	}
+	require.NoError(t, out.Flush())
+	return bufio.NewReader(&buf)
+}
+
+// roundTrip writes msg the way the helper would in the given mode, and reads
+// it back into into the way the daemon would
+func roundTrip(t *testing.T, mode wireMode, msg interface{}, into interface{}) {
+	var buf bytes.Buffer
+	_, w := newCodec(mode, bufio.NewReader(&bytes.Buffer{}), bufio.NewWriter(&buf))
+	require.NoError(t, w.write(msg))
+	r, _ := newCodec(mode, bufio.NewReader(&buf), bufio.NewWriter(ioutil.Discard))
+	decodeUpcall(t, r, into)
+}
+
+// decodeUpcall reads a message written by the helper back into msg
+func decodeUpcall(t *testing.T, r requestReader, msg interface{}) {
+	raw, err := r.next()
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(raw.Header, msg))
+	require.NoError(t, putBlobs(msg, raw.Blobs))
+}
+
+func TestNegotiateWireMode(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected wireMode
+		rest     string
+		ack      string
+	}{
+		{`{"method":"listPeers"}`, jsonLinesMode, `{"method":"listPeers"}`, ""},
+		{framedPreamble + "rest", framedMode, "rest", framedPreamble},
+	} {
+		var ack bytes.Buffer
+		in := bufio.NewReader(bytes.NewBufferString(tc.input))
+		mode, err := negotiateWireMode(in, bufio.NewWriter(&ack))
+		require.NoError(t, err)
+		require.Equal(t, tc.expected, mode)
+		require.Equal(t, tc.ack, ack.String())
+
+		rest, err := ioutil.ReadAll(in)
+		require.NoError(t, err)
+		require.Equal(t, tc.rest, string(rest))
+	}
+
+	_, err := negotiateWireMode(bufio.NewReader(bytes.NewBufferString("\x00bogus-preamble\n")), bufio.NewWriter(&bytes.Buffer{}))
+	require.Error(t, err)
+}
+
+func TestWireModesRequests(t *testing.T) {
+	large := make([]byte, 1<<24)
+	large[0], large[len(large)-1] = 1, 2
+
+	for _, mode := range wireModes {
+		var buf bytes.Buffer
+		out := bufio.NewWriter(&buf)
+
+		encodeRequest(t, mode, out, envelope{Method: publish, Seqno: 1, Body: &publishMsg{Topic: "test", Data: large}})
+		encodeRequest(t, mode, out, envelope{Method: sendStreamMsg, Seqno: 2, Body: &sendStreamMsgMsg{StreamIdx: 3, Data: []byte{}}})
+		encodeRequest(t, mode, out, envelope{Method: closeStream, Seqno: 3, Body: &closeStreamMsg{StreamIdx: 4}})
+
+		requests, _ := newCodec(mode, bufio.NewReader(&buf), bufio.NewWriter(&bytes.Buffer{}))
+
+		req, err := requests.next()
+		require.NoError(t, err)
+		env, msg, err := parseRequest(req)
+		require.NoError(t, err)
+		require.Equal(t, publish, env.Method)
+		require.Equal(t, 1, env.Seqno)
+		require.Equal(t, "test", msg.(*publishMsg).Topic)
+		require.Equal(t, large, msg.(*publishMsg).Data, "mode %s", mode)
+
+		req, err = requests.next()
+		require.NoError(t, err)
+		env, msg, err = parseRequest(req)
+		require.NoError(t, err)
+		require.Equal(t, sendStreamMsg, env.Method)
+		require.Equal(t, 3, msg.(*sendStreamMsgMsg).StreamIdx)
+		require.Empty(t, msg.(*sendStreamMsgMsg).Data)
+
+		req, err = requests.next()
+		require.NoError(t, err)
+		env, msg, err = parseRequest(req)
+		require.NoError(t, err)
+		require.Equal(t, closeStream, env.Method)
+		require.Equal(t, &closeStreamMsg{StreamIdx: 4}, msg)
+
+		_, err = requests.next()
+		require.Equal(t, io.EOF, err)
+	}
+}
+
+func TestWireModesUpcalls(t *testing.T) {
+	sender := &codaPeerInfo{Libp2pPort: 7000, Host: "127.0.0.1", PeerID: "peer"}
+	upcalls := []interface{}{
+		&validateUpcall{Sender: sender, Expiration: 42, Data: []byte("block"), Seqno: 1, Upcall: "validate", Idx: 2},
+		&incomingMsgUpcall{Upcall: "incomingStreamMsg", StreamIdx: 3, Data: []byte{0, 1, 0xff}},
+		&successResult{Seqno: 4, Success: json.RawMessage(`"ok"`), Duration: "1ms"},
+		&errorResult{Seqno: 5, Errorr: "oops"},
+		&streamLostUpcall{Upcall: "streamLost", StreamIdx: 6, Reason: "gone"},
+		&validateBatchUpcall{Upcall: "validateBatch", Idx: 7, Messages: []batchedValidation{
+			{Sender: sender, Expiration: 43, Data: []byte("tx 0"), Seqno: 8},
+			{Sender: sender, Expiration: 44, Data: []byte{}, Seqno: 9},
+			{Sender: sender, Expiration: 45, Data: []byte("tx 2"), Seqno: 10},
+		}},
+	}
+
+	for _, mode := range wireModes {
+		var buf bytes.Buffer
+		_, w := newCodec(mode, bufio.NewReader(&bytes.Buffer{}), bufio.NewWriter(&buf))
+		for _, upcall := range upcalls {
+			require.NoError(t, w.write(upcall))
+		}
+
+		if mode == jsonLinesMode {
+			require.Contains(t, buf.String(), `"data":"YmxvY2s="`)
+		}
+
+		r, _ := newCodec(mode, bufio.NewReader(&buf), bufio.NewWriter(&bytes.Buffer{}))
+		decoded := []interface{}{
+			new(validateUpcall),
+			new(incomingMsgUpcall),
+			new(successResult),
+			new(errorResult),
+			new(streamLostUpcall),
+			new(validateBatchUpcall),
+		}
+		for i, msg := range decoded {
+			decodeUpcall(t, r, msg)
+			require.Equal(t, upcalls[i], msg, "mode %s", mode)
+		}
+	}
+}
+
+func TestFramedBlobErrors(t *testing.T) {
+	var buf bytes.Buffer
+	out := bufio.NewWriter(&buf)
+	hdr := []byte(`{"seqno":1,"method":"closeStream","body":{"stream_idx":4}}`)
+	require.NoError(t, writeFrame(out, hdr, [][]byte{[]byte("stray")}))
+
+	// a blob length running past the end of the frame
+	var lens [8]byte
+	binary.BigEndian.PutUint32(lens[:4], uint32(4+len(hdr)+4))
+	binary.BigEndian.PutUint32(lens[4:], uint32(len(hdr)))
+	buf.Write(lens[:])
+	buf.Write(hdr)
+	buf.Write([]byte{0, 0, 0, 9})
+
+	requests, _ := newCodec(framedMode, bufio.NewReader(&buf), bufio.NewWriter(&bytes.Buffer{}))
+	req, err := requests.next()
+	require.NoError(t, err)
+	_, _, err = parseRequest(req)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+
+	_, err = requests.next()
+	require.Error(t, err)
+}
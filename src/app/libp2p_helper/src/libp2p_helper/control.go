@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"codanet"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Instead of stdin/stdout, the helper can serve the daemon over a control
+// socket, given with -control as either unix:<path> or tcp:<loopback
+// host>:<port>. Each connection is a session speaking the same protocol as
+// stdin/stdout, starting with wire mode negotiation and hello.
+//
+// The daemon can disconnect and reconnect at will: the libp2p host,
+// subscriptions and streams belong to the app, not to a session, so they
+// survive. Only one session is active at a time; connections made while one
+// is active are refused, once they negotiated the wire mode, with an error
+// with seqno 0 and code busy. Upcalls and results are delivered to whichever
+// session is active when they are sent, so results of calls made on a
+// previous session can show up on the new one.
+//
+// The socket is not authenticated, so a unix socket is only accessible to
+// the user running the helper, and a tcp socket only listens on loopback.
+
+// listenControl opens the control socket described by spec
+func listenControl(spec string) (gonet.Listener, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("control address %q is neither unix:<path> nor tcp:<host>:<port>", spec)
+	}
+
+	switch parts[0] {
+	case "unix":
+		return listenUnix(parts[1])
+	case "tcp":
+		host, _, err := gonet.SplitHostPort(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		if ip := gonet.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return nil, fmt.Errorf("refusing to listen for control connections on non-loopback host %q", host)
+		}
+		return gonet.Listen("tcp", parts[1])
+	default:
+		return nil, fmt.Errorf("unknown control address scheme %q", parts[0])
+	}
+}
+
+// listenUnix binds a unix socket at path that only its owner can connect to.
+// It is bound in a private directory and only moved to path once its mode is
+// restricted, so that nobody can connect in between.
+func listenUnix(path string) (gonet.Listener, error) {
+	// a socket left behind by a previous helper would make listening fail
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	dir, err := ioutil.TempDir(filepath.Dir(path), ".helper-control-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	private := filepath.Join(dir, "control.sock")
+	listener, err := gonet.ListenUnix("unix", &gonet.UnixAddr{Name: private, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	listener.SetUnlinkOnClose(false)
+
+	if err := os.Chmod(private, 0600); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	if err := os.Rename(private, path); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// unixListener reports and cleans up the path its socket was moved to
+type unixListener struct {
+	*gonet.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() gonet.Addr {
+	return &gonet.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.UnixListener.Close()
+	_ = os.Remove(l.path)
+	return err
+}
+
+type controlSession struct {
+	conn gonet.Conn
+	out  msgWriter
+}
+
+type controlServer struct {
+	app      *app
+	listener gonet.Listener
+
+	mutex   sync.Mutex
+	changed *sync.Cond
+	current *controlSession
+}
+
+func newControlServer(app *app, listener gonet.Listener) *controlServer {
+	s := &controlServer{app: app, listener: listener}
+	s.changed = sync.NewCond(&s.mutex)
+	return s
+}
+
+// serve accepts sessions until the listener fails
+func (s *controlServer) serve() error {
+	go s.forwardMsgs()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *controlServer) handle(conn gonet.Conn) {
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	in := bufio.NewReaderSize(conn, 1024*1024)
+	out := bufio.NewWriter(conn)
+
+	mode, err := negotiateWireMode(in, out)
+	if err != nil {
+		helperLog.Errorf("failed to negotiate wire mode with control client %s: %s", conn.RemoteAddr(), err)
+		return
+	}
+	helperLog.Infof("control client %s connected, speaking %s wire mode", conn.RemoteAddr(), mode)
+
+	requests, w := newCodec(mode, in, out)
+	session := &controlSession{conn: conn, out: w}
+	if !s.attach(session) {
+		helperLog.Errorf("refusing control client %s: another control client is still connected", conn.RemoteAddr())
+		busy := errors.New("another control client is still connected")
+		if err := w.write(errorResult{Errorr: busy.Error(), Code: codanet.ErrCodeBusy}); err != nil {
+			helperLog.Errorf("telling control client %s it was refused failed: %s", conn.RemoteAddr(), err)
+		}
+		return
+	}
+	defer s.detach(session)
+
+	if err := serve(s.app, requests); err != nil {
+		helperLog.Errorf("control client %s: reading requests failed: %s", conn.RemoteAddr(), err)
+		return
+	}
+	helperLog.Infof("control client %s disconnected", conn.RemoteAddr())
+}
+
+// attach makes session the active one, unless there already is one
+func (s *controlServer) attach(session *controlSession) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current != nil {
+		return false
+	}
+	s.current = session
+	s.changed.Broadcast()
+	return true
+}
+
+func (s *controlServer) detach(session *controlSession) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.current == session {
+		s.current = nil
+	}
+}
+
+// session blocks until a session is active and returns it
+func (s *controlServer) session() *controlSession {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for s.current == nil {
+		s.changed.Wait()
+	}
+	return s.current
+}
+
+// forwardMsgs writes results and upcalls to the active session. While no
+// session is active they queue up in app.OutQueue.
+func (s *controlServer) forwardMsgs() {
+	for {
+		msg := s.app.OutQueue.pop()
+		s.deliver(msg)
+		exitAfterShutdown(s.app, msg, s.deliver)
+	}
+}
+
+// deliver writes msg to the active session. If that session's connection
+// turns out to be gone, msg goes to the session that replaces it instead.
+func (s *controlServer) deliver(msg interface{}) {
+	for {
+		session := s.session()
+		err := session.out.write(msg)
+		if err == nil {
+			return
+		}
+
+		var netErr gonet.Error
+		if !errors.As(err, &netErr) {
+			helperLog.Errorf("dropping %T: encoding it for control client %s failed: %s", msg, session.conn.RemoteAddr(), err)
+			return
+		}
+
+		helperLog.Errorf("writing %T to control client %s failed: %s", msg, session.conn.RemoteAddr(), err)
+		_ = session.conn.Close()
+		s.detach(session)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"codanet"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	gonet "net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type testControlClient struct {
+	conn  gonet.Conn
+	lines *bufio.Reader
+	seqno int
+}
+
+func dialControl(t *testing.T, network string, addr string) *testControlClient {
+	conn, err := gonet.Dial(network, addr)
+	require.NoError(t, err)
+	return &testControlClient{conn: conn, lines: bufio.NewReader(conn)}
+}
+
+// call sends a json lines request and returns the raw result
+func (c *testControlClient) call(t *testing.T, method string, body string) map[string]json.RawMessage {
+	res, err := c.tryCall(method, body)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(c.seqno), string(res["seqno"]))
+	return res
+}
+
+// tryCall is call, returning an error if the helper closed the connection
+func (c *testControlClient) tryCall(method string, body string) (map[string]json.RawMessage, error) {
+	c.seqno++
+	if _, err := fmt.Fprintf(c.conn, `{"seqno":%d,"method":%q,"body":%s}`+"\n", c.seqno, method, body); err != nil {
+		return nil, err
+	}
+
+	line, err := c.lines.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+
+	var res map[string]json.RawMessage
+	return res, json.Unmarshal(line, &res)
+}
+
+// dialSession connects to the helper once it has let go of the previous
+// session, returning the client and the result of its first call
+func dialSession(t *testing.T, addr string, method string, body string) (*testControlClient, map[string]json.RawMessage) {
+	var client *testControlClient
+	var res map[string]json.RawMessage
+	require.Eventually(t, func() bool {
+		client = dialControl(t, "unix", addr)
+		var err error
+		if res, err = client.tryCall(method, body); err != nil {
+			_ = client.conn.Close()
+			return false
+		}
+		return true
+	}, testTimeout, 10*time.Millisecond)
+	return client, res
+}
+
+func TestListenControl(t *testing.T) {
+	for _, spec := range []string{"tcp:8.8.8.8:0", "tcp:example.com:0", "udp:127.0.0.1:0", "/tmp/helper.sock"} {
+		_, err := listenControl(spec)
+		require.Error(t, err, spec)
+	}
+
+	listener, err := listenControl("tcp:127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, listener.Close())
+
+	// only the helper's user can connect to a unix socket
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "helper.sock")
+	listener, err = listenControl("unix:" + path)
+	require.NoError(t, err)
+	require.Equal(t, path, listener.Addr().String())
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	require.NoError(t, listener.Close())
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// nor is the private directory it was bound in left behind
+	entries, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
+
+func TestControlSocketReconnect(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+
+	listener, err := listenControl("unix:" + filepath.Join(dir, "helper.sock"))
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	app := newApp()
+	go func() {
+		_ = newControlServer(app, listener).serve()
+	}()
+
+	hello := helloBody("generateKeypair")
+
+	first := dialControl(t, "unix", listener.Addr().String())
+	require.Contains(t, first.call(t, "hello", hello), "success")
+	require.Contains(t, first.call(t, "generateKeypair", "{}"), "success")
+	require.NoError(t, first.conn.Close())
+
+	// a new session must greet the helper again, and then picks up where the
+	// previous one left off
+	second, res := dialSession(t, listener.Addr().String(), "generateKeypair", "{}")
+	require.Contains(t, res, "error")
+
+	var code codanet.ErrorCode
+	require.NoError(t, json.Unmarshal(res["code"], &code))
+	require.Equal(t, codanet.ErrCodeBadInput, code)
+
+	require.Contains(t, second.call(t, "hello", hello), "success")
+	require.Contains(t, second.call(t, "generateKeypair", "{}"), "success")
+
+	// nobody else can take over while a session is active, and whoever tries
+	// is told so before being disconnected
+	third := dialControl(t, "unix", listener.Addr().String())
+	res, err = third.tryCall("hello", hello)
+	require.NoError(t, err)
+	require.Equal(t, "0", string(res["seqno"]))
+	require.NoError(t, json.Unmarshal(res["code"], &code))
+	require.Equal(t, codanet.ErrCodeBusy, code)
+	_, err = third.tryCall("hello", hello)
+	require.Error(t, err)
+	require.Contains(t, second.call(t, "generateKeypair", "{}"), "success")
+
+	require.NoError(t, second.conn.Close())
+	_, res = dialSession(t, listener.Addr().String(), "hello", hello)
+	require.Contains(t, res, "success")
+}
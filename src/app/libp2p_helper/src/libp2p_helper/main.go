@@ -7,19 +7,24 @@ import (
 	cryptorand "crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
-	"log"
 	gonet "net"
 	"net/http"
 	"os"
+	"reflect"
 	"runtime/debug"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
 	logging "github.com/ipfs/go-log/v2"
+	connmgr "github.com/libp2p/go-libp2p-core/connmgr"
+	control "github.com/libp2p/go-libp2p-core/control"
 	crypto "github.com/libp2p/go-libp2p-core/crypto"
 	net "github.com/libp2p/go-libp2p-core/network"
 	peer "github.com/libp2p/go-libp2p-core/peer"
@@ -37,12 +42,58 @@ import (
 type subscription struct {
 	Sub    *pubsub.Subscription
 	Idx    int
+	Topic  string
 	Ctx    context.Context
 	Cancel context.CancelFunc
 }
 
+// topicValidator is the validator shared by the subscriptions to a topic, as
+// GossipSub allows only one per topic. The first subscription registers it,
+// with its validation options, and the last unregisters it. Its upcalls are
+// for the oldest subscription.
+type topicValidator struct {
+	// the options of the subscription that registered the validator
+	opts  validatorOptions
+	mutex sync.Mutex
+	subs  []int
+}
+
+func (v *topicValidator) add(idx int) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.subs = append(v.subs, idx)
+}
+
+// remove drops the subscription idx, reporting whether it was the last one.
+// The last one is kept, as the validator still runs until it is unregistered.
+func (v *topicValidator) remove(idx int) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	if len(v.subs) == 1 {
+		return true
+	}
+	for i, sub := range v.subs {
+		if sub == idx {
+			v.subs = append(v.subs[:i], v.subs[i+1:]...)
+			break
+		}
+	}
+	return false
+}
+
+// idx is the subscription that the validator's upcalls are for
+func (v *topicValidator) idx() int {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.subs[0]
+}
+
 type validationStatus struct {
 	Completion chan string
+	Timeout    time.Duration
 	TimedOutAt *time.Time
 }
 
@@ -51,15 +102,30 @@ type app struct {
 	Ctx             context.Context
 	Subs            map[int]subscription
 	Topics          map[string]*pubsub.Topic
+	SubValidators   map[string]*topicValidator
+	SubsMutex       sync.Mutex // guards Subs, Topics and SubValidators
 	Validators      map[int]*validationStatus
 	ValidatorMutex  *sync.Mutex
 	Streams         map[int]net.Stream
 	StreamsMutex    sync.Mutex
+	Pending         map[int]*pendingRequest
+	PendingMutex    sync.Mutex
 	Out             *bufio.Writer
-	OutChan         chan interface{}
+	OutQueue        *outQueue
 	Bootstrapper    io.Closer
-	AddedPeers      []peer.AddrInfo
+	StopAdvertising context.CancelFunc  // cancels the discovery started by beginAdvertising
+	Config          *configureMsg       // the settings the helper runs with; reconfigure replaces rather than modifies it
+	ConfigMutex     sync.Mutex          // guards Config
+	ReconfigMutex   sync.Mutex          // serializes reconfigure calls
+	AddedPeers      []peer.AddrInfo     // trusted on top of the gating config, and connected to by beginAdvertising
+	GatingConfig    *setGatingConfigMsg // the gating config the daemon set last
+	PeersMutex      sync.Mutex          // guards AddedPeers, GatingConfig and P2p.Seeds
 	UnsafeNoTrustIP bool
+	PeerScores      map[peer.ID]float64 // as of the last time GossipSub reported them, if it scores peers
+	PeerScoresMutex sync.Mutex
+	SeenCache       *seenCache      // the payloads recently handed to the daemon for validation, once configured
+	Upcalls         map[string]bool // the upcalls the daemon handles, as it said in hello
+	UpcallsMutex    sync.Mutex
 
 	// development configuration options
 	NoMDNS    bool
@@ -67,8 +133,16 @@ type app struct {
 	NoUpcalls bool
 }
 
+// pendingRequest is a call that is still running, indexed by seqno in
+// app.Pending so that cancelRequest can find it
+type pendingRequest struct {
+	cancel context.CancelFunc
+}
+
 var seqs = make(chan int)
 
+var helperLog = logging.Logger("helper top-level JSON handling")
+
 type methodIdx int
 
 const (
@@ -94,6 +168,21 @@ const (
 	setGatingConfig
 	setNodeStatus
 	getPeerNodeStatus
+	hello
+	cancelRequest
+	shutdown
+	reconfigure
+	listBans
+	getGatingEvents
+	getConnectionManagerStatus
+	protectPeer
+	unprotectPeer
+	tagPeer
+	untagPeer
+	registerDecayingTag
+	bumpDecayingTag
+	getPeerScores
+	validationCompleteBatch
 )
 
 const validationTimeout = 5 * time.Minute
@@ -102,12 +191,32 @@ type codaPeerInfo struct {
 	Libp2pPort int    `json:"libp2p_port"`
 	Host       string `json:"host"`
 	PeerID     string `json:"peer_id"`
+	// "inbound" or "outbound", in listPeers results
+	Direction string `json:"direction,omitempty"`
 }
 
 type envelope struct {
 	Method methodIdx   `json:"method"`
 	Seqno  int         `json:"seqno"`
 	Body   interface{} `json:"body"`
+	// DeadlineMs optionally bounds how long the call may take. It overrides
+	// the handler's own default timeout, if it has one.
+	DeadlineMs int `json:"deadline_ms,omitempty"`
+}
+
+// timeout returns the latency budget the daemon gave the call, or 0 if it
+// didn't give one
+func (env envelope) timeout() time.Duration {
+	return time.Duration(env.DeadlineMs) * time.Millisecond
+}
+
+// withDefaultTimeout bounds ctx by timeout, unless the daemon already set a
+// deadline for the call
+func withDefaultTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
 }
 
 func (app *app) writeMsg(msg interface{}) {
@@ -115,18 +224,41 @@ func (app *app) writeMsg(msg interface{}) {
 		return
 	}
 
-	app.OutChan <- msg
+	app.OutQueue.push(msg)
 }
 
-type action interface {
-	run(app *app) (interface{}, error)
+// streamCall is implemented by calls on a single stream
+type streamCall interface {
+	stream() int
+}
+
+func (cs *closeStreamMsg) stream() int   { return cs.StreamIdx }
+func (cs *resetStreamMsg) stream() int   { return cs.StreamIdx }
+func (cs *sendStreamMsgMsg) stream() int { return cs.StreamIdx }
+
+// writeResult writes res, the result of msg. The result of a call on a stream
+// doesn't overtake that stream's data.
+func (app *app) writeResult(msg action, res interface{}) {
+	if app.NoUpcalls {
+		return
+	}
+
+	if sc, ok := msg.(streamCall); ok {
+		app.OutQueue.pushResult(res, sc.stream())
+		return
+	}
+	app.OutQueue.push(res)
 }
 
-// TODO: wrap these in a new type, encode them differently in the rpc mainloop
+type action interface {
+	// ctx is cancelled when the daemon cancels the request
+	run(ctx context.Context, app *app) (interface{}, error)
+}
 
 type wrappedError struct {
-	e   error
-	tag string
+	e    error
+	tag  string
+	code codanet.ErrorCode
 }
 
 func (w wrappedError) Error() string {
@@ -137,46 +269,81 @@ func (w wrappedError) Unwrap() error {
 	return w.e
 }
 
-func wrapError(e error, tag string) error { return wrappedError{e: e, tag: tag} }
+func wrapErrorWithCode(e error, tag string, code codanet.ErrorCode) error {
+	return wrappedError{e: e, tag: tag, code: code}
+}
+
+// codeOf returns the outermost error code attached to err, sent to the daemon
+// alongside the message in errorResult
+func codeOf(err error) codanet.ErrorCode {
+	for e := err; e != nil; {
+		switch w := e.(type) {
+		case wrappedError:
+			if w.code != "" {
+				return w.code
+			}
+		case *codanet.CodedError:
+			return w.Code
+		}
+		u, ok := e.(interface{ Unwrap() error })
+		if !ok {
+			break
+		}
+		e = u.Unwrap()
+	}
+	return codanet.ErrCodeInternal
+}
+
+func badRequest(e error) error {
+	return wrapErrorWithCode(e, "malformed request", codanet.ErrCodeBadInput)
+}
 
 func badRPC(e error) error {
-	return wrapError(e, "internal RPC error")
+	return wrapErrorWithCode(e, "internal RPC error", codanet.ErrCodeBadInput)
 }
 
 func badp2p(e error) error {
-	return wrapError(e, "libp2p error")
+	return wrapErrorWithCode(e, "libp2p error", codanet.ClassifyError(e))
 }
 
 func badHelper(e error) error {
-	return wrapError(e, "initializing helper")
+	return wrapErrorWithCode(e, "initializing helper", codanet.ErrCodeInitFailed)
 }
 
 func badAddr(e error) error {
-	return wrapError(e, "initializing external addr")
+	return wrapErrorWithCode(e, "initializing external addr", codanet.ErrCodeBadInput)
+}
+
+func internalError(e error) error {
+	return wrapErrorWithCode(e, "internal helper error", codanet.ErrCodeInternal)
 }
 
 func needsConfigure() error {
-	return badRPC(errors.New("helper not yet configured"))
+	return wrapErrorWithCode(errors.New("helper not yet configured"), "internal RPC error", codanet.ErrCodeNotConfigured)
 }
 
 func needsDHT() error {
-	return badRPC(errors.New("helper not yet joined to pubsub"))
+	return wrapErrorWithCode(errors.New("helper not yet joined to pubsub"), "internal RPC error", codanet.ErrCodeNotConfigured)
+}
+
+func unknownStream() error {
+	return wrapErrorWithCode(errors.New("unknown stream_idx"), "internal RPC error", codanet.ErrCodeUnknownStream)
 }
 
 func parseMultiaddrWithID(ma multiaddr.Multiaddr, id peer.ID) (*codaPeerInfo, error) {
 	ipComponent, tcpMaddr := multiaddr.SplitFirst(ma)
 	if !(ipComponent.Protocol().Code == multiaddr.P_IP4 || ipComponent.Protocol().Code == multiaddr.P_IP6) {
-		return nil, badRPC(errors.New(fmt.Sprintf("only IP connections are supported right now, how did this peer connect?: %s", ma.String())))
+		return nil, badp2p(fmt.Errorf("only IP connections are supported right now, how did this peer connect?: %s", ma.String()))
 	}
 
 	tcpComponent, _ := multiaddr.SplitFirst(tcpMaddr)
 	if tcpComponent.Protocol().Code != multiaddr.P_TCP {
-		return nil, badRPC(errors.New("only TCP connections are supported right now, how did this peer connect?"))
+		return nil, badp2p(errors.New("only TCP connections are supported right now, how did this peer connect?"))
 	}
 
 	port, err := strconv.Atoi(tcpComponent.Value())
 	if err != nil {
-		return nil, err
+		return nil, badp2p(err)
 	}
 
 	return &codaPeerInfo{Libp2pPort: port, Host: ipComponent.Value(), PeerID: peer.Encode(id)}, nil
@@ -249,30 +416,89 @@ var (
 )
 
 type configureMsg struct {
-	Statedir            string             `json:"statedir"`
-	Privk               string             `json:"privk"`
-	NetworkID           string             `json:"network_id"`
-	ListenOn            []string           `json:"ifaces"`
-	MetricsPort         string             `json:"metrics_port"`
-	External            string             `json:"external_maddr"`
-	UnsafeNoTrustIP     bool               `json:"unsafe_no_trust_ip"`
-	Flood               bool               `json:"flood"`
-	PeerExchange        bool               `json:"peer_exchange"`
-	DirectPeers         []string           `json:"direct_peers"`
-	SeedPeers           []string           `json:"seed_peers"`
-	GatingConfig        setGatingConfigMsg `json:"gating_config"`
-	MaxConnections      int                `json:"max_connections"`
-	ValidationQueueSize int                `json:"validation_queue_size"`
-	MinaPeerExchange    bool               `json:"mina_peer_exchange"`
+	Statedir        string             `json:"statedir"`
+	Privk           string             `json:"privk"`
+	NetworkID       string             `json:"network_id"`
+	ListenOn        []string           `json:"ifaces"`
+	MetricsPort     string             `json:"metrics_port"`
+	External        string             `json:"external_maddr"`
+	UnsafeNoTrustIP bool               `json:"unsafe_no_trust_ip"`
+	Flood           bool               `json:"flood"`
+	PeerExchange    bool               `json:"peer_exchange"`
+	DirectPeers     []string           `json:"direct_peers"`
+	SeedPeers       []string           `json:"seed_peers"`
+	GatingConfig    setGatingConfigMsg `json:"gating_config"`
+	MaxConnections  int                `json:"max_connections"`
+	// the connection manager trims down to LowWater connections once there
+	// are more than MaxConnections, sparing those made in the last
+	// GracePeriodMs. 0 is the default for either. ReservedOutbound of the
+	// MaxConnections slots are kept for connections we make ourselves.
+	LowWater            int    `json:"low_water"`
+	GracePeriodMs       int    `json:"grace_period_ms"`
+	ReservedOutbound    int    `json:"reserved_outbound"`
+	ValidationQueueSize int    `json:"validation_queue_size"`
+	MinaPeerExchange    bool   `json:"mina_peer_exchange"`
+	OutQueueSize        int    `json:"out_queue_size"`
+	OutQueuePolicy      string `json:"out_queue_policy"`
+	PersistGatingState  bool   `json:"persist_gating_state"`
+	// GossipSub only scores peers if this is set
+	PeerScore *peerScoreConfig `json:"peer_score"`
+	// how GossipSub identifies messages, "sender_seqno" (the default) or
+	// "blake2b" of the payload, and for how long payloads handed to the
+	// daemon for validation aren't handed to it again. 0 disables the seen
+	// cache.
+	MessageID      string `json:"message_id"`
+	SeenCacheTTLMs int    `json:"seen_cache_ttl_ms"`
 }
 
 type peerConnectionUpcall struct {
 	ID     string `json:"peer_id"`
 	Upcall string `json:"upcall"`
+	// why the helper dropped the connection, if it did
+	Reason string `json:"reason,omitempty"`
 }
 
-func (m *configureMsg) run(app *app) (interface{}, error) {
+func (m *configureMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p != nil {
+		return nil, badRequest(errors.New("helper already configured, use reconfigure to change its settings"))
+	}
+
 	app.UnsafeNoTrustIP = m.UnsafeNoTrustIP
+
+	policy := overflowBlock
+	if m.OutQueuePolicy != "" {
+		policy = overflowPolicy(m.OutQueuePolicy)
+	}
+	if err := app.OutQueue.configure(m.OutQueueSize, policy); err != nil {
+		return nil, badRPC(err)
+	}
+
+	if m.LowWater < 0 || m.GracePeriodMs < 0 {
+		return nil, badRPC(errors.New("low_water and grace_period_ms must not be negative"))
+	}
+	if m.LowWater > m.MaxConnections {
+		return nil, badRPC(fmt.Errorf("low_water %d is above max_connections %d", m.LowWater, m.MaxConnections))
+	}
+	if m.ReservedOutbound < 0 || m.ReservedOutbound > m.MaxConnections {
+		return nil, badRPC(fmt.Errorf("reserved_outbound must be between 0 and max_connections %d, got %d", m.MaxConnections, m.ReservedOutbound))
+	}
+	lowWater := codanet.DefaultLowWater
+	if m.LowWater > 0 {
+		lowWater = m.LowWater
+	}
+	gracePeriod := codanet.DefaultGracePeriod
+	if m.GracePeriodMs > 0 {
+		gracePeriod = time.Duration(m.GracePeriodMs) * time.Millisecond
+	}
+
+	messageIDOpts, err := messageIDOptions(m.MessageID)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	if m.SeenCacheTTLMs < 0 {
+		return nil, badRPC(fmt.Errorf("seen_cache_ttl_ms must not be negative, got %d", m.SeenCacheTTLMs))
+	}
+
 	privkBytes, err := codaDecode(m.Privk)
 	if err != nil {
 		return nil, badRPC(err)
@@ -302,8 +528,6 @@ func (m *configureMsg) run(app *app) (interface{}, error) {
 		seeds = append(seeds, *addr)
 	}
 
-	app.AddedPeers = append(app.AddedPeers, seeds...)
-
 	directPeers := make([]peer.AddrInfo, 0, len(m.DirectPeers))
 	for _, v := range m.DirectPeers {
 		addr, err := addrInfoOfString(v)
@@ -321,15 +545,22 @@ func (m *configureMsg) run(app *app) (interface{}, error) {
 		return nil, badAddr(err)
 	}
 
+	app.PeersMutex.Lock()
+	app.AddedPeers = append(app.AddedPeers, seeds...)
+	app.GatingConfig = &m.GatingConfig
 	gatingConfig, err := gatingConfigFromJson(&(m.GatingConfig), app.AddedPeers)
+	app.PeersMutex.Unlock()
 	if err != nil {
 		return nil, badRPC(err)
 	}
+	gatingConfig.OnBanExpired = app.banExpired
+	gatingConfig.OnUpgradeRejected = app.upgradeRejected
 
-	helper, err := codanet.MakeHelper(app.Ctx, maddrs, externalMaddr, m.Statedir, privk, m.NetworkID, seeds, gatingConfig, m.MaxConnections, m.MinaPeerExchange)
+	helper, err := codanet.MakeHelper(app.Ctx, maddrs, externalMaddr, m.Statedir, privk, m.NetworkID, seeds, gatingConfig, m.MaxConnections, lowWater, gracePeriod, m.MinaPeerExchange, m.PersistGatingState)
 	if err != nil {
 		return nil, badHelper(err)
 	}
+	helper.ConnectionManager.SetReservedOutbound(helper.Host.Network(), m.ReservedOutbound)
 
 	// SOMEDAY:
 	// - stop putting block content on the mesh.
@@ -340,15 +571,26 @@ func (m *configureMsg) run(app *app) (interface{}, error) {
 		pubsub.WithDirectPeers(directPeers),
 		pubsub.WithValidateQueueSize(m.ValidationQueueSize),
 	}
+	opts = append(opts, messageIDOpts...)
+	if m.PeerScore != nil {
+		opts = append(opts, m.PeerScore.options(app)...)
+	}
 
 	var ps *pubsub.PubSub
 	ps, err = pubsub.NewGossipSub(app.Ctx, helper.Host, opts...)
 	if err != nil {
+		_ = helper.Close()
+		// GossipSub is what checks the score parameters
+		if m.PeerScore != nil {
+			return nil, badRPC(err)
+		}
 		return nil, badHelper(err)
 	}
 
 	helper.Pubsub = ps
+	app.SeenCache = newSeenCache(time.Duration(m.SeenCacheTTLMs) * time.Millisecond)
 	app.P2p = helper
+	app.setConfig(m)
 
 	app.P2p.Logger.Infof("here are the seeds: %v", seeds)
 
@@ -362,242 +604,913 @@ func (m *configureMsg) run(app *app) (interface{}, error) {
 	return "configure success", nil
 }
 
-type listenMsg struct {
-	Iface string `json:"iface"`
-}
+// reconfigureMsg changes settings of a configured helper. Fields left out are
+// unchanged.
+type reconfigureMsg struct {
+	MaxConnections   *int             `json:"max_connections"`
+	LowWater         *int             `json:"low_water"`
+	GracePeriodMs    *int             `json:"grace_period_ms"`
+	ReservedOutbound *int             `json:"reserved_outbound"`
+	Flood            *bool            `json:"flood"`
+	PeerExchange     *bool            `json:"peer_exchange"`
+	DirectPeers      []string         `json:"direct_peers"`
+	PeerScore        *peerScoreConfig `json:"peer_score"`
+	MessageID        *string          `json:"message_id"`
+	SeenCacheTTLMs   *int             `json:"seen_cache_ttl_ms"`
+	SeedPeers        []string         `json:"seed_peers"`
+	MetricsPort      *string          `json:"metrics_port"`
+	External         *string          `json:"external_maddr"`
+}
+
+// reconfigureResult lists the changed fields, by their JSON name, that took
+// effect on the live host and those that only take effect when the helper is
+// restarted and configured with them
+type reconfigureResult struct {
+	Applied         []string `json:"applied"`
+	RestartRequired []string `json:"restart_required"`
+}
+
+// replaceSeeds makes seeds the seed peers, returning the new ones. New seeds
+// are added and trusted, while dropped ones are removed and no longer
+// trusted, unless the gating config trusts them.
+func (app *app) replaceSeeds(seeds []peer.AddrInfo) []peer.AddrInfo {
+	app.PeersMutex.Lock()
+	defer app.PeersMutex.Unlock()
+
+	old := make(map[peer.ID]bool)
+	for _, info := range app.P2p.Seeds {
+		old[info.ID] = true
+	}
+	current := make(map[peer.ID]bool)
+	var added []peer.AddrInfo
+	for _, info := range seeds {
+		current[info.ID] = true
+		if !old[info.ID] {
+			added = append(added, info)
+			app.AddedPeers = append(app.AddedPeers, info)
+			app.P2p.GatingState.TrustPeer(info.ID)
+		}
+	}
 
-func (m *listenMsg) run(app *app) (interface{}, error) {
-	if app.P2p == nil {
-		return nil, needsConfigure()
+	trusted := make(map[string]bool)
+	if app.GatingConfig != nil {
+		for _, id := range app.GatingConfig.TrustedPeerIDs {
+			trusted[id] = true
+		}
 	}
-	ma, err := multiaddr.NewMultiaddr(m.Iface)
-	if err != nil {
-		return nil, badp2p(err)
+	kept := make([]peer.AddrInfo, 0, len(app.AddedPeers))
+	for _, info := range app.AddedPeers {
+		if old[info.ID] && !current[info.ID] {
+			continue
+		}
+		kept = append(kept, info)
 	}
-	if err := app.P2p.Host.Network().Listen(ma); err != nil {
-		return nil, badp2p(err)
+	for id := range old {
+		if !current[id] && !trusted[peer.Encode(id)] {
+			app.P2p.GatingState.DistrustPeer(id)
+		}
 	}
-	return app.P2p.Host.Addrs(), nil
+	app.AddedPeers = kept
+	app.P2p.Seeds = seeds
+	return added
 }
 
-type listeningAddrsMsg struct {
+// addedPeers returns a copy of app.AddedPeers
+func (app *app) addedPeers() []peer.AddrInfo {
+	app.PeersMutex.Lock()
+	defer app.PeersMutex.Unlock()
+
+	return append([]peer.AddrInfo(nil), app.AddedPeers...)
 }
 
-func (m *listeningAddrsMsg) run(app *app) (interface{}, error) {
-	if app.P2p == nil {
-		return nil, needsConfigure()
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
 	}
-	return app.P2p.Host.Addrs(), nil
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
 }
 
-type publishMsg struct {
-	Topic string `json:"topic"`
-	Data  string `json:"data"`
+// config returns the settings the helper runs with, which must not be
+// modified
+func (app *app) config() *configureMsg {
+	app.ConfigMutex.Lock()
+	defer app.ConfigMutex.Unlock()
+	return app.Config
+}
+
+func (app *app) setConfig(config *configureMsg) {
+	app.ConfigMutex.Lock()
+	defer app.ConfigMutex.Unlock()
+	app.Config = config
 }
 
-func (t *publishMsg) run(app *app) (interface{}, error) {
+func (m *reconfigureMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
-	if app.P2p.Dht == nil {
-		return nil, needsDHT()
-	}
 
-	data, err := codaDecode(t.Data)
-	if err != nil {
-		return nil, badRPC(err)
-	}
+	app.ReconfigMutex.Lock()
+	defer app.ReconfigMutex.Unlock()
 
-	var topic *pubsub.Topic
-	var has bool
+	// check everything before changing anything, so that a bad request
+	// leaves the helper as it was
+	if m.MaxConnections != nil && *m.MaxConnections <= 0 {
+		return nil, badRPC(fmt.Errorf("max_connections must be positive, got %d", *m.MaxConnections))
+	}
 
-	if topic, has = app.Topics[t.Topic]; !has {
-		topic, err = app.P2p.Pubsub.Join(t.Topic)
-		if err != nil {
-			return nil, badp2p(err)
+	info := app.P2p.ConnectionManager.GetInfo()
+	lowWater, highWater, gracePeriod := info.LowWater, info.HighWater, info.GracePeriod
+	if m.MaxConnections != nil {
+		highWater = *m.MaxConnections
+	}
+	if m.LowWater != nil {
+		if *m.LowWater <= 0 {
+			return nil, badRPC(fmt.Errorf("low_water must be positive, got %d", *m.LowWater))
 		}
-		app.Topics[t.Topic] = topic
+		if *m.LowWater > highWater {
+			return nil, badRPC(fmt.Errorf("low_water %d is above max_connections %d", *m.LowWater, highWater))
+		}
+		lowWater = *m.LowWater
 	}
-
-	if err := topic.Publish(app.Ctx, data); err != nil {
-		return nil, badp2p(err)
+	if m.GracePeriodMs != nil {
+		if *m.GracePeriodMs < 0 {
+			return nil, badRPC(fmt.Errorf("grace_period_ms must not be negative, got %d", *m.GracePeriodMs))
+		}
+		gracePeriod = time.Duration(*m.GracePeriodMs) * time.Millisecond
+	}
+	reservedOutbound := app.P2p.ConnectionManager.ReservedOutbound()
+	if m.ReservedOutbound != nil {
+		if *m.ReservedOutbound < 0 {
+			return nil, badRPC(fmt.Errorf("reserved_outbound must not be negative, got %d", *m.ReservedOutbound))
+		}
+		reservedOutbound = *m.ReservedOutbound
+	}
+	if reservedOutbound > highWater {
+		return nil, badRPC(fmt.Errorf("reserved_outbound %d is above max_connections %d", reservedOutbound, highWater))
+	}
+	if m.SeenCacheTTLMs != nil && *m.SeenCacheTTLMs < 0 {
+		return nil, badRPC(fmt.Errorf("seen_cache_ttl_ms must not be negative, got %d", *m.SeenCacheTTLMs))
 	}
 
-	return "publish success", nil
-}
-
-type subscribeMsg struct {
-	Topic        string `json:"topic"`
-	Subscription int    `json:"subscription_idx"`
-}
-
-// we use base64 for encoding blobs in our JSON protocol. there are more
-// efficient options but this one is easy to reach to.
+	for _, v := range m.DirectPeers {
+		if _, err := addrInfoOfString(v); err != nil {
+			return nil, badRPC(err)
+		}
+	}
 
-func codaEncode(data []byte) string {
-	return base64.StdEncoding.EncodeToString(data)
-}
+	var seeds []peer.AddrInfo
+	if m.SeedPeers != nil {
+		seeds = make([]peer.AddrInfo, 0, len(m.SeedPeers))
+		for _, v := range m.SeedPeers {
+			addr, err := addrInfoOfString(v)
+			if err != nil {
+				return nil, badRPC(err)
+			}
+			seeds = append(seeds, *addr)
+		}
+	}
 
-func codaDecode(data string) ([]byte, error) {
-	return base64.StdEncoding.DecodeString(data)
-}
+	var externalMaddr multiaddr.Multiaddr
+	if m.External != nil {
+		var err error
+		externalMaddr, err = multiaddr.NewMultiaddr(*m.External)
+		if err != nil {
+			return nil, badAddr(err)
+		}
+	}
 
-var (
-	acceptResult = "accept"
-	rejectResult = "reject"
-	ignoreResult = "ignore"
-)
+	// readers may hold on to the current settings, so changes go to a copy
+	// that replaces them at the end
+	config := *app.config()
+	defer app.setConfig(&config)
+	result := reconfigureResult{Applied: []string{}, RestartRequired: []string{}}
 
-func (s *subscribeMsg) run(app *app) (interface{}, error) {
-	if app.P2p == nil {
-		return nil, needsConfigure()
+	// GossipSub takes these as options when it's created and has no way to
+	// change them afterwards
+	if m.Flood != nil && *m.Flood != config.Flood {
+		result.RestartRequired = append(result.RestartRequired, "flood")
 	}
-	if app.P2p.Dht == nil {
-		return nil, needsDHT()
+	if m.PeerExchange != nil && *m.PeerExchange != config.PeerExchange {
+		result.RestartRequired = append(result.RestartRequired, "peer_exchange")
+	}
+	if m.DirectPeers != nil && !sameStrings(m.DirectPeers, config.DirectPeers) {
+		result.RestartRequired = append(result.RestartRequired, "direct_peers")
+	}
+	if m.PeerScore != nil && !reflect.DeepEqual(m.PeerScore, config.PeerScore) {
+		result.RestartRequired = append(result.RestartRequired, "peer_score")
+	}
+	if m.MessageID != nil && *m.MessageID != config.MessageID {
+		result.RestartRequired = append(result.RestartRequired, "message_id")
 	}
 
-	topic, err := app.P2p.Pubsub.Join(s.Topic)
-	if err != nil {
-		return nil, badp2p(err)
+	var limitsChanged []string
+	if highWater != info.HighWater {
+		limitsChanged = append(limitsChanged, "max_connections")
+	}
+	if lowWater != info.LowWater {
+		limitsChanged = append(limitsChanged, "low_water")
+	}
+	if gracePeriod != info.GracePeriod {
+		limitsChanged = append(limitsChanged, "grace_period_ms")
+	}
+	if len(limitsChanged) > 0 {
+		if err := app.P2p.ConnectionManager.SetLimits(app.P2p.Host.Network(), lowWater, highWater, gracePeriod); err != nil {
+			return nil, badp2p(err)
+		}
+		config.MaxConnections = highWater
+		config.LowWater = lowWater
+		config.GracePeriodMs = int(gracePeriod / time.Millisecond)
+		result.Applied = append(result.Applied, limitsChanged...)
 	}
 
-	app.Topics[s.Topic] = topic
+	if reservedOutbound != app.P2p.ConnectionManager.ReservedOutbound() {
+		app.P2p.ConnectionManager.SetReservedOutbound(app.P2p.Host.Network(), reservedOutbound)
+		config.ReservedOutbound = reservedOutbound
+		result.Applied = append(result.Applied, "reserved_outbound")
+	}
 
-	err = app.P2p.Pubsub.RegisterTopicValidator(s.Topic, func(ctx context.Context, id peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
-		if id == app.P2p.Me {
-			// messages from ourself are valid.
-			app.P2p.Logger.Info("would have validated but it's from us!")
-			return pubsub.ValidationAccept
+	if m.SeenCacheTTLMs != nil && *m.SeenCacheTTLMs != config.SeenCacheTTLMs {
+		if app.SeenCache != nil {
+			app.SeenCache.setTTL(time.Duration(*m.SeenCacheTTLMs) * time.Millisecond)
 		}
+		config.SeenCacheTTLMs = *m.SeenCacheTTLMs
+		result.Applied = append(result.Applied, "seen_cache_ttl_ms")
+	}
 
-		seqno := <-seqs
-		ch := make(chan string)
-		app.ValidatorMutex.Lock()
-		app.Validators[seqno] = new(validationStatus)
-		app.Validators[seqno].Completion = ch
-		app.ValidatorMutex.Unlock()
+	if m.SeedPeers != nil && !sameStrings(m.SeedPeers, config.SeedPeers) {
+		added := app.replaceSeeds(seeds)
 
-		app.P2p.Logger.Info("validating a new pubsub message ...")
+		// beginAdvertising connects to the added peers, so new seeds only
+		// need connecting to here if it already ran
+		if app.StopAdvertising != nil {
+			for _, info := range added {
+				go func(info peer.AddrInfo) {
+					if err := app.P2p.Host.Connect(app.Ctx, info); err != nil {
+						app.P2p.Logger.Warningf("failed to connect to new seed %s: %s", info, err)
+					}
+				}(info)
+			}
+		}
 
-		sender, err := findPeerInfo(app, id)
+		config.SeedPeers = m.SeedPeers
+		result.Applied = append(result.Applied, "seed_peers")
+	}
 
-		if err != nil && !app.UnsafeNoTrustIP {
-			app.P2p.Logger.Errorf("failed to connect to peer %s that just sent us a pubsub message, dropping it", peer.Encode(id))
-			app.ValidatorMutex.Lock()
-			defer app.ValidatorMutex.Unlock()
-			delete(app.Validators, seqno)
-			return pubsub.ValidationIgnore
+	if m.MetricsPort != nil && *m.MetricsPort != config.MetricsPort {
+		if metricsServer != nil {
+			metricsServer.Shutdown()
+			metricsServer = nil
 		}
-
-		deadline, ok := ctx.Deadline()
-		if !ok {
-			app.P2p.Logger.Errorf("no deadline set on validation context")
-			defer app.ValidatorMutex.Unlock()
-			delete(app.Validators, seqno)
-			return pubsub.ValidationIgnore
+		if len(*m.MetricsPort) > 0 {
+			metricsServer = startMetricsServer(*m.MetricsPort)
 		}
+		config.MetricsPort = *m.MetricsPort
+		result.Applied = append(result.Applied, "metrics_port")
+	}
 
-		app.writeMsg(validateUpcall{
-			Sender:     sender,
-			Expiration: deadline.UnixNano(),
-			Data:       codaEncode(msg.Data),
-			Seqno:      seqno,
-			Upcall:     "validate",
-			Idx:        s.Subscription,
-		})
+	if m.External != nil && *m.External != config.External {
+		app.P2p.SetExternalAddr(externalMaddr)
+		config.External = *m.External
+		result.Applied = append(result.Applied, "external_maddr")
+	}
 
-		// Wait for the validation response, but be sure to honor any timeout/deadline in ctx
-		select {
-		case <-ctx.Done():
-			// XXX: do 🅽🅾🆃  delete app.Validators[seqno] here! the ocaml side doesn't
-			// care about the timeout and will validate it anyway.
-			// validationComplete will remove app.Validators[seqno] once the
-			// coda process gets around to it.
-			app.P2p.Logger.Error("validation timed out :(")
+	return result, nil
+}
 
-			app.ValidatorMutex.Lock()
+type getConnectionManagerStatusMsg struct {
+}
 
-			now := time.Now()
-			app.Validators[seqno].TimedOutAt = &now
+type connectionManagerStatus struct {
+	LowWater      int   `json:"low_water"`
+	HighWater     int   `json:"high_water"`
+	GracePeriodMs int64 `json:"grace_period_ms"`
+	ConnCount     int   `json:"conn_count"`
+	// the open connections by direction
+	InboundCount     int `json:"inbound_count"`
+	OutboundCount    int `json:"outbound_count"`
+	ReservedOutbound int `json:"reserved_outbound"`
+	// when connections were last trimmed, if ever
+	LastTrimMs int64 `json:"last_trim_ms,omitempty"`
+}
 
-			app.ValidatorMutex.Unlock()
+func (m *getConnectionManagerStatusMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
 
-			if app.UnsafeNoTrustIP {
-				app.P2p.Logger.Info("validated anyway!")
-				return pubsub.ValidationAccept
-			}
-			app.P2p.Logger.Info("unvalidated :(")
-			return pubsub.ValidationReject
-		case res := <-ch:
-			switch res {
-			case rejectResult:
-				app.P2p.Logger.Info("why u fail to validate :(")
-				return pubsub.ValidationReject
-			case acceptResult:
-				app.P2p.Logger.Info("validated!")
-				return pubsub.ValidationAccept
-			case ignoreResult:
-				app.P2p.Logger.Info("ignoring valid message!")
-				return pubsub.ValidationIgnore
-			default:
-				app.P2p.Logger.Info("ignoring message that falled off the end!")
-				return pubsub.ValidationIgnore
-			}
-		}
-	}, pubsub.WithValidatorTimeout(validationTimeout))
+	info := app.P2p.ConnectionManager.GetInfo()
+	inbound, outbound := codanet.ConnCounts(app.P2p.Host.Network())
+	status := connectionManagerStatus{
+		LowWater:         info.LowWater,
+		HighWater:        info.HighWater,
+		GracePeriodMs:    int64(info.GracePeriod / time.Millisecond),
+		ConnCount:        info.ConnCount,
+		InboundCount:     inbound,
+		OutboundCount:    outbound,
+		ReservedOutbound: app.P2p.ConnectionManager.ReservedOutbound(),
+	}
+	if !info.LastTrim.IsZero() {
+		status.LastTrimMs = info.LastTrim.UnixNano() / int64(time.Millisecond)
+	}
+	return status, nil
+}
 
-	if err != nil {
-		return nil, badp2p(err)
+// The tags and protections the daemon sets are kept apart from those of the
+// helper and of libp2p, so that the daemon can't clear them by accident
+func daemonTag(tag string) (string, error) {
+	if tag == "" {
+		return "", badRPC(errors.New("tag must not be empty"))
 	}
+	return "daemon:" + tag, nil
+}
 
-	sub, err := topic.Subscribe()
+// decodePeerTag decodes the peer ID and tag the tagging RPCs take
+func decodePeerTag(peerID string, tag string) (peer.ID, string, error) {
+	id, err := peer.Decode(peerID)
 	if err != nil {
-		return nil, badp2p(err)
+		return "", "", badRPC(err)
 	}
-
-	ctx, cancel := context.WithCancel(app.Ctx)
-	app.Subs[s.Subscription] = subscription{
-		Sub:    sub,
-		Idx:    s.Subscription,
-		Ctx:    ctx,
-		Cancel: cancel,
+	tag, err = daemonTag(tag)
+	if err != nil {
+		return "", "", err
 	}
-	go func() {
-		for {
-			_, err = sub.Next(ctx)
-			if err != nil {
-				if ctx.Err() != context.Canceled {
-					app.P2p.Logger.Error("sub.Next failed: ", err)
-				} else {
-					break
-				}
-			}
-		}
-	}()
-	return "subscribe success", nil
+	return id, tag, nil
 }
 
-type unsubscribeMsg struct {
-	Subscription int `json:"subscription_idx"`
+// protectPeerMsg keeps the connection manager from trimming the connections
+// to a peer until it is unprotected with the same tag
+type protectPeerMsg struct {
+	PeerID string `json:"peer_id"`
+	Tag    string `json:"tag"`
 }
 
-func (u *unsubscribeMsg) run(app *app) (interface{}, error) {
+func (m *protectPeerMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
-	if sub, ok := app.Subs[u.Subscription]; ok {
-		sub.Sub.Cancel()
-		sub.Cancel()
-		delete(app.Subs, u.Subscription)
-		return "unsubscribe success", nil
+
+	id, tag, err := decodePeerTag(m.PeerID, m.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	app.P2p.ConnectionManager.Protect(id, tag)
+	return "protectPeer success", nil
+}
+
+type unprotectPeerMsg struct {
+	PeerID string `json:"peer_id"`
+	Tag    string `json:"tag"`
+}
+
+type unprotectPeerResult struct {
+	// whether the peer is still protected, under other tags
+	Protected bool `json:"protected"`
+}
+
+func (m *unprotectPeerMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	id, tag, err := decodePeerTag(m.PeerID, m.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return unprotectPeerResult{Protected: app.P2p.ConnectionManager.Unprotect(id, tag)}, nil
+}
+
+// tagPeerMsg sets the weight of a tag on a peer. The connection manager trims
+// the connections to the peers with the least total weight first.
+type tagPeerMsg struct {
+	PeerID string `json:"peer_id"`
+	Tag    string `json:"tag"`
+	Weight int    `json:"weight"`
+}
+
+func (m *tagPeerMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	id, tag, err := decodePeerTag(m.PeerID, m.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	app.P2p.ConnectionManager.TagPeer(id, tag, m.Weight)
+	return "tagPeer success", nil
+}
+
+type untagPeerMsg struct {
+	PeerID string `json:"peer_id"`
+	Tag    string `json:"tag"`
+}
+
+func (m *untagPeerMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	id, tag, err := decodePeerTag(m.PeerID, m.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	app.P2p.ConnectionManager.UntagPeer(id, tag)
+	return "untagPeer success", nil
+}
+
+// registerDecayingTagMsg registers a tag whose weight on each peer decays
+// every IntervalMs, and grows when bumped with bumpDecayingTag. The
+// connection manager applies decay at most once a minute.
+type registerDecayingTagMsg struct {
+	Name       string `json:"name"`
+	IntervalMs int    `json:"interval_ms"`
+	// how the weight decays each interval: "none", "fixed" to subtract
+	// DecayAmount, "linear" to multiply by DecayCoefficient, or "expire" to
+	// drop the tag once it wasn't bumped for ExpireAfterMs. It is removed
+	// from a peer once it reaches zero.
+	Decay            string  `json:"decay"`
+	DecayAmount      int     `json:"decay_amount"`
+	DecayCoefficient float64 `json:"decay_coefficient"`
+	ExpireAfterMs    int     `json:"expire_after_ms"`
+	// how bumps add up: "sum", the default, "bounded_sum" to keep the weight
+	// between BumpMin and BumpMax, or "overwrite" to replace it
+	Bump    string `json:"bump"`
+	BumpMin int    `json:"bump_min"`
+	BumpMax int    `json:"bump_max"`
+}
+
+func (m *registerDecayingTagMsg) decayFn() (connmgr.DecayFn, error) {
+	switch m.Decay {
+	case "none":
+		return connmgr.DecayNone(), nil
+	case "fixed":
+		if m.DecayAmount <= 0 {
+			return nil, fmt.Errorf("decay_amount must be positive, got %d", m.DecayAmount)
+		}
+		return connmgr.DecayFixed(m.DecayAmount), nil
+	case "linear":
+		if m.DecayCoefficient <= 0 || m.DecayCoefficient >= 1 {
+			return nil, fmt.Errorf("decay_coefficient must be between 0 and 1, got %f", m.DecayCoefficient)
+		}
+		return connmgr.DecayLinear(m.DecayCoefficient), nil
+	case "expire":
+		if m.ExpireAfterMs <= 0 {
+			return nil, fmt.Errorf("expire_after_ms must be positive, got %d", m.ExpireAfterMs)
+		}
+		return connmgr.DecayExpireWhenInactive(time.Duration(m.ExpireAfterMs) * time.Millisecond), nil
+	default:
+		return nil, fmt.Errorf("unknown decay %q", m.Decay)
 	}
-	return nil, badRPC(errors.New("subscription not found"))
+}
+
+func (m *registerDecayingTagMsg) bumpFn() (connmgr.BumpFn, error) {
+	switch m.Bump {
+	case "", "sum":
+		return connmgr.BumpSumUnbounded(), nil
+	case "bounded_sum":
+		if m.BumpMin > m.BumpMax {
+			return nil, fmt.Errorf("bump_min %d is above bump_max %d", m.BumpMin, m.BumpMax)
+		}
+		return connmgr.BumpSumBounded(m.BumpMin, m.BumpMax), nil
+	case "overwrite":
+		return connmgr.BumpOverwrite(), nil
+	default:
+		return nil, fmt.Errorf("unknown bump %q", m.Bump)
+	}
+}
+
+func (m *registerDecayingTagMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	name, err := daemonTag(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	if m.IntervalMs <= 0 {
+		return nil, badRPC(fmt.Errorf("interval_ms must be positive, got %d", m.IntervalMs))
+	}
+	decayFn, err := m.decayFn()
+	if err != nil {
+		return nil, badRPC(err)
+	}
+	bumpFn, err := m.bumpFn()
+	if err != nil {
+		return nil, badRPC(err)
+	}
+
+	if _, exists := app.P2p.ConnectionManager.DecayingTag(name); exists {
+		return nil, badRequest(fmt.Errorf("decaying tag %s is already registered", m.Name))
+	}
+
+	interval := time.Duration(m.IntervalMs) * time.Millisecond
+	if _, err := app.P2p.ConnectionManager.RegisterDecayingTag(name, interval, decayFn, bumpFn); err != nil {
+		return nil, badp2p(err)
+	}
+	return "registerDecayingTag success", nil
+}
+
+type bumpDecayingTagMsg struct {
+	Name   string `json:"name"`
+	PeerID string `json:"peer_id"`
+	Delta  int    `json:"delta"`
+}
+
+func (m *bumpDecayingTagMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	id, name, err := decodePeerTag(m.PeerID, m.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	tag, ok := app.P2p.ConnectionManager.DecayingTag(name)
+	if !ok {
+		return nil, badRequest(fmt.Errorf("decaying tag %s is not registered", m.Name))
+	}
+	if err := tag.Bump(id, m.Delta); err != nil {
+		return nil, badp2p(err)
+	}
+	return "bumpDecayingTag success", nil
+}
+
+type listenMsg struct {
+	Iface string `json:"iface"`
+}
+
+func (m *listenMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	ma, err := multiaddr.NewMultiaddr(m.Iface)
+	if err != nil {
+		return nil, badp2p(err)
+	}
+	if err := app.P2p.Host.Network().Listen(ma); err != nil {
+		return nil, badp2p(err)
+	}
+	return app.P2p.Host.Addrs(), nil
+}
+
+type listeningAddrsMsg struct {
+}
+
+func (m *listeningAddrsMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	return app.P2p.Host.Addrs(), nil
+}
+
+type publishMsg struct {
+	Topic string `json:"topic"`
+	Data  []byte `json:"data"`
+}
+
+func (t *publishMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	if app.P2p.Dht == nil {
+		return nil, needsDHT()
+	}
+
+	var err error
+	var topic *pubsub.Topic
+	var has bool
+
+	app.SubsMutex.Lock()
+	if topic, has = app.Topics[t.Topic]; !has {
+		topic, err = app.P2p.Pubsub.Join(t.Topic)
+		if err != nil {
+			app.SubsMutex.Unlock()
+			return nil, badp2p(err)
+		}
+		app.Topics[t.Topic] = topic
+	}
+	app.SubsMutex.Unlock()
+
+	if err := topic.Publish(ctx, t.Data); err != nil {
+		return nil, badp2p(err)
+	}
+
+	return "publish success", nil
+}
+
+type subscribeMsg struct {
+	Topic        string `json:"topic"`
+	Subscription int    `json:"subscription_idx"`
+	// if positive, the messages to validate are sent in validateBatch
+	// upcalls, each gathering those that arrived within BatchWindowMs of the
+	// first, up to MaxBatchSize of them
+	BatchWindowMs int `json:"batch_window_ms"`
+	MaxBatchSize  int `json:"max_batch_size"`
+	// if positive, how long the daemon has to validate each message, and how
+	// many messages it can be validating at once; any more are ignored.
+	// ValidateInline runs the validator on GossipSub's validation workers,
+	// clear of the throttle shared by all topics, so that a backlog on busy
+	// topics can't drop its messages. It holds a worker while the daemon
+	// validates, so it is meant for low-volume topics like blocks.
+	ValidationTimeoutMs   int  `json:"validation_timeout_ms"`
+	ValidationConcurrency int  `json:"validation_concurrency"`
+	ValidateInline        bool `json:"validate_inline"`
+}
+
+// validatorOptions are the options of a subscription that apply to the
+// validator of its topic, which all subscriptions to the topic share
+type validatorOptions struct {
+	batchWindowMs         int
+	maxBatchSize          int
+	validationTimeoutMs   int
+	validationConcurrency int
+	validateInline        bool
+}
+
+func (s *subscribeMsg) validatorOptions() validatorOptions {
+	return validatorOptions{
+		batchWindowMs:         s.BatchWindowMs,
+		maxBatchSize:          s.MaxBatchSize,
+		validationTimeoutMs:   s.ValidationTimeoutMs,
+		validationConcurrency: s.ValidationConcurrency,
+		validateInline:        s.ValidateInline,
+	}
+}
+
+// we use base64 for encoding blobs in our JSON protocol. there are more
+// efficient options but this one is easy to reach to. blobs in messages are
+// []byte fields, which encoding/json base64s the same way, and which the
+// framed wire mode sends raw instead.
+
+func codaEncode(data []byte) string {
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func codaDecode(data string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(data)
+}
+
+var (
+	acceptResult = "accept"
+	rejectResult = "reject"
+	ignoreResult = "ignore"
+)
+
+func (s *subscribeMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	if app.P2p.Dht == nil {
+		return nil, needsDHT()
+	}
+
+	// the call's own deadline only bounds the call, while validation_timeout_ms
+	// bounds the validation of every message received on the subscription
+	timeout := validationTimeout
+	if s.ValidationTimeoutMs > 0 {
+		timeout = time.Duration(s.ValidationTimeoutMs) * time.Millisecond
+	}
+
+	if s.BatchWindowMs < 0 || s.MaxBatchSize < 0 {
+		return nil, badRPC(errors.New("batch_window_ms and max_batch_size must not be negative"))
+	}
+	if s.ValidationTimeoutMs < 0 || s.ValidationConcurrency < 0 {
+		return nil, badRPC(errors.New("validation_timeout_ms and validation_concurrency must not be negative"))
+	}
+	if s.ValidateInline && s.BatchWindowMs > 0 {
+		return nil, badRPC(errors.New("validate_inline can't be combined with batch_window_ms"))
+	}
+	if s.BatchWindowMs > 0 && !app.handles(upcallValidateBatch) {
+		return nil, badRequest(fmt.Errorf("batch_window_ms needs the %s upcall, which the daemon doesn't handle", upcallValidateBatch))
+	}
+	validatorOpts := []pubsub.ValidatorOpt{
+		pubsub.WithValidatorTimeout(timeout),
+		pubsub.WithValidatorInline(s.ValidateInline),
+	}
+	if s.ValidationConcurrency > 0 {
+		validatorOpts = append(validatorOpts, pubsub.WithValidatorConcurrency(s.ValidationConcurrency))
+	}
+
+	app.SubsMutex.Lock()
+	defer app.SubsMutex.Unlock()
+
+	// waiting for the lock may have used up the call's deadline
+	if err := ctx.Err(); err != nil {
+		return nil, badp2p(err)
+	}
+
+	if _, has := app.Subs[s.Subscription]; has {
+		return nil, badRPC(fmt.Errorf("subscription_idx %d is already in use", s.Subscription))
+	}
+
+	validator, shared := app.SubValidators[s.Topic]
+	if shared && validator.opts != s.validatorOptions() {
+		return nil, badRPC(fmt.Errorf("topic %s is already subscribed to with other validator options", s.Topic))
+	}
+
+	var err error
+	topic, has := app.Topics[s.Topic]
+	if !has {
+		topic, err = app.P2p.Pubsub.Join(s.Topic)
+		if err != nil {
+			return nil, badp2p(err)
+		}
+		app.Topics[s.Topic] = topic
+	}
+
+	if !shared {
+		validator = &topicValidator{opts: s.validatorOptions()}
+	}
+	validator.add(s.Subscription)
+	app.SubValidators[s.Topic] = validator
+
+	var batcher *validationBatcher
+	if s.BatchWindowMs > 0 {
+		batcher = newValidationBatcher(app, validator.idx, time.Duration(s.BatchWindowMs)*time.Millisecond, s.MaxBatchSize)
+	}
+
+	validate := func(ctx context.Context, id peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+		if id == app.P2p.Me {
+			// messages from ourself are valid.
+			app.P2p.Logger.Info("would have validated but it's from us!")
+			return pubsub.ValidationAccept
+		}
+
+		if app.SeenCache != nil && !app.SeenCache.claim(msg.Data) {
+			app.P2p.Logger.Debug("not validating a payload the daemon was just handed")
+			return pubsub.ValidationIgnore
+		}
+		// the next copy gets a chance at being validated
+		forget := func() {
+			if app.SeenCache != nil {
+				app.SeenCache.remove(msg.Data)
+			}
+		}
+
+		seqno := <-seqs
+		// buffered, so that completing a validation that timed out doesn't
+		// block on a validator that is no longer waiting
+		ch := make(chan string, 1)
+		app.ValidatorMutex.Lock()
+		app.Validators[seqno] = new(validationStatus)
+		app.Validators[seqno].Completion = ch
+		app.Validators[seqno].Timeout = timeout
+		app.ValidatorMutex.Unlock()
+
+		app.P2p.Logger.Info("validating a new pubsub message ...")
+
+		sender, err := findPeerInfo(app, id)
+
+		if err != nil && !app.UnsafeNoTrustIP {
+			app.P2p.Logger.Errorf("failed to connect to peer %s that just sent us a pubsub message, dropping it", peer.Encode(id))
+			forget()
+			app.ValidatorMutex.Lock()
+			defer app.ValidatorMutex.Unlock()
+			delete(app.Validators, seqno)
+			return pubsub.ValidationIgnore
+		}
+
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			app.P2p.Logger.Errorf("no deadline set on validation context")
+			forget()
+			app.ValidatorMutex.Lock()
+			defer app.ValidatorMutex.Unlock()
+			delete(app.Validators, seqno)
+			return pubsub.ValidationIgnore
+		}
+
+		upcall := &validateUpcall{
+			Sender:     sender,
+			Expiration: deadline.UnixNano(),
+			Data:       msg.Data,
+			Seqno:      seqno,
+			Upcall:     "validate",
+			Idx:        validator.idx(),
+		}
+		if batcher != nil {
+			batcher.add(upcall)
+		} else {
+			app.writeMsg(upcall)
+		}
+
+		// Wait for the validation response, but be sure to honor any timeout/deadline in ctx
+		select {
+		case <-ctx.Done():
+			// XXX: do 🅽🅾🆃  delete app.Validators[seqno] here! the ocaml side doesn't
+			// care about the timeout and will validate it anyway.
+			// validationComplete will remove app.Validators[seqno] once the
+			// coda process gets around to it.
+			if res, ok := app.timeOutValidation(seqno, ch); ok {
+				return app.validationResult(res)
+			}
+			app.P2p.Logger.Error("validation timed out :(")
+			forget()
+			return app.timedOutResult()
+		case res := <-ch:
+			return app.validationResult(res)
+		}
+	}
+
+	// later subscriptions to the topic share the validator, options and all
+	if !shared {
+		if err := app.P2p.Pubsub.RegisterTopicValidator(s.Topic, validate, validatorOpts...); err != nil {
+			_ = app.leaveTopic(s.Topic)
+			return nil, badp2p(err)
+		}
+	}
+
+	sub, err := topic.Subscribe()
+	if err != nil {
+		if validator.remove(s.Subscription) {
+			_ = app.leaveTopic(s.Topic)
+		}
+		return nil, badp2p(err)
+	}
+
+	ctx, cancel := context.WithCancel(app.Ctx)
+	app.Subs[s.Subscription] = subscription{
+		Sub:    sub,
+		Idx:    s.Subscription,
+		Topic:  s.Topic,
+		Ctx:    ctx,
+		Cancel: cancel,
+	}
+	go func() {
+		for {
+			if _, err := sub.Next(ctx); err != nil {
+				if ctx.Err() != nil || err == pubsub.ErrSubscriptionCancelled {
+					return
+				}
+				app.P2p.Logger.Error("sub.Next failed: ", err)
+			}
+		}
+	}()
+	return "subscribe success", nil
+}
+
+// leaveTopic unregisters the validator of a topic with no subscriptions
+// left, and closes its handle, which publish joins again if needed.
+// app.SubsMutex must be held.
+func (app *app) leaveTopic(topic string) error {
+	delete(app.SubValidators, topic)
+	err := app.P2p.Pubsub.UnregisterTopicValidator(topic)
+	if t, has := app.Topics[topic]; has {
+		delete(app.Topics, topic)
+		if closeErr := t.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+type unsubscribeMsg struct {
+	Subscription int `json:"subscription_idx"`
+}
+
+func (u *unsubscribeMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	app.SubsMutex.Lock()
+	defer app.SubsMutex.Unlock()
+
+	sub, ok := app.Subs[u.Subscription]
+	if !ok {
+		return nil, wrapErrorWithCode(errors.New("subscription not found"), "internal RPC error", codanet.ErrCodeUnknownSubscription)
+	}
+	sub.Cancel()
+	sub.Sub.Cancel()
+	delete(app.Subs, u.Subscription)
+
+	if app.SubValidators[sub.Topic].remove(u.Subscription) {
+		if err := app.leaveTopic(sub.Topic); err != nil {
+			return nil, badp2p(err)
+		}
+	}
+	return "unsubscribe success", nil
 }
 
 type validateUpcall struct {
 	Sender     *codaPeerInfo `json:"sender"`
 	Expiration int64         `json:"expiration"`
-	Data       string        `json:"data"`
+	Data       []byte        `json:"data"`
 	Seqno      int           `json:"seqno"`
 	Upcall     string        `json:"upcall"`
 	Idx        int           `json:"subscription_idx"`
@@ -608,21 +1521,78 @@ type validationCompleteMsg struct {
 	Valid string `json:"is_valid"`
 }
 
-func (r *validationCompleteMsg) run(app *app) (interface{}, error) {
+func (r *validationCompleteMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
+	if app.completeValidation(r.Seqno, r.Valid) {
+		return "validationComplete success", nil
+	}
+	return nil, wrapErrorWithCode(errors.New("validation seqno unknown"), "internal RPC error", codanet.ErrCodeUnknownValidation)
+}
+
+// completeValidation hands the daemon's verdict on a message to the topic
+// validator waiting for it, returning false if seqno is unknown
+func (app *app) completeValidation(seqno int, valid string) bool {
 	app.ValidatorMutex.Lock()
 	defer app.ValidatorMutex.Unlock()
-	if st, ok := app.Validators[r.Seqno]; ok {
-		st.Completion <- r.Valid
+	if st, ok := app.Validators[seqno]; ok {
+		st.Completion <- valid
 		if st.TimedOutAt != nil {
-			app.P2p.Logger.Errorf("validation for item %d took %d seconds", r.Seqno, time.Now().Add(validationTimeout).Sub(*st.TimedOutAt))
+			app.P2p.Logger.Errorf("validation for item %d took %d seconds", seqno, time.Now().Add(st.Timeout).Sub(*st.TimedOutAt))
 		}
-		delete(app.Validators, r.Seqno)
-		return "validationComplete success", nil
+		delete(app.Validators, seqno)
+		return true
+	}
+	return false
+}
+
+// timeOutValidation marks the validation of seqno as timed out. If the
+// daemon's verdict came in just before, the validation is no longer pending
+// and the verdict is returned instead.
+func (app *app) timeOutValidation(seqno int, ch chan string) (string, bool) {
+	app.ValidatorMutex.Lock()
+	defer app.ValidatorMutex.Unlock()
+	if st, ok := app.Validators[seqno]; ok {
+		now := time.Now()
+		st.TimedOutAt = &now
+		return "", false
+	}
+	return <-ch, true
+}
+
+// timedOutResult is the verdict on a message the daemon didn't validate in
+// time. When peers are scored, a rejection counts against the sender, and a
+// slow daemon is no fault of theirs, so such a message is ignored instead.
+func (app *app) timedOutResult() pubsub.ValidationResult {
+	if app.UnsafeNoTrustIP {
+		app.P2p.Logger.Info("validated anyway!")
+		return pubsub.ValidationAccept
+	}
+	if config := app.config(); config != nil && config.PeerScore != nil {
+		app.P2p.Logger.Info("unvalidated, ignoring it so as not to score the sender down")
+		return pubsub.ValidationIgnore
+	}
+	app.P2p.Logger.Info("unvalidated :(")
+	return pubsub.ValidationReject
+}
+
+// validationResult turns the daemon's verdict into the one for pubsub
+func (app *app) validationResult(res string) pubsub.ValidationResult {
+	switch res {
+	case rejectResult:
+		app.P2p.Logger.Info("why u fail to validate :(")
+		return pubsub.ValidationReject
+	case acceptResult:
+		app.P2p.Logger.Info("validated!")
+		return pubsub.ValidationAccept
+	case ignoreResult:
+		app.P2p.Logger.Info("ignoring valid message!")
+		return pubsub.ValidationIgnore
+	default:
+		app.P2p.Logger.Info("ignoring message that falled off the end!")
+		return pubsub.ValidationIgnore
 	}
-	return nil, badRPC(errors.New("validation seqno unknown"))
 }
 
 type generateKeypairMsg struct {
@@ -634,19 +1604,19 @@ type generatedKeypair struct {
 	PeerID  string `json:"peer_id"`
 }
 
-func (*generateKeypairMsg) run(app *app) (interface{}, error) {
+func (*generateKeypairMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	privk, pubk, err := crypto.GenerateEd25519Key(cryptorand.Reader)
 	if err != nil {
 		return nil, badp2p(err)
 	}
 	privkBytes, err := crypto.MarshalPrivateKey(privk)
 	if err != nil {
-		return nil, badRPC(err)
+		return nil, internalError(err)
 	}
 
 	pubkBytes, err := crypto.MarshalPublicKey(pubk)
 	if err != nil {
-		return nil, badRPC(err)
+		return nil, internalError(err)
 	}
 
 	peerID, err := peer.IDFromPublicKey(pubk)
@@ -671,7 +1641,7 @@ type streamReadCompleteUpcall struct {
 type incomingMsgUpcall struct {
 	Upcall    string `json:"upcall"`
 	StreamIdx int    `json:"stream_idx"`
-	Data      string `json:"data"`
+	Data      []byte `json:"data"`
 }
 
 func handleStreamReads(app *app, stream net.Stream, idx int) {
@@ -685,9 +1655,9 @@ func handleStreamReads(app *app, stream net.Stream, idx int) {
 			len, err := stream.Read(buf)
 
 			if len != 0 {
-				app.writeMsg(incomingMsgUpcall{
+				app.writeMsg(&incomingMsgUpcall{
 					Upcall:    "incomingStreamMsg",
-					Data:      codaEncode(buf[:len]),
+					Data:      append([]byte(nil), buf[:len]...),
 					StreamIdx: idx,
 				})
 			}
@@ -722,7 +1692,7 @@ type openStreamResult struct {
 	Peer      codaPeerInfo `json:"peer"`
 }
 
-func (o *openStreamMsg) run(app *app) (interface{}, error) {
+func (o *openStreamMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
@@ -736,7 +1706,7 @@ func (o *openStreamMsg) run(app *app) (interface{}, error) {
 		return nil, badRPC(err)
 	}
 
-	ctx, cancel := context.WithTimeout(app.Ctx, 30*time.Second)
+	ctx, cancel := withDefaultTimeout(ctx, 30*time.Second)
 	defer cancel()
 
 	stream, err := app.P2p.Host.NewStream(ctx, peer, protocol.ID(o.ProtocolID))
@@ -766,7 +1736,7 @@ type closeStreamMsg struct {
 	StreamIdx int `json:"stream_idx"`
 }
 
-func (cs *closeStreamMsg) run(app *app) (interface{}, error) {
+func (cs *closeStreamMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
@@ -780,14 +1750,14 @@ func (cs *closeStreamMsg) run(app *app) (interface{}, error) {
 		}
 		return "closeStream success", nil
 	}
-	return nil, badRPC(errors.New("unknown stream_idx"))
+	return nil, unknownStream()
 }
 
 type resetStreamMsg struct {
 	StreamIdx int `json:"stream_idx"`
 }
 
-func (cs *resetStreamMsg) run(app *app) (interface{}, error) {
+func (cs *resetStreamMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
@@ -801,33 +1771,30 @@ func (cs *resetStreamMsg) run(app *app) (interface{}, error) {
 		}
 		return "resetStream success", nil
 	}
-	return nil, badRPC(errors.New("unknown stream_idx"))
+	return nil, unknownStream()
 }
 
 type sendStreamMsgMsg struct {
 	StreamIdx int    `json:"stream_idx"`
-	Data      string `json:"data"`
+	Data      []byte `json:"data"`
 }
 
-func (cs *sendStreamMsgMsg) run(app *app) (interface{}, error) {
-	if app.P2p == nil {
-		return nil, needsConfigure()
-	}
-	data, err := codaDecode(cs.Data)
-	if err != nil {
-		return nil, badRPC(err)
+func (cs *sendStreamMsgMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
 	}
+	data := cs.Data
 
 	app.StreamsMutex.Lock()
 	defer app.StreamsMutex.Unlock()
 	if stream, ok := app.Streams[cs.StreamIdx]; ok {
 		n, err := stream.Write(data)
 		if err != nil {
-			return nil, wrapError(badp2p(err), fmt.Sprintf("only wrote %d out of %d bytes", n, len(data)))
+			return nil, badp2p(fmt.Errorf("only wrote %d out of %d bytes: %w", n, len(data), err))
 		}
 		return "sendStreamMsg success", nil
 	}
-	return nil, badRPC(errors.New("unknown stream_idx"))
+	return nil, unknownStream()
 }
 
 type addStreamHandlerMsg struct {
@@ -841,7 +1808,7 @@ type incomingStreamUpcall struct {
 	Protocol  string       `json:"protocol"`
 }
 
-func (as *addStreamHandlerMsg) run(app *app) (interface{}, error) {
+func (as *addStreamHandlerMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
@@ -871,7 +1838,7 @@ type removeStreamHandlerMsg struct {
 	Protocol string `json:"protocol"`
 }
 
-func (rs *removeStreamHandlerMsg) run(app *app) (interface{}, error) {
+func (rs *removeStreamHandlerMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
@@ -898,18 +1865,23 @@ func addrInfoOfString(maddr string) (*peer.AddrInfo, error) {
 	return info, nil
 }
 
-func (ap *addPeerMsg) run(app *app) (interface{}, error) {
+func (ap *addPeerMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
 
 	info, err := addrInfoOfString(ap.Multiaddr)
 	if err != nil {
-		return nil, err
+		return nil, badRPC(err)
 	}
 
+	app.PeersMutex.Lock()
 	app.AddedPeers = append(app.AddedPeers, *info)
-	app.P2p.GatingState.TrustedPeers.Add(info.ID)
+	app.P2p.GatingState.TrustPeer(info.ID)
+	if ap.Seed {
+		app.P2p.Seeds = append(app.P2p.Seeds, *info)
+	}
+	app.PeersMutex.Unlock()
 
 	if app.Bootstrapper != nil {
 		app.Bootstrapper.Close()
@@ -917,11 +1889,7 @@ func (ap *addPeerMsg) run(app *app) (interface{}, error) {
 
 	app.P2p.Logger.Error("addPeer Trying to connect to: ", info)
 
-	if ap.Seed {
-		app.P2p.Seeds = append(app.P2p.Seeds, *info)
-	}
-
-	err = app.P2p.Host.Connect(app.Ctx, *info)
+	err = app.P2p.Host.Connect(ctx, *info)
 	if err != nil {
 		return nil, badp2p(err)
 	}
@@ -982,20 +1950,28 @@ func beginMDNS(app *app, foundPeerCh chan peerDiscovery) error {
 	return nil
 }
 
-func (ap *beginAdvertisingMsg) run(app *app) (interface{}, error) {
+func (ap *beginAdvertisingMsg) run(ctx context.Context, app *app) (interface{}, error) {
 	if app.P2p == nil {
 		return nil, needsConfigure()
 	}
 
-	for _, info := range app.AddedPeers {
+	for _, info := range app.addedPeers() {
 		app.P2p.Logger.Debug("Trying to connect to: ", info)
-		err := app.P2p.Host.Connect(app.Ctx, info)
+		err := app.P2p.Host.Connect(ctx, info)
 		if err != nil {
 			app.P2p.Logger.Error("failed to connect to peer: ", info, err.Error())
 			continue
 		}
 	}
 
+	// discovery outlives this call, so don't start it for a cancelled one
+	if err := ctx.Err(); err != nil {
+		return nil, badp2p(err)
+	}
+
+	advertiseCtx, stopAdvertising := context.WithCancel(app.Ctx)
+	app.StopAdvertising = stopAdvertising
+
 	foundPeerCh := make(chan peerDiscovery)
 
 	validPeer := func(who peer.ID) bool {
@@ -1018,7 +1994,7 @@ func (ap *beginAdvertisingMsg) run(app *app) (interface{}, error) {
 				// now connect to the peer we discovered
 				connInfo := app.P2p.ConnectionManager.GetInfo()
 				if connInfo.ConnCount < connInfo.LowWater {
-					err := app.P2p.Host.Connect(app.Ctx, discovery.info)
+					err := app.P2p.Host.Connect(advertiseCtx, discovery.info)
 					if err != nil {
 						app.P2p.Logger.Error("failed to connect to peer after discovering it: ", discovery.info, err.Error())
 						continue
@@ -1043,12 +2019,12 @@ func (ap *beginAdvertisingMsg) run(app *app) (interface{}, error) {
 		app.P2p.Logger.Infof("beginning DHT discovery")
 		routingDiscovery := discovery.NewRoutingDiscovery(app.P2p.Dht)
 		if routingDiscovery == nil {
-			return nil, errors.New("failed to create routing discovery")
+			return nil, internalError(errors.New("failed to create routing discovery"))
 		}
 
 		app.P2p.Discovery = routingDiscovery
 
-		err := app.P2p.Dht.Bootstrap(app.Ctx)
+		err := app.P2p.Dht.Bootstrap(advertiseCtx)
 		if err != nil {
 			app.P2p.Logger.Error("failed to dht bootstrap: ", err.Error())
 			return nil, badp2p(err)
@@ -1057,14 +2033,14 @@ func (ap *beginAdvertisingMsg) run(app *app) (interface{}, error) {
 		time.Sleep(time.Millisecond * 100)
 		app.P2p.Logger.Debugf("beginning DHT advertising")
 
-		_, err = routingDiscovery.Advertise(app.Ctx, app.P2p.Rendezvous)
+		_, err = routingDiscovery.Advertise(advertiseCtx, app.P2p.Rendezvous)
 		if err != nil {
 			app.P2p.Logger.Error("failed to routing advertise: ", err.Error())
 			return nil, badp2p(err)
 		}
 
 		go func() {
-			peerCh, err := routingDiscovery.FindPeers(app.Ctx, app.P2p.Rendezvous)
+			peerCh, err := routingDiscovery.FindPeers(advertiseCtx, app.P2p.Rendezvous)
 			if err != nil {
 				app.P2p.Logger.Error("error while trying to find some peers: ", err.Error())
 			}
@@ -1094,7 +2070,7 @@ func (ap *beginAdvertisingMsg) run(app *app) (interface{}, error) {
 		// go app.checkLatency(id)
 	}
 
-	app.P2p.ConnectionManager.OnDisconnect = func(net net.Network, c net.Conn) {
+	app.P2p.ConnectionManager.OnDisconnect = func(net net.Network, c net.Conn, reason string) {
 		app.updateConnectionMetrics()
 
 		id := c.RemotePeer()
@@ -1102,6 +2078,7 @@ func (ap *beginAdvertisingMsg) run(app *app) (interface{}, error) {
 		app.writeMsg(peerConnectionUpcall{
 			ID:     peer.Encode(id),
 			Upcall: "peerDisconnected",
+			Reason: reason,
 		})
 	}
 
@@ -1116,6 +2093,10 @@ const (
 func (app *app) updateConnectionMetrics() {
 	info := app.P2p.ConnectionManager.GetInfo()
 	connectionCountMetric.Set(float64(info.ConnCount))
+
+	inbound, outbound := codanet.ConnCounts(app.P2p.Host.Network())
+	inboundConnectionCountMetric.Set(float64(inbound))
+	outboundConnectionCountMetric.Set(float64(outbound))
 }
 
 func (a *app) checkBandwidth(id peer.ID) {
@@ -1196,224 +2177,718 @@ type findPeerMsg struct {
 	PeerID string `json:"peer_id"`
 }
 
-func (ap *findPeerMsg) run(app *app) (interface{}, error) {
-	id, err := peer.Decode(ap.PeerID)
-	if err != nil {
-		return nil, err
+func (ap *findPeerMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	id, err := peer.Decode(ap.PeerID)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+
+	maybePeer, err := findPeerInfo(app, id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return *maybePeer, nil
+}
+
+type setNodeStatusMsg struct {
+	Data string `json:"data"`
+}
+
+func (m *setNodeStatusMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	app.P2p.NodeStatus = m.Data
+	return "setNodeStatus success", nil
+}
+
+type getPeerNodeStatusMsg struct {
+	PeerMultiaddr string `json:"peer_multiaddr"`
+}
+
+func (m *getPeerNodeStatusMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	ctx, cancel := withDefaultTimeout(ctx, 400*time.Millisecond)
+	defer cancel()
+
+	addrInfo, err := addrInfoOfString(m.PeerMultiaddr)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+
+	app.P2p.Host.Peerstore().AddAddrs(addrInfo.ID, addrInfo.Addrs, peerstore.ConnectedAddrTTL)
+
+	// Open a "get node status" stream on m.PeerID,
+	// block until you can read the response, return that.
+	s, err := app.P2p.Host.NewStream(ctx, addrInfo.ID, codanet.NodeStatusProtocolID)
+	if err != nil {
+		app.P2p.Logger.Error("failed to open stream: ", err)
+		return nil, badp2p(err)
+	}
+
+	defer func() {
+		_ = s.Close()
+	}()
+
+	errCh := make(chan error)
+	responseCh := make(chan string)
+
+	go func() {
+		// 1 megabyte
+		size := 1048576
+
+		data := make([]byte, size)
+		n, err := s.Read(data)
+		if err != nil && err != io.EOF {
+			app.P2p.Logger.Errorf("failed to decode node status data: err=%s", err)
+			errCh <- err
+			return
+		}
+
+		if n == size && err == nil {
+			errCh <- fmt.Errorf("node status data was greater than %d bytes", size)
+			return
+		}
+
+		responseCh <- string(data[:n])
+	}()
+
+	select {
+	case <-ctx.Done():
+		s.Reset()
+		return nil, wrapErrorWithCode(errors.New("timed out requesting node status data from peer"), "libp2p error", codanet.ErrCodeTimeout)
+	case err := <-errCh:
+		return nil, badp2p(err)
+	case response := <-responseCh:
+		return response, nil
+	}
+}
+
+type listPeersMsg struct {
+}
+
+func (lp *listPeersMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	connsHere := app.P2p.Host.Network().Conns()
+
+	peerInfos := make([]codaPeerInfo, 0, len(connsHere))
+
+	for _, conn := range connsHere {
+		maybePeer, err := parseMultiaddrWithID(conn.RemoteMultiaddr(), conn.RemotePeer())
+		if err != nil {
+			app.P2p.Logger.Warning("skipping maddr ", conn.RemoteMultiaddr().String(), " because it failed to parse: ", err.Error())
+			continue
+		}
+		maybePeer.Direction = strings.ToLower(conn.Stat().Direction.String())
+		peerInfos = append(peerInfos, *maybePeer)
+	}
+
+	return peerInfos, nil
+}
+
+// parseIPNet parses either a single IPv4 or IPv6 address or a range of either
+// in CIDR notation
+func parseIPNet(ip string) (gonet.IPNet, error) {
+	if strings.Contains(ip, "/") {
+		_, parsed, err := gonet.ParseCIDR(ip)
+		if err != nil {
+			return gonet.IPNet{}, badRPC(err)
+		}
+		return *parsed, nil
+	}
+
+	realIP := gonet.ParseIP(ip)
+	if realIP == nil {
+		return gonet.IPNet{}, badRPC(fmt.Errorf("unparsable IP %q", ip))
+	}
+	if ip4 := realIP.To4(); ip4 != nil {
+		realIP = ip4
+	}
+
+	bits := len(realIP) * 8
+	return gonet.IPNet{IP: realIP, Mask: gonet.CIDRMask(bits, bits)}, nil
+}
+
+// filterIPString adds a filter for ip, as parsed by parseIPNet
+func filterIPString(filters *ma.Filters, ip string, action ma.Action) error {
+	ipnet, err := parseIPNet(ip)
+	if err != nil {
+		return err
+	}
+
+	filters.AddFilter(ipnet, action)
+
+	return nil
+}
+
+type setGatingConfigMsg struct {
+	BannedIPs      []string  `json:"banned_ips"`
+	BannedPeerIDs  []string  `json:"banned_peers"`
+	TrustedPeerIDs []string  `json:"trusted_peers"`
+	TrustedIPs     []string  `json:"trusted_ips"`
+	Isolate        bool      `json:"isolate"`
+	TimedBans      []banJson `json:"timed_bans"`
+	// connections negotiating a muxer or security protocol missing from
+	// these lists are dropped; empty lists allow any
+	AllowedMuxers   []string `json:"allowed_muxers"`
+	AllowedSecurity []string `json:"allowed_security"`
+	// 0 is no limit
+	MaxConnsPerIP int `json:"max_conns_per_ip"`
+	// caps on inbound connections from untrusted peers, per IP and per /24
+	// (/48 for IPv6); 0 is no limit
+	MaxInboundPerIP     int `json:"max_inbound_per_ip"`
+	MaxInboundPerSubnet int `json:"max_inbound_per_subnet"`
+}
+
+// banJson is an entry of the ban table, banning either a peer or an IP range.
+// Bans without an expiry last until the gating config is replaced.
+type banJson struct {
+	PeerID      string `json:"peer_id,omitempty"`
+	IP          string `json:"ip,omitempty"`
+	ExpiresAtMs int64  `json:"expires_at_ms,omitempty"`
+	RemainingMs int64  `json:"remaining_ms,omitempty"`
+	Reason      string `json:"reason,omitempty"`
+}
+
+func banToJson(ban codanet.Ban, now time.Time) banJson {
+	var entry banJson
+	if ban.IPNet != nil {
+		entry.IP = ban.IPNet.String()
+	} else {
+		entry.PeerID = peer.Encode(ban.Peer)
+	}
+	entry.Reason = ban.Reason
+	if !ban.Expires.IsZero() {
+		entry.ExpiresAtMs = ban.Expires.UnixNano() / int64(time.Millisecond)
+		if remaining := ban.Expires.Sub(now); remaining > 0 {
+			entry.RemainingMs = int64(remaining / time.Millisecond)
+		}
+	}
+	return entry
+}
+
+type banExpiredUpcall struct {
+	Upcall string `json:"upcall"`
+	PeerID string `json:"peer_id,omitempty"`
+	IP     string `json:"ip,omitempty"`
+}
+
+func gatingConfigFromJson(gc *setGatingConfigMsg, addedPeers []peer.AddrInfo) (*codanet.CodaGatingState, error) {
+	var totalIpNets []gonet.IPNet
+	for _, cidr := range []string{"0.0.0.0/0", "::/0"} {
+		_, totalIpNet, err := gonet.ParseCIDR(cidr)
+		if err != nil {
+			return nil, internalError(err)
+		}
+		totalIpNets = append(totalIpNets, *totalIpNet)
+	}
+
+	// TODO: perhaps the isolate option should just be passed down to the gating state instead
+	bannedAddrFilters := ma.NewFilters()
+	if gc.Isolate {
+		for _, totalIpNet := range totalIpNets {
+			bannedAddrFilters.AddFilter(totalIpNet, ma.ActionDeny)
+		}
+	}
+	for _, ip := range gc.BannedIPs {
+		err := filterIPString(bannedAddrFilters, ip, ma.ActionDeny)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	trustedAddrFilters := ma.NewFilters()
+	for _, totalIpNet := range totalIpNets {
+		trustedAddrFilters.AddFilter(totalIpNet, ma.ActionDeny)
+	}
+	for _, ip := range gc.TrustedIPs {
+		err := filterIPString(trustedAddrFilters, ip, ma.ActionAccept)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	bannedPeers := peer.NewSet()
+	for _, peerID := range gc.BannedPeerIDs {
+		id, err := peer.Decode(peerID)
+		if err != nil {
+			return nil, err
+		}
+		bannedPeers.Add(id)
+	}
+
+	trustedPeers := peer.NewSet()
+	for _, peerID := range gc.TrustedPeerIDs {
+		id, err := peer.Decode(peerID)
+		if err != nil {
+			return nil, err
+		}
+		trustedPeers.Add(id)
+	}
+	for _, peer := range addedPeers {
+		trustedPeers.Add(peer.ID)
+	}
+
+	state := codanet.NewCodaGatingState(bannedAddrFilters, trustedAddrFilters, bannedPeers, trustedPeers)
+
+	for _, ban := range gc.TimedBans {
+		if ban.ExpiresAtMs <= 0 {
+			return nil, badRPC(errors.New("timed ban without expires_at_ms"))
+		}
+		expires := time.Unix(0, ban.ExpiresAtMs*int64(time.Millisecond))
+
+		switch {
+		case ban.PeerID != "" && ban.IP == "":
+			id, err := peer.Decode(ban.PeerID)
+			if err != nil {
+				return nil, err
+			}
+			state.BanPeerUntil(id, expires, ban.Reason)
+		case ban.IP != "" && ban.PeerID == "":
+			ipnet, err := parseIPNet(ban.IP)
+			if err != nil {
+				return nil, err
+			}
+			state.BanIPNetUntil(ipnet, expires, ban.Reason)
+		default:
+			return nil, badRPC(errors.New("timed ban must have exactly one of peer_id and ip"))
+		}
+	}
+
+	if gc.MaxConnsPerIP < 0 || gc.MaxInboundPerIP < 0 || gc.MaxInboundPerSubnet < 0 {
+		return nil, badRPC(errors.New("connection limits must not be negative"))
+	}
+	state.UpgradePolicy = codanet.UpgradePolicy{
+		AllowedMuxers:   gc.AllowedMuxers,
+		AllowedSecurity: gc.AllowedSecurity,
+		MaxConnsPerIP:   gc.MaxConnsPerIP,
+	}
+	state.InboundLimits = codanet.InboundLimits{
+		PerIP:     gc.MaxInboundPerIP,
+		PerSubnet: gc.MaxInboundPerSubnet,
+	}
+
+	return state, nil
+}
+
+func (gc *setGatingConfigMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	// the peers added in the meantime would be left out of the new state
+	app.PeersMutex.Lock()
+	defer app.PeersMutex.Unlock()
+
+	newState, err := gatingConfigFromJson(gc, app.AddedPeers)
+	if err != nil {
+		return nil, badRPC(err)
+	}
+
+	if err := app.P2p.UpdateGatingState(newState); err != nil {
+		return nil, internalError(err)
+	}
+	app.GatingConfig = gc
+
+	return "ok", nil
+}
+
+func (app *app) banExpired(ban codanet.Ban) {
+	if !app.handles(upcallBanExpired) {
+		return
+	}
+	entry := banToJson(ban, time.Now())
+	app.writeMsg(banExpiredUpcall{Upcall: upcallBanExpired, PeerID: entry.PeerID, IP: entry.IP})
+}
+
+// upgradeRejected tells the daemon about a connection the upgrade policy
+// rejected, if it knows the peer as connected and the peer has no other
+// connection left. The connection itself was never reported as connected, as
+// libp2p drops it before it is added to the host, so a peer the daemon
+// doesn't know of is left at the gating events.
+func (app *app) upgradeRejected(c net.Conn, reason control.DisconnectReason) {
+	if app.P2p == nil || len(app.P2p.Host.Network().ConnsToPeer(c.RemotePeer())) > 0 {
+		return
+	}
+	// the connections the daemon knows of are gone, and mustn't be reported
+	// as disconnected again
+	if !app.P2p.ConnectionManager.ForgetReported(c.RemotePeer()) {
+		return
+	}
+	app.writeMsg(peerConnectionUpcall{
+		ID:     peer.Encode(c.RemotePeer()),
+		Upcall: "peerDisconnected",
+		Reason: string(codanet.DisconnectReasonRule(reason)),
+	})
+}
+
+type listBansMsg struct {
+}
+
+func (lb *listBansMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+
+	now := time.Now()
+	bans := app.P2p.GatingState.Bans()
+	result := make([]banJson, 0, len(bans))
+	for _, ban := range bans {
+		result = append(result, banToJson(ban, now))
+	}
+
+	return result, nil
+}
+
+type getGatingEventsMsg struct {
+	// only return this many of the latest events, if positive
+	Limit int `json:"limit"`
+}
+
+type gatingEventJson struct {
+	TimeMs  int64  `json:"time_ms"`
+	Stage   string `json:"stage"`
+	PeerID  string `json:"peer_id,omitempty"`
+	Addr    string `json:"addr,omitempty"`
+	Allowed bool   `json:"allowed"`
+	Rule    string `json:"rule"`
+}
+
+func (ge *getGatingEventsMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
 	}
 
-	maybePeer, err := findPeerInfo(app, id)
+	events := app.P2p.GatingState.Events()
+	if ge.Limit > 0 && len(events) > ge.Limit {
+		events = events[len(events)-ge.Limit:]
+	}
 
-	if err != nil {
-		return nil, err
+	result := make([]gatingEventJson, 0, len(events))
+	for _, event := range events {
+		entry := gatingEventJson{
+			TimeMs:  event.Time.UnixNano() / int64(time.Millisecond),
+			Stage:   string(event.Stage),
+			Allowed: event.Allowed,
+			Rule:    string(event.Rule),
+		}
+		if event.Peer != "" {
+			entry.PeerID = peer.Encode(event.Peer)
+		}
+		if event.Addr != nil {
+			entry.Addr = event.Addr.String()
+		}
+		result = append(result, entry)
 	}
 
-	return *maybePeer, nil
+	return result, nil
 }
 
-type setNodeStatusMsg struct {
-	Data string `json:"data"`
-}
+// protocolVersion must be bumped whenever the meaning of an existing method,
+// result or upcall changes. Adding methods or upcalls does not need a bump:
+// the daemon and the helper exchange the names they support in hello.
+//
+// Version 2: error results carry a code, configure can't be repeated, a
+// subscription_idx can't be reused, and with peer scoring on, a validation
+// the daemon doesn't complete in time is ignored rather than rejected.
+const protocolVersion = 2
 
-func (m *setNodeStatusMsg) run(app *app) (interface{}, error) {
-	app.P2p.NodeStatus = m.Data
-	return "setNodeStatus success", nil
+// requiredUpcalls are the upcalls the helper may send whatever the daemon
+// calls, so the daemon has to handle all of them
+var requiredUpcalls = []string{
+	"validate",
+	"incomingStream",
+	"incomingStreamMsg",
+	"streamLost",
+	"streamReadComplete",
+	"peerConnected",
+	"peerDisconnected",
 }
 
-type getPeerNodeStatusMsg struct {
-	PeerMultiaddr string `json:"peer_multiaddr"`
-}
+// Optional upcalls are only sent to a daemon that handles them: the calls
+// that lead to validateBatch and shutdown are refused otherwise, and
+// banExpired, which is merely informative, is left out.
+const (
+	upcallValidateBatch = "validateBatch"
+	upcallShutdown      = "shutdown"
+	upcallBanExpired    = "banExpired"
+)
 
-func (m *getPeerNodeStatusMsg) run(app *app) (interface{}, error) {
-	ctx, _ := context.WithTimeout(app.Ctx, 400*time.Millisecond)
+// upcallNames lists every upcall the helper may send
+func upcallNames() []string {
+	return append(append([]string(nil), requiredUpcalls...), upcallValidateBatch, upcallShutdown, upcallBanExpired)
+}
 
-	addrInfo, err := addrInfoOfString(m.PeerMultiaddr)
-	if err != nil {
-		return nil, err
-	}
+// handles reports whether the daemon said in hello that it handles upcall
+func (app *app) handles(upcall string) bool {
+	app.UpcallsMutex.Lock()
+	defer app.UpcallsMutex.Unlock()
 
-	app.P2p.Host.Peerstore().AddAddrs(addrInfo.ID, addrInfo.Addrs, peerstore.ConnectedAddrTTL)
+	return app.Upcalls[upcall]
+}
 
-	// Open a "get node status" stream on m.PeerID,
-	// block until you can read the response, return that.
-	s, err := app.P2p.Host.NewStream(ctx, addrInfo.ID, codanet.NodeStatusProtocolID)
-	if err != nil {
-		app.P2p.Logger.Error("failed to open stream: ", err)
-		return nil, err
-	}
+// helloMsg must be the first call the daemon makes; every other method is
+// refused until the helper accepted it.
+type helloMsg struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Methods         []string `json:"methods"`
+	Upcalls         []string `json:"upcalls"`
+}
 
-	defer func() {
-		_ = s.Close()
-	}()
+type helloResult struct {
+	ProtocolVersion int      `json:"protocol_version"`
+	Methods         []string `json:"methods"`
+	Upcalls         []string `json:"upcalls"`
+}
 
-	errCh := make(chan error)
-	responseCh := make(chan string)
+func supportedMethods() []string {
+	methods := make([]string, 0, len(_methodIdxNameToValue))
+	for name := range _methodIdxNameToValue {
+		methods = append(methods, name)
+	}
+	sort.Strings(methods)
+	return methods
+}
 
-	go func() {
-		// 1 megabyte
-		size := 1048576
+func (m *helloMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if m.ProtocolVersion != protocolVersion {
+		return nil, wrapErrorWithCode(fmt.Errorf("daemon speaks protocol version %d but the helper speaks protocol version %d", m.ProtocolVersion, protocolVersion), "internal RPC error", codanet.ErrCodeVersionMismatch)
+	}
 
-		data := make([]byte, size)
-		n, err := s.Read(data)
-		if err != nil && err != io.EOF {
-			app.P2p.Logger.Errorf("failed to decode node status data: err=%s", err)
-			errCh <- err
-			return
+	unsupported := []string{}
+	for _, name := range m.Methods {
+		if _, ok := _methodIdxNameToValue[name]; !ok {
+			unsupported = append(unsupported, name)
 		}
+	}
+	if len(unsupported) > 0 {
+		return nil, wrapErrorWithCode(fmt.Errorf("daemon requires methods the helper does not support: %v", unsupported), "internal RPC error", codanet.ErrCodeUnknownMethod)
+	}
 
-		if n == size && err == nil {
-			errCh <- fmt.Errorf("node status data was greater than %d bytes", size)
-			return
+	upcalls := make(map[string]bool, len(m.Upcalls))
+	for _, name := range m.Upcalls {
+		upcalls[name] = true
+	}
+	unhandled := []string{}
+	for _, name := range requiredUpcalls {
+		if !upcalls[name] {
+			unhandled = append(unhandled, name)
 		}
+	}
+	if len(unhandled) > 0 {
+		return nil, wrapErrorWithCode(fmt.Errorf("daemon does not handle upcalls the helper sends: %v", unhandled), "internal RPC error", codanet.ErrCodeUnknownMethod)
+	}
 
-		responseCh <- string(data[:n])
-	}()
+	app.UpcallsMutex.Lock()
+	app.Upcalls = upcalls
+	app.UpcallsMutex.Unlock()
 
-	select {
-	case <-ctx.Done():
-		s.Reset()
-		return nil, errors.New("timed out requesting node status data from peer")
-	case err := <-errCh:
-		return nil, err
-	case response := <-responseCh:
-		return response, nil
-	}
+	return helloResult{
+		ProtocolVersion: protocolVersion,
+		Methods:         supportedMethods(),
+		Upcalls:         upcallNames(),
+	}, nil
 }
 
-type listPeersMsg struct {
+type cancelRequestMsg struct {
+	Seqno int `json:"seqno"`
 }
 
-func (lp *listPeersMsg) run(app *app) (interface{}, error) {
-	if app.P2p == nil {
-		return nil, needsConfigure()
+// cancelRequest cancels the context of a pending call. The call then replies
+// with an error coded "cancelled", unless it already got far enough to
+// succeed anyway, in which case it replies with its result as usual.
+func (m *cancelRequestMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	app.PendingMutex.Lock()
+	req, ok := app.Pending[m.Seqno]
+	app.PendingMutex.Unlock()
+
+	if !ok {
+		return nil, wrapErrorWithCode(fmt.Errorf("no pending request with seqno %d", m.Seqno), "internal RPC error", codanet.ErrCodeUnknownRequest)
 	}
 
-	connsHere := app.P2p.Host.Network().Conns()
+	req.cancel()
+	return "cancelRequest success", nil
+}
 
-	peerInfos := make([]codaPeerInfo, 0, len(connsHere))
+// beginRequest registers a pending call, returning its context and a function
+// to unregister it once it's done
+func (app *app) beginRequest(seqno int, timeout time.Duration) (context.Context, func()) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+	if timeout > 0 {
+		ctx, cancel = context.WithTimeout(app.Ctx, timeout)
+	} else {
+		ctx, cancel = context.WithCancel(app.Ctx)
+	}
+	req := &pendingRequest{cancel: cancel}
 
-	for _, conn := range connsHere {
-		maybePeer, err := parseMultiaddrWithID(conn.RemoteMultiaddr(), conn.RemotePeer())
-		if err != nil {
-			app.P2p.Logger.Warning("skipping maddr ", conn.RemoteMultiaddr().String(), " because it failed to parse: ", err.Error())
-			continue
+	app.PendingMutex.Lock()
+	app.Pending[seqno] = req
+	app.PendingMutex.Unlock()
+
+	return ctx, func() {
+		app.PendingMutex.Lock()
+		if app.Pending[seqno] == req {
+			delete(app.Pending, seqno)
 		}
-		peerInfos = append(peerInfos, *maybePeer)
+		app.PendingMutex.Unlock()
+		cancel()
 	}
-
-	return peerInfos, nil
 }
 
-func filterIPString(filters *ma.Filters, ip string, action ma.Action) error {
-	realIP := gonet.ParseIP(ip).To4()
+type shutdownMsg struct {
+}
 
-	if realIP == nil {
-		// TODO: how to compute mask for IPv6?
-		return badRPC(errors.New("unparsable IP or IPv6"))
-	}
+type shutdownUpcall struct {
+	Upcall string `json:"upcall"`
+}
 
-	ipnet := gonet.IPNet{Mask: gonet.IPv4Mask(255, 255, 255, 255), IP: realIP}
+// finisher is implemented by calls with something left to do once their
+// result is queued
+type finisher interface {
+	finish(app *app)
+}
 
-	filters.AddFilter(ipnet, action)
+func (m *shutdownMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if !app.handles(upcallShutdown) {
+		return nil, badRequest(fmt.Errorf("shutdown ends with the %s upcall, which the daemon doesn't handle", upcallShutdown))
+	}
 
-	return nil
+	if err := app.shutdown(); err != nil {
+		// there is nothing the daemon could do about it
+		helperLog.Errorf("shutting down: %s", err)
+	}
+	return "shutdown success", nil
 }
 
-type setGatingConfigMsg struct {
-	BannedIPs      []string `json:"banned_ips"`
-	BannedPeerIDs  []string `json:"banned_peers"`
-	TrustedPeerIDs []string `json:"trusted_peers"`
-	TrustedIPs     []string `json:"trusted_ips"`
-	Isolate        bool     `json:"isolate"`
+// finish sends the final upcall, after which the helper exits (see
+// exitAfterShutdown)
+func (m *shutdownMsg) finish(app *app) {
+	app.writeMsg(shutdownUpcall{Upcall: upcallShutdown})
 }
 
-func gatingConfigFromJson(gc *setGatingConfigMsg, addedPeers []peer.AddrInfo) (*codanet.CodaGatingState, error) {
-	_, totalIpNet, err := gonet.ParseCIDR("0.0.0.0/0")
-	if err != nil {
-		return nil, err
+// shutdown tears everything down in order, so that the helper can exit
+// without leaving the peerstore in an unclean state
+func (app *app) shutdown() error {
+	if app.StopAdvertising != nil {
+		app.StopAdvertising()
 	}
 
-	// TODO: perhaps the isolate option should just be passed down to the gating state instead
-	bannedAddrFilters := ma.NewFilters()
-	if gc.Isolate {
-		bannedAddrFilters.AddFilter(*totalIpNet, ma.ActionDeny)
+	var err error
+	app.SubsMutex.Lock()
+	for idx, sub := range app.Subs {
+		sub.Cancel()
+		sub.Sub.Cancel()
+		delete(app.Subs, idx)
 	}
-	for _, ip := range gc.BannedIPs {
-		err := filterIPString(bannedAddrFilters, ip, ma.ActionDeny)
-		if err != nil {
-			return nil, err
+	for topic := range app.SubValidators {
+		if leaveErr := app.leaveTopic(topic); err == nil && leaveErr != nil {
+			err = fmt.Errorf("leaving topic %s: %w", topic, leaveErr)
 		}
 	}
-
-	trustedAddrFilters := ma.NewFilters()
-	trustedAddrFilters.AddFilter(*totalIpNet, ma.ActionDeny)
-	for _, ip := range gc.TrustedIPs {
-		err := filterIPString(trustedAddrFilters, ip, ma.ActionAccept)
-		if err != nil {
-			return nil, err
+	// what's left was only joined to publish
+	for topic, t := range app.Topics {
+		delete(app.Topics, topic)
+		if closeErr := t.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("closing topic %s: %w", topic, closeErr)
 		}
 	}
+	app.SubsMutex.Unlock()
 
-	bannedPeers := peer.NewSet()
-	for _, peerID := range gc.BannedPeerIDs {
-		id := peer.ID(peerID)
-		bannedPeers.Add(id)
+	app.StreamsMutex.Lock()
+	for idx, stream := range app.Streams {
+		_ = stream.Reset()
+		delete(app.Streams, idx)
 	}
+	app.StreamsMutex.Unlock()
 
-	trustedPeers := peer.NewSet()
-	for _, peerID := range gc.TrustedPeerIDs {
-		id := peer.ID(peerID)
-		trustedPeers.Add(id)
+	if app.P2p != nil {
+		if closeErr := app.P2p.Close(); err == nil {
+			err = closeErr
+		}
 	}
-	for _, peer := range addedPeers {
-		trustedPeers.Add(peer.ID)
+
+	if metricsServer != nil {
+		metricsServer.Shutdown()
+		metricsServer = nil
 	}
 
-	return codanet.NewCodaGatingState(bannedAddrFilters, trustedAddrFilters, bannedPeers, trustedPeers), nil
+	return err
 }
 
-func (gc *setGatingConfigMsg) run(app *app) (interface{}, error) {
-	if app.P2p == nil {
-		return nil, needsConfigure()
+// exitAfterShutdown exits once the final upcall of a shutdown is written,
+// after writing whatever is still queued behind it
+func exitAfterShutdown(app *app, msg interface{}, write func(msg interface{})) {
+	if _, ok := msg.(shutdownUpcall); !ok {
+		return
 	}
-
-	newState, err := gatingConfigFromJson(gc, app.AddedPeers)
-	if err != nil {
-		return nil, badRPC(err)
+	for _, msg := range app.OutQueue.drain() {
+		write(msg)
 	}
+	helperLog.Info("shut down cleanly")
+	os.Exit(0)
+}
 
-	app.P2p.GatingState = newState
-
-	return "ok", nil
+func needsHello(method methodIdx) error {
+	return badRPC(fmt.Errorf("refusing %s: hello must be the first call", _methodIdxValueToName[method]))
 }
 
 var msgHandlers = map[methodIdx]func() action{
-	configure:            func() action { return &configureMsg{} },
-	listen:               func() action { return &listenMsg{} },
-	publish:              func() action { return &publishMsg{} },
-	subscribe:            func() action { return &subscribeMsg{} },
-	unsubscribe:          func() action { return &unsubscribeMsg{} },
-	validationComplete:   func() action { return &validationCompleteMsg{} },
-	generateKeypair:      func() action { return &generateKeypairMsg{} },
-	openStream:           func() action { return &openStreamMsg{} },
-	closeStream:          func() action { return &closeStreamMsg{} },
-	resetStream:          func() action { return &resetStreamMsg{} },
-	sendStreamMsg:        func() action { return &sendStreamMsgMsg{} },
-	removeStreamHandler:  func() action { return &removeStreamHandlerMsg{} },
-	addStreamHandler:     func() action { return &addStreamHandlerMsg{} },
-	listeningAddrs:       func() action { return &listeningAddrsMsg{} },
-	addPeer:              func() action { return &addPeerMsg{} },
-	beginAdvertising:     func() action { return &beginAdvertisingMsg{} },
-	findPeer:             func() action { return &findPeerMsg{} },
-	listPeers:            func() action { return &listPeersMsg{} },
-	setGatingConfig:      func() action { return &setGatingConfigMsg{} },
-	setNodeStatus:        func() action { return &setNodeStatusMsg{} },
-	getPeerNodeStatus:    func() action { return &getPeerNodeStatusMsg{} },
+	configure:                  func() action { return &configureMsg{} },
+	listen:                     func() action { return &listenMsg{} },
+	publish:                    func() action { return &publishMsg{} },
+	subscribe:                  func() action { return &subscribeMsg{} },
+	unsubscribe:                func() action { return &unsubscribeMsg{} },
+	validationComplete:         func() action { return &validationCompleteMsg{} },
+	generateKeypair:            func() action { return &generateKeypairMsg{} },
+	openStream:                 func() action { return &openStreamMsg{} },
+	closeStream:                func() action { return &closeStreamMsg{} },
+	resetStream:                func() action { return &resetStreamMsg{} },
+	sendStreamMsg:              func() action { return &sendStreamMsgMsg{} },
+	removeStreamHandler:        func() action { return &removeStreamHandlerMsg{} },
+	addStreamHandler:           func() action { return &addStreamHandlerMsg{} },
+	listeningAddrs:             func() action { return &listeningAddrsMsg{} },
+	addPeer:                    func() action { return &addPeerMsg{} },
+	beginAdvertising:           func() action { return &beginAdvertisingMsg{} },
+	findPeer:                   func() action { return &findPeerMsg{} },
+	listPeers:                  func() action { return &listPeersMsg{} },
+	setGatingConfig:            func() action { return &setGatingConfigMsg{} },
+	setNodeStatus:              func() action { return &setNodeStatusMsg{} },
+	getPeerNodeStatus:          func() action { return &getPeerNodeStatusMsg{} },
+	hello:                      func() action { return &helloMsg{} },
+	cancelRequest:              func() action { return &cancelRequestMsg{} },
+	shutdown:                   func() action { return &shutdownMsg{} },
+	reconfigure:                func() action { return &reconfigureMsg{} },
+	listBans:                   func() action { return &listBansMsg{} },
+	getGatingEvents:            func() action { return &getGatingEventsMsg{} },
+	getConnectionManagerStatus: func() action { return &getConnectionManagerStatusMsg{} },
+	getPeerScores:              func() action { return &getPeerScoresMsg{} },
+	validationCompleteBatch:    func() action { return &validationCompleteBatchMsg{} },
+	protectPeer:                func() action { return &protectPeerMsg{} },
+	unprotectPeer:              func() action { return &unprotectPeerMsg{} },
+	tagPeer:                    func() action { return &tagPeerMsg{} },
+	untagPeer:                  func() action { return &untagPeerMsg{} },
+	registerDecayingTag:        func() action { return &registerDecayingTagMsg{} },
+	bumpDecayingTag:            func() action { return &bumpDecayingTagMsg{} },
 }
 
 type errorResult struct {
-	Seqno  int    `json:"seqno"`
-	Errorr string `json:"error"`
+	Seqno  int               `json:"seqno"`
+	Errorr string            `json:"error"`
+	Code   codanet.ErrorCode `json:"code,omitempty"`
+}
+
+func newErrorResult(seqno int, err error) errorResult {
+	return errorResult{Seqno: seqno, Errorr: err.Error(), Code: codeOf(err)}
 }
 
 type successResult struct {
@@ -1427,28 +2902,198 @@ var connectionCountMetric = prometheus.NewGauge(prometheus.GaugeOpts{
 	Help: "Number of active connections, according to the CodaConnectionManager.",
 })
 
+var inboundConnectionCountMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "inbound_connection_count",
+	Help: "Number of open connections that peers made to us.",
+})
+
+var outboundConnectionCountMetric = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "outbound_connection_count",
+	Help: "Number of open connections that we made to peers.",
+})
+
 func init() {
 	// === Register metrics collectors here ===
 	prometheus.MustRegister(connectionCountMetric)
+	prometheus.MustRegister(inboundConnectionCountMetric)
+	prometheus.MustRegister(outboundConnectionCountMetric)
+	prometheus.MustRegister(seenCacheHitsMetric)
 	http.Handle("/metrics", promhttp.Handler())
 }
 
+// serve reads and dispatches requests until the daemon closes its end,
+// returning the read error, if any
+func serve(app *app, requests requestReader) error {
+	var line string
+	greeted := false
+
+	defer func() {
+		if r := recover(); r != nil {
+			helperLog.Error("While handling RPC:", line, "\nThe following panic occurred: ", r, "\nstack:\n", string(debug.Stack()))
+		}
+	}()
+
+	for {
+		req, err := requests.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = string(req.Header)
+		helperLog.Debugf("message size is %d", len(req.Header)+len(req.Blobs))
+		env, msg, err := parseRequest(req)
+		if err != nil {
+			helperLog.Errorf("refusing request (seqno %d): %s", env.Seqno, err)
+			app.writeMsg(newErrorResult(env.Seqno, err))
+			continue
+		}
+
+		// hello is handled synchronously so that its outcome is known before
+		// the next call is read
+		if env.Method == hello {
+			if handleRequest(app, env, msg) {
+				greeted = true
+			}
+			continue
+		}
+
+		if !greeted {
+			app.writeMsg(newErrorResult(env.Seqno, needsHello(env.Method)))
+			continue
+		}
+
+		go handleRequest(app, env, msg)
+	}
+}
+
+// handleRequest runs msg and writes its result, reporting whether it succeeded
+func handleRequest(app *app, env envelope, msg action) (ok bool) {
+	seqno := env.Seqno
+
+	defer func() {
+		if r := recover(); r != nil {
+			helperLog.Error("While running RPC ", seqno, "\nThe following panic occurred: ", r, "\nstack:\n", string(debug.Stack()))
+			app.writeResult(msg, newErrorResult(seqno, wrapErrorWithCode(fmt.Errorf("%v", r), "helper panic", codanet.ErrCodeInternal)))
+			ok = false
+		}
+	}()
+
+	ctx, done := app.beginRequest(seqno, env.timeout())
+	defer done()
+
+	start := time.Now()
+	ret, err := msg.run(ctx, app)
+	if err != nil {
+		if ctx.Err() == context.Canceled && app.Ctx.Err() == nil {
+			err = wrapErrorWithCode(err, "request cancelled", codanet.ErrCodeCancelled)
+		} else if ctx.Err() == context.DeadlineExceeded {
+			err = wrapErrorWithCode(err, "request deadline exceeded", codanet.ErrCodeTimeout)
+		}
+		app.writeResult(msg, newErrorResult(seqno, err))
+		return false
+	}
+
+	res, err := json.Marshal(ret)
+	if err != nil {
+		app.writeResult(msg, newErrorResult(seqno, wrapErrorWithCode(err, "encoding result", codanet.ErrCodeInternal)))
+		return false
+	}
+
+	app.writeResult(msg, successResult{Seqno: seqno, Success: res, Duration: time.Since(start).String()})
+	if f, ok := msg.(finisher); ok {
+		f.finish(app)
+	}
+	return true
+}
+
+// rawEnvelope is what the helper actually decodes an envelope into, so that
+// the seqno of a call with an unknown method can still be reported back
+type rawEnvelope struct {
+	Method     string          `json:"method"`
+	Seqno      int             `json:"seqno"`
+	Body       json.RawMessage `json:"body"`
+	DeadlineMs int             `json:"deadline_ms"`
+}
+
+// parseRequest decodes the envelope and method invocation of a request read
+// off the wire in either wire mode. On error, the returned envelope carries
+// the seqno of the request if it could be recovered, and 0 otherwise.
+func parseRequest(req *request) (envelope, action, error) {
+	var raw rawEnvelope
+	if err := json.Unmarshal(req.Header, &raw); err != nil {
+		// try to salvage the seqno, e.g. if only the body is mistyped
+		var seqno struct {
+			Seqno int `json:"seqno"`
+		}
+		_ = json.Unmarshal(req.Header, &seqno)
+		return envelope{Seqno: seqno.Seqno}, nil, badRequest(fmt.Errorf("when unmarshaling the envelope: %w", err))
+	}
+
+	env := envelope{Seqno: raw.Seqno, Body: raw.Body}
+	if raw.DeadlineMs < 0 {
+		return env, nil, badRequest(fmt.Errorf("negative deadline_ms %d", raw.DeadlineMs))
+	}
+	env.DeadlineMs = raw.DeadlineMs
+	method, ok := _methodIdxNameToValue[raw.Method]
+	if !ok {
+		return env, nil, wrapErrorWithCode(fmt.Errorf("unknown method %q", raw.Method), "malformed request", codanet.ErrCodeUnknownMethod)
+	}
+	env.Method = method
+
+	newMsg, ok := msgHandlers[method]
+	if !ok {
+		return env, nil, wrapErrorWithCode(fmt.Errorf("no handler for method %q", raw.Method), "malformed request", codanet.ErrCodeUnknownMethod)
+	}
+	msg := newMsg()
+	if len(raw.Body) == 0 {
+		return env, nil, badRequest(errors.New("missing body"))
+	}
+	if err := json.Unmarshal(raw.Body, msg); err != nil {
+		return env, nil, badRequest(fmt.Errorf("when unmarshaling the method invocation: %w", err))
+	}
+	if err := putBlobs(msg, req.Blobs); err != nil {
+		return env, nil, badRequest(err)
+	}
+	return env, msg, nil
+}
+
+// dropStream resets a stream the helper gave up on delivering to the daemon
+func (app *app) dropStream(idx int) {
+	app.StreamsMutex.Lock()
+	stream, ok := app.Streams[idx]
+	delete(app.Streams, idx)
+	app.StreamsMutex.Unlock()
+
+	if ok {
+		_ = stream.Reset()
+	}
+}
+
 func newApp() *app {
-	return &app{
+	app := &app{
 		P2p:            nil,
 		Ctx:            context.Background(),
 		Subs:           make(map[int]subscription),
 		Topics:         make(map[string]*pubsub.Topic),
+		SubValidators:  make(map[string]*topicValidator),
 		ValidatorMutex: &sync.Mutex{},
 		Validators:     make(map[int]*validationStatus),
 		Streams:        make(map[int]net.Stream),
-		OutChan:        make(chan interface{}, 4096),
+		Pending:        make(map[int]*pendingRequest),
+		OutQueue:       newOutQueue(defaultOutQueueSize, overflowBlock),
 		Out:            bufio.NewWriter(os.Stdout),
 		AddedPeers:     []peer.AddrInfo{},
 	}
+	app.OutQueue.onStreamDropped = app.dropStream
+	return app
 }
 
 func main() {
+	control := flag.String("control", "", "serve the daemon on unix:<path> or tcp:<loopback host>:<port> instead of stdin/stdout")
+	flag.Parse()
+
 	logging.SetupLogging(logging.Config{
 		Format: logging.JSONOutput,
 		Stderr: true,
@@ -1456,8 +3101,6 @@ func main() {
 		Level:  logging.LevelDebug,
 		File:   "",
 	})
-	helperLog := logging.Logger("helper top-level JSON handling")
-
 	helperLog.Infof("libp2p_helper has the following logging subsystems active: %v", logging.GetSubsystems())
 
 	// === Set subsystem log levels ===
@@ -1511,88 +3154,49 @@ func main() {
 		}
 	}()
 
-	lines := bufio.NewScanner(os.Stdin)
-	// 22MiB buffer size, larger than the 21.33MB minimum for 16MiB to be b64'd
-	// 4 * (2^24/3) / 2^20 = 21.33
-	bufsize := (1024 * 1024) * 1024
-	lines.Buffer(make([]byte, bufsize), bufsize)
-
 	app := newApp()
 
-	go func() {
-		for {
-			msg := <-app.OutChan
-			bytes, err := json.Marshal(msg)
-			if err != nil {
-				panic(err)
-			}
-
-			n, err := app.Out.Write(bytes)
-			if err != nil {
-				panic(err)
-			}
-
-			if n != len(bytes) {
-				// TODO: handle this correctly.
-				panic("short write :(")
-			}
-
-			err = app.Out.WriteByte(0x0a)
-			if err != nil {
-				panic(err)
-			}
-
-			if err := app.Out.Flush(); err != nil {
-				panic(err)
-			}
+	if *control != "" {
+		listener, err := listenControl(*control)
+		if err != nil {
+			helperLog.Errorf("failed to listen for control connections: %s", err)
+			os.Exit(1)
 		}
-	}()
+		helperLog.Infof("serving the daemon on %s", listener.Addr())
 
-	var line string
+		err = newControlServer(app, listener).serve()
+		helperLog.Errorf("control socket stopped accepting connections because %v", err)
+		os.Exit(1)
+	}
 
-	defer func() {
-		if r := recover(); r != nil {
-			helperLog.Error("While handling RPC:", line, "\nThe following panic occurred: ", r, "\nstack:\n", string(debug.Stack()))
-		}
-	}()
+	in := bufio.NewReaderSize(os.Stdin, 1024*1024)
 
-	for lines.Scan() {
-		line = lines.Text()
-		helperLog.Debugf("message size is %d", len(line))
-		var raw json.RawMessage
-		env := envelope{
-			Body: &raw,
-		}
-		if err := json.Unmarshal([]byte(line), &env); err != nil {
-			log.Print("when unmarshaling the envelope...")
-			log.Panic(err)
-		}
-		msg := msgHandlers[env.Method]()
-		if err := json.Unmarshal(raw, msg); err != nil {
-			log.Print("when unmarshaling the method invocation...")
-			log.Panic(err)
-		}
+	mode, err := negotiateWireMode(in, app.Out)
+	if err != nil {
+		helperLog.Errorf("failed to negotiate wire mode: %s", err)
+		os.Exit(1)
+	}
+	helperLog.Infof("speaking %s wire mode to the daemon", mode)
 
-		go func() {
-			start := time.Now()
-			ret, err := msg.run(app)
-			if err != nil {
-				app.writeMsg(errorResult{Seqno: env.Seqno, Errorr: err.Error()})
-				return
-			}
+	requests, out := newCodec(mode, in, app.Out)
 
-			res, err := json.Marshal(ret)
-			if err != nil {
-				app.writeMsg(errorResult{Seqno: env.Seqno, Errorr: err.Error()})
-				return
+	go func() {
+		for {
+			msg := app.OutQueue.pop()
+			write := func(msg interface{}) {
+				if err := out.write(msg); err != nil {
+					panic(err)
+				}
 			}
+			write(msg)
+			exitAfterShutdown(app, msg, write)
+		}
+	}()
 
-			app.writeMsg(successResult{Seqno: env.Seqno, Success: res, Duration: time.Since(start).String()})
-		}()
-	}
-	app.writeMsg(errorResult{Seqno: 0, Errorr: fmt.Sprintf("helper stdin scanning stopped because %v", lines.Err())})
-	// we never want the helper to get here, it should be killed or gracefully
-	// shut down instead of stdin closed.
+	err = serve(app, requests)
+	app.writeMsg(errorResult{Seqno: 0, Errorr: fmt.Sprintf("helper stdin scanning stopped because %v", err)})
+	// we never want the helper to get here, it should be killed or shut down
+	// with the shutdown method instead of stdin closed.
 	os.Exit(1)
 }
 
@@ -2,13 +2,22 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"codanet"
 	"context"
 	crand "crypto/rand"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -22,6 +31,7 @@ import (
 	protocol "github.com/libp2p/go-libp2p-core/protocol"
 
 	"github.com/libp2p/go-libp2p-pubsub"
+	swarm "github.com/libp2p/go-libp2p-swarm"
 	ma "github.com/multiformats/go-multiaddr"
 
 	"github.com/stretchr/testify/require"
@@ -68,7 +78,10 @@ func newTestAppWithMaxConns(t *testing.T, seeds []peer.AddrInfo, maxConns int) *
 		seeds,
 		codanet.NewCodaGatingState(nil, nil, nil, nil),
 		maxConns,
+		codanet.DefaultLowWater,
+		codanet.DefaultGracePeriod,
 		true,
+		false,
 	)
 	require.NoError(t, err)
 	port++
@@ -88,14 +101,37 @@ func newTestAppWithMaxConns(t *testing.T, seeds []peer.AddrInfo, maxConns int) *
 		Ctx:            context.Background(),
 		Subs:           make(map[int]subscription),
 		Topics:         make(map[string]*pubsub.Topic),
+		SubValidators:  make(map[string]*topicValidator),
 		ValidatorMutex: &sync.Mutex{},
 		Validators:     make(map[int]*validationStatus),
 		Streams:        make(map[int]net.Stream),
+		Pending:        make(map[int]*pendingRequest),
 		AddedPeers:     make([]peer.AddrInfo, 0, 512),
+		Config:         &configureMsg{MaxConnections: maxConns, MinaPeerExchange: true},
+		Upcalls:        handlesAll(),
 		NoUpcalls:      true,
 	}
 }
 
+// handlesAll is the upcalls of a daemon that handles every one of them
+func handlesAll() map[string]bool {
+	upcalls := make(map[string]bool)
+	for _, name := range upcallNames() {
+		upcalls[name] = true
+	}
+	return upcalls
+}
+
+// helloBody is the body of a hello from a daemon that calls methods and
+// handles the required upcalls
+func helloBody(methods ...string) string {
+	body, err := json.Marshal(helloMsg{ProtocolVersion: protocolVersion, Methods: append([]string{}, methods...), Upcalls: requiredUpcalls})
+	if err != nil {
+		panic(err)
+	}
+	return string(body)
+}
+
 func newTestApp(t *testing.T, seeds []peer.AddrInfo) *app {
 	return newTestAppWithMaxConns(t, seeds, 50)
 }
@@ -135,11 +171,11 @@ func TestDHTDiscovery_TwoNodes(t *testing.T) {
 	appB.NoMDNS = true
 
 	// begin appB and appC's DHT advertising
-	ret, err := new(beginAdvertisingMsg).run(appB)
+	ret, err := new(beginAdvertisingMsg).run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, ret, "beginAdvertising success")
 
-	ret, err = new(beginAdvertisingMsg).run(appA)
+	ret, err = new(beginAdvertisingMsg).run(context.Background(), appA)
 	require.NoError(t, err)
 	require.Equal(t, ret, "beginAdvertising success")
 
@@ -168,11 +204,11 @@ func TestDHTDiscovery_ThreeNodes(t *testing.T) {
 	time.Sleep(time.Second)
 
 	// begin appB and appC's DHT advertising
-	ret, err := new(beginAdvertisingMsg).run(appB)
+	ret, err := new(beginAdvertisingMsg).run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, ret, "beginAdvertising success")
 
-	ret, err = new(beginAdvertisingMsg).run(appC)
+	ret, err = new(beginAdvertisingMsg).run(context.Background(), appC)
 	require.NoError(t, err)
 	require.Equal(t, ret, "beginAdvertising success")
 
@@ -209,11 +245,11 @@ func TestMDNSDiscovery(t *testing.T) {
 	appB.NoDHT = true
 
 	// begin appA and appB's mDNS advertising
-	ret, err := new(beginAdvertisingMsg).run(appB)
+	ret, err := new(beginAdvertisingMsg).run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, ret, "beginAdvertising success")
 
-	ret, err = new(beginAdvertisingMsg).run(appA)
+	ret, err = new(beginAdvertisingMsg).run(context.Background(), appA)
 	require.NoError(t, err)
 	require.Equal(t, ret, "beginAdvertising success")
 
@@ -321,9 +357,242 @@ func TestConfigurationMsg(t *testing.T) {
 		ValidationQueueSize: 16,
 	}
 
-	ret, err := msg.run(testApp)
+	ret, err := msg.run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, "configure success", ret)
+
+	// a second helper would leak the first one
+	_, err = msg.run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+}
+
+func TestReconfigureMsg(t *testing.T) {
+	appA := newTestApp(t, nil)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, nil)
+	err = appB.P2p.Host.Connect(appB.Ctx, appAInfos[0])
+	require.NoError(t, err)
+
+	cm := appB.P2p.ConnectionManager
+	cm.TagPeer(appA.P2p.Host.ID(), "test", 42)
+	cm.Protect(appA.P2p.Host.ID(), "test")
+
+	maxConns := 10
+	flood := true
+	external := "/ip4/1.2.3.4/tcp/7000"
+	msg := &reconfigureMsg{
+		MaxConnections: &maxConns,
+		Flood:          &flood,
+		External:       &external,
+	}
+
+	before := appB.config()
+	ret, err := msg.run(context.Background(), appB)
+	require.NoError(t, err)
+	require.Equal(t, reconfigureResult{
+		Applied:         []string{"max_connections", "external_maddr"},
+		RestartRequired: []string{"flood"},
+	}, ret)
+
+	// the settings are replaced, so whoever still holds the old ones doesn't
+	// see them change underneath
+	require.Equal(t, 50, before.MaxConnections)
+	require.Equal(t, maxConns, appB.config().MaxConnections)
+	require.Equal(t, external, appB.config().External)
+
+	// the new limits apply without losing track of connections, tags or
+	// protections
+	info := cm.GetInfo()
+	require.Equal(t, maxConns, info.HighWater)
+	require.Equal(t, 1, info.ConnCount)
+	require.Equal(t, 42, cm.GetTagInfo(appA.P2p.Host.ID()).Tags["test"])
+	require.True(t, cm.IsProtected(appA.P2p.Host.ID(), "test"))
+
+	externalMaddr, err := ma.NewMultiaddr(external)
+	require.NoError(t, err)
+	require.Contains(t, appB.P2p.Host.Addrs(), externalMaddr)
+
+	// applying the same settings again changes nothing
+	ret, err = msg.run(context.Background(), appB)
+	require.NoError(t, err)
+	require.Equal(t, reconfigureResult{Applied: []string{}, RestartRequired: []string{"flood"}}, ret)
+
+	maxConns = 0
+	_, err = msg.run(context.Background(), appB)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+}
+
+func TestReconfigureSeeds(t *testing.T) {
+	testApp := newTestApp(t, nil)
+
+	var seeds []string
+	var ids []peer.ID
+	for i := 0; i < 3; i++ {
+		_, pk, err := crypto.GenerateEd25519Key(crand.Reader)
+		require.NoError(t, err)
+		id, err := peer.IDFromPublicKey(pk)
+		require.NoError(t, err)
+		ids = append(ids, id)
+		seeds = append(seeds, fmt.Sprintf("/ip4/127.0.0.1/tcp/9/p2p/%s", peer.Encode(id)))
+	}
+	addedPeers := func() []peer.ID {
+		var added []peer.ID
+		for _, info := range testApp.addedPeers() {
+			added = append(added, info.ID)
+		}
+		return added
+	}
+	trusted := func(id peer.ID) bool {
+		return testApp.P2p.GatingState.TrustedPeers.Contains(id)
+	}
+
+	_, err := (&reconfigureMsg{SeedPeers: seeds[:2]}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.ElementsMatch(t, ids[:2], addedPeers())
+	require.True(t, trusted(ids[0]))
+	require.True(t, trusted(ids[1]))
+
+	_, err = (&setGatingConfigMsg{TrustedPeerIDs: []string{peer.Encode(ids[1])}}).run(context.Background(), testApp)
+	require.NoError(t, err)
+
+	// dropped seeds are no longer trusted, unless the gating config says so
+	_, err = (&reconfigureMsg{SeedPeers: seeds[2:]}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, ids[2:], addedPeers())
+	require.False(t, trusted(ids[0]))
+	require.True(t, trusted(ids[1]))
+	require.True(t, trusted(ids[2]))
+
+	// the added peers can be changed while they are read
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			_, _ = (&reconfigureMsg{SeedPeers: seeds[i%3 : i%3+1]}).run(context.Background(), testApp)
+		}(i)
+		go func() {
+			defer wg.Done()
+			_, _ = (&setGatingConfigMsg{}).run(context.Background(), testApp)
+		}()
+	}
+	wg.Wait()
+	require.Len(t, addedPeers(), 1)
+}
+
+func TestGetConnectionManagerStatusMsg(t *testing.T) {
+	testApp := newTestApp(t, nil)
+
+	ret, err := (&getConnectionManagerStatusMsg{}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, connectionManagerStatus{
+		LowWater:      codanet.DefaultLowWater,
+		HighWater:     50,
+		GracePeriodMs: int64(codanet.DefaultGracePeriod / time.Millisecond),
+	}, ret)
+
+	lowWater := 10
+	gracePeriodMs := 30000
+	msg := &reconfigureMsg{LowWater: &lowWater, GracePeriodMs: &gracePeriodMs}
+	ret, err = msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, reconfigureResult{
+		Applied:         []string{"low_water", "grace_period_ms"},
+		RestartRequired: []string{},
+	}, ret)
+
+	ret, err = (&getConnectionManagerStatusMsg{}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, connectionManagerStatus{LowWater: 10, HighWater: 50, GracePeriodMs: 30000}, ret)
+
+	// the low water mark can't be above the high one
+	lowWater = 60
+	_, err = msg.run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	lowWater = 8
+	maxConns := 5
+	_, err = (&reconfigureMsg{MaxConnections: &maxConns, LowWater: &lowWater}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+
+	reserved := 10
+	ret, err = (&reconfigureMsg{ReservedOutbound: &reserved}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, reconfigureResult{
+		Applied:         []string{"reserved_outbound"},
+		RestartRequired: []string{},
+	}, ret)
+	ret, err = (&getConnectionManagerStatusMsg{}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, 10, ret.(connectionManagerStatus).ReservedOutbound)
+
+	// nor can the reserved outbound slots be more than there are slots
+	_, err = (&reconfigureMsg{MaxConnections: &maxConns}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+}
+
+func TestProtectAndTagPeerMsgs(t *testing.T) {
+	testApp := newTestApp(t, nil)
+	cm := testApp.P2p.ConnectionManager
+	peerID := "12D3KooWJDGPa2hiYCJ2o7XPqEq2tjrWpFJzqa4dy538Gfs7Vn2r"
+	id, err := peer.Decode(peerID)
+	require.NoError(t, err)
+
+	_, err = (&protectPeerMsg{PeerID: peerID, Tag: "producer"}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	_, err = (&protectPeerMsg{PeerID: peerID, Tag: "catchup"}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.True(t, cm.IsProtected(id, "daemon:producer"))
+
+	ret, err := (&unprotectPeerMsg{PeerID: peerID, Tag: "producer"}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, unprotectPeerResult{Protected: true}, ret)
+	ret, err = (&unprotectPeerMsg{PeerID: peerID, Tag: "catchup"}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, unprotectPeerResult{Protected: false}, ret)
+
+	_, err = (&tagPeerMsg{PeerID: peerID, Tag: "useful", Weight: 42}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, 42, cm.GetTagInfo(id).Tags["daemon:useful"])
+	_, err = (&untagPeerMsg{PeerID: peerID, Tag: "useful"}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.NotContains(t, cm.GetTagInfo(id).Tags, "daemon:useful")
+
+	_, err = (&tagPeerMsg{PeerID: "not a peer", Tag: "useful"}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	_, err = (&protectPeerMsg{PeerID: peerID}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+}
+
+func TestDecayingTagMsgs(t *testing.T) {
+	testApp := newTestApp(t, nil)
+	peerID := "12D3KooWJDGPa2hiYCJ2o7XPqEq2tjrWpFJzqa4dy538Gfs7Vn2r"
+	id, err := peer.Decode(peerID)
+	require.NoError(t, err)
+
+	register := &registerDecayingTagMsg{Name: "served-blocks", IntervalMs: 60000, Decay: "fixed", DecayAmount: 1, Bump: "bounded_sum", BumpMax: 100}
+	_, err = register.run(context.Background(), testApp)
+	require.NoError(t, err)
+	_, err = register.run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+
+	bump := &bumpDecayingTagMsg{Name: "served-blocks", PeerID: peerID, Delta: 70}
+	_, err = bump.run(context.Background(), testApp)
+	require.NoError(t, err)
+	_, err = bump.run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		info := testApp.P2p.ConnectionManager.GetTagInfo(id)
+		return info != nil && info.Tags["daemon:served-blocks"] == 100
+	}, 10*time.Second, 10*time.Millisecond)
+
+	_, err = (&bumpDecayingTagMsg{Name: "unknown", PeerID: peerID, Delta: 1}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	_, err = (&registerDecayingTagMsg{Name: "bad", IntervalMs: 60000, Decay: "linear", DecayCoefficient: 2}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	_, err = (&registerDecayingTagMsg{Name: "bad", Decay: "none"}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
 }
 
 func TestListenMsg(t *testing.T) {
@@ -338,7 +607,7 @@ func TestListenMsg(t *testing.T) {
 		Iface: addrStr,
 	}
 
-	addrs, err := msg.run(testApp)
+	addrs, err := msg.run(context.Background(), testApp)
 	require.NoError(t, err)
 
 	found := false
@@ -359,14 +628,14 @@ func TestPublishMsg(t *testing.T) {
 	require.NoError(t, err)
 
 	topic := "testtopic"
-	data := "testdata"
+	data := []byte("testdata")
 
 	msg := &publishMsg{
 		Topic: topic,
 		Data:  data,
 	}
 
-	ret, err := msg.run(testApp)
+	ret, err := msg.run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, "publish success", ret)
 
@@ -388,7 +657,7 @@ func TestSubscribeMsg(t *testing.T) {
 		Subscription: idx,
 	}
 
-	ret, err := msg.run(testApp)
+	ret, err := msg.run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, "subscribe success", ret)
 
@@ -412,7 +681,7 @@ func TestUnsubscribeMsg(t *testing.T) {
 		Subscription: idx,
 	}
 
-	ret, err := msg.run(testApp)
+	ret, err := msg.run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, "subscribe success", ret)
 
@@ -424,7 +693,7 @@ func TestUnsubscribeMsg(t *testing.T) {
 	unsubMsg := &unsubscribeMsg{
 		Subscription: idx,
 	}
-	ret, err = unsubMsg.run(testApp)
+	ret, err = unsubMsg.run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, "unsubscribe success", ret)
 
@@ -432,6 +701,168 @@ func TestUnsubscribeMsg(t *testing.T) {
 	require.False(t, has)
 }
 
+func TestSubscribeMsg_ValidatorOptions(t *testing.T) {
+	var err error
+
+	appA := newTestApp(t, nil)
+	appA.NoUpcalls = false
+	appA.OutQueue = newOutQueue(defaultOutQueueSize, overflowBlock)
+	appA.P2p.Pubsub, err = pubsub.NewGossipSub(appA.Ctx, appA.P2p.Host)
+	require.NoError(t, err)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, appAInfos)
+	appB.P2p.Pubsub, err = pubsub.NewGossipSub(appB.Ctx, appB.P2p.Host)
+	require.NoError(t, err)
+	require.NoError(t, appB.P2p.Host.Connect(appB.Ctx, appAInfos[0]))
+
+	for _, msg := range []*subscribeMsg{
+		{Topic: "txs", ValidationTimeoutMs: -1},
+		{Topic: "txs", ValidationConcurrency: -1},
+		{Topic: "txs", ValidateInline: true, BatchWindowMs: 100},
+	} {
+		_, err = msg.run(context.Background(), appA)
+		require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	}
+
+	// batching needs a daemon that handles validateBatch
+	appA.Upcalls = map[string]bool{}
+	_, err = (&subscribeMsg{Topic: "txs", BatchWindowMs: 100}).run(context.Background(), appA)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	appA.Upcalls = handlesAll()
+
+	_, err = (&subscribeMsg{Topic: "txs", Subscription: 0, ValidationTimeoutMs: 500, ValidationConcurrency: 1}).run(context.Background(), appA)
+	require.NoError(t, err)
+	// the deadline of the call doesn't carry over to the validations
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err = (&subscribeMsg{Topic: "blocks", Subscription: 1, ValidateInline: true}).run(ctx, appA)
+	require.NoError(t, err)
+
+	topicsB := make(map[string]*pubsub.Topic)
+	for _, topic := range []string{"txs", "blocks"} {
+		topicsB[topic], err = appB.P2p.Pubsub.Join(topic)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return len(topicsB[topic].ListPeers()) == 1
+		}, testTimeout, 10*time.Millisecond)
+	}
+
+	go func() {
+		seqs <- 1
+		seqs <- 2
+	}()
+
+	require.NoError(t, topicsB["txs"].Publish(appB.Ctx, []byte("tx 0")))
+	tx, ok := nextMsg(t, appA).(*validateUpcall)
+	require.True(t, ok)
+	require.Equal(t, 0, tx.Idx)
+
+	// the second transaction is over the topic's concurrency, so it is
+	// dropped, and the block is validated while the first is outstanding
+	require.NoError(t, topicsB["txs"].Publish(appB.Ctx, []byte("tx 1")))
+	require.NoError(t, topicsB["blocks"].Publish(appB.Ctx, []byte("block")))
+	block, ok := nextMsg(t, appA).(*validateUpcall)
+	require.True(t, ok)
+	require.Equal(t, 1, block.Idx)
+	require.Equal(t, []byte("block"), block.Data)
+	appA.ValidatorMutex.Lock()
+	require.Equal(t, validationTimeout, appA.Validators[block.Seqno].Timeout)
+	appA.ValidatorMutex.Unlock()
+	_, err = (&validationCompleteMsg{Seqno: block.Seqno, Valid: acceptResult}).run(context.Background(), appA)
+	require.NoError(t, err)
+
+	// the transaction times out after its topic's timeout, not the default
+	require.Eventually(t, func() bool {
+		appA.ValidatorMutex.Lock()
+		defer appA.ValidatorMutex.Unlock()
+		return appA.Validators[tx.Seqno].TimedOutAt != nil
+	}, testTimeout, 10*time.Millisecond)
+	_, err = (&validationCompleteMsg{Seqno: tx.Seqno, Valid: acceptResult}).run(context.Background(), appA)
+	require.NoError(t, err)
+}
+
+func TestSubscribeMsg_Churn(t *testing.T) {
+	var err error
+	topic := "testtopic"
+
+	appA := newTestApp(t, nil)
+	appA.NoUpcalls = false
+	appA.OutQueue = newOutQueue(defaultOutQueueSize, overflowBlock)
+	appA.P2p.Pubsub, err = pubsub.NewGossipSub(appA.Ctx, appA.P2p.Host)
+	require.NoError(t, err)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, appAInfos)
+	appB.P2p.Pubsub, err = pubsub.NewGossipSub(appB.Ctx, appB.P2p.Host)
+	require.NoError(t, err)
+	require.NoError(t, appB.P2p.Host.Connect(appB.Ctx, appAInfos[0]))
+	topicB, err := appB.P2p.Pubsub.Join(topic)
+	require.NoError(t, err)
+
+	rounds := 3
+	go func() {
+		for i := 0; i < 2*rounds; i++ {
+			seqs <- i
+		}
+	}()
+
+	// publishes a message from B and completes its validation, returning the
+	// subscription it was validated for
+	validatedFor := func(data string) int {
+		require.NoError(t, topicB.Publish(appB.Ctx, []byte(data)))
+		upcall, ok := nextMsg(t, appA).(*validateUpcall)
+		require.True(t, ok)
+		require.Equal(t, []byte(data), upcall.Data)
+		_, err := (&validationCompleteMsg{Seqno: upcall.Seqno, Valid: acceptResult}).run(context.Background(), appA)
+		require.NoError(t, err)
+		return upcall.Idx
+	}
+
+	for i := 0; i < rounds; i++ {
+		first, second := 2*i, 2*i+1
+
+		// the same topic under two subscriptions shares one validator
+		_, err = (&subscribeMsg{Topic: topic, Subscription: first}).run(context.Background(), appA)
+		require.NoError(t, err)
+		_, err = (&subscribeMsg{Topic: topic, Subscription: second}).run(context.Background(), appA)
+		require.NoError(t, err)
+		_, err = (&subscribeMsg{Topic: "other", Subscription: second}).run(context.Background(), appA)
+		require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+		// a validator can only have one set of options
+		_, err = (&subscribeMsg{Topic: topic, Subscription: 2 * rounds, ValidateInline: true}).run(context.Background(), appA)
+		require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+		require.NotContains(t, appA.Subs, 2*rounds)
+
+		require.Eventually(t, func() bool {
+			return len(topicB.ListPeers()) == 1
+		}, testTimeout, 10*time.Millisecond)
+		require.Equal(t, first, validatedFor(fmt.Sprintf("round %d, first", i)))
+
+		// the validator is for the remaining subscription once the first is gone
+		_, err = (&unsubscribeMsg{Subscription: first}).run(context.Background(), appA)
+		require.NoError(t, err)
+		require.Equal(t, second, validatedFor(fmt.Sprintf("round %d, second", i)))
+
+		// and is unregistered with the last one, along with the topic
+		_, err = (&unsubscribeMsg{Subscription: second}).run(context.Background(), appA)
+		require.NoError(t, err)
+		require.Empty(t, appA.Subs)
+		require.Empty(t, appA.Topics)
+		require.Empty(t, appA.SubValidators)
+		require.Eventually(t, func() bool {
+			return len(topicB.ListPeers()) == 0
+		}, testTimeout, 10*time.Millisecond)
+	}
+
+	// publishing joins the topic again
+	_, err = (&publishMsg{Topic: topic, Data: []byte("block")}).run(context.Background(), appA)
+	require.NoError(t, err)
+	require.Contains(t, appA.Topics, topic)
+}
+
 func TestValidationCompleteMsg(t *testing.T) {
 	testApp := newTestApp(t, nil)
 
@@ -452,16 +883,40 @@ func TestValidationCompleteMsg(t *testing.T) {
 		Valid: acceptResult,
 	}
 
-	ret, err := msg.run(testApp)
+	ret, err := msg.run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, "validationComplete success", ret)
 	require.Equal(t, acceptResult, result)
 }
 
+func TestValidationCompleteAtDeadline(t *testing.T) {
+	testApp := newTestApp(t, nil)
+
+	// the verdict comes in just as the validation times out
+	ch := make(chan string, 1)
+	testApp.Validators[0] = &validationStatus{Completion: ch}
+	_, err := (&validationCompleteMsg{Seqno: 0, Valid: rejectResult}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	res, ok := testApp.timeOutValidation(0, ch)
+	require.True(t, ok)
+	require.Equal(t, rejectResult, res)
+	require.Equal(t, pubsub.ValidationReject, testApp.validationResult(res))
+
+	// or just after
+	ch = make(chan string, 1)
+	testApp.Validators[1] = &validationStatus{Completion: ch}
+	_, ok = testApp.timeOutValidation(1, ch)
+	require.False(t, ok)
+	require.NotNil(t, testApp.Validators[1].TimedOutAt)
+	_, err = (&validationCompleteMsg{Seqno: 1, Valid: acceptResult}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Empty(t, testApp.Validators)
+}
+
 func TestGenerateKeypairMsg(t *testing.T) {
 	testApp := newTestApp(t, nil)
 
-	ret, err := (&generateKeypairMsg{}).run(testApp)
+	ret, err := (&generateKeypairMsg{}).run(context.Background(), testApp)
 	require.NoError(t, err)
 
 	kp, ok := ret.(generatedKeypair)
@@ -489,7 +944,7 @@ func TestOpenStreamMsg(t *testing.T) {
 		seqs <- 1
 	}()
 
-	ret, err := msg.run(appA)
+	ret, err := msg.run(context.Background(), appA)
 	require.NoError(t, err)
 
 	expectedHost, err := appB.P2p.Host.Addrs()[0].ValueForProtocol(4)
@@ -525,7 +980,7 @@ func TestCloseStreamMsg(t *testing.T) {
 		seqs <- 1
 	}()
 
-	ret, err := msg.run(appA)
+	ret, err := msg.run(context.Background(), appA)
 	require.NoError(t, err)
 
 	expectedHost, err := appB.P2p.Host.Addrs()[0].ValueForProtocol(4)
@@ -546,7 +1001,7 @@ func TestCloseStreamMsg(t *testing.T) {
 		StreamIdx: 1,
 	}
 
-	ret, err = closeMsg.run(appA)
+	ret, err = closeMsg.run(context.Background(), appA)
 	require.NoError(t, err)
 	require.Equal(t, "closeStream success", ret)
 
@@ -572,7 +1027,7 @@ func TestResetStreamMsg(t *testing.T) {
 		seqs <- 1
 	}()
 
-	ret, err := msg.run(appA)
+	ret, err := msg.run(context.Background(), appA)
 	require.NoError(t, err)
 
 	expectedHost, err := appB.P2p.Host.Addrs()[0].ValueForProtocol(4)
@@ -593,7 +1048,7 @@ func TestResetStreamMsg(t *testing.T) {
 		StreamIdx: 1,
 	}
 
-	ret, err = resetMsg.run(appA)
+	ret, err = resetMsg.run(context.Background(), appA)
 	require.NoError(t, err)
 	require.Equal(t, "resetStream success", ret)
 
@@ -619,7 +1074,7 @@ func TestSendStreamMsg(t *testing.T) {
 		seqs <- 1
 	}()
 
-	ret, err := msg.run(appA)
+	ret, err := msg.run(context.Background(), appA)
 	require.NoError(t, err)
 
 	expectedHost, err := appB.P2p.Host.Addrs()[0].ValueForProtocol(4)
@@ -638,10 +1093,10 @@ func TestSendStreamMsg(t *testing.T) {
 
 	sendMsg := &sendStreamMsgMsg{
 		StreamIdx: 1,
-		Data:      "somedata",
+		Data:      []byte("somedata"),
 	}
 
-	ret, err = sendMsg.run(appA)
+	ret, err = sendMsg.run(context.Background(), appA)
 	require.NoError(t, err)
 	require.Equal(t, "sendStreamMsg success", ret)
 }
@@ -661,10 +1116,10 @@ func TestAddStreamHandlerMsg(t *testing.T) {
 		Protocol: newProtocol,
 	}
 
-	ret, err := addMsg.run(appA)
+	ret, err := addMsg.run(context.Background(), appA)
 	require.NoError(t, err)
 	require.Equal(t, "addStreamHandler success", ret)
-	ret, err = addMsg.run(appB)
+	ret, err = addMsg.run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, "addStreamHandler success", ret)
 
@@ -677,7 +1132,7 @@ func TestAddStreamHandlerMsg(t *testing.T) {
 		seqs <- 1
 	}()
 
-	ret, err = msg.run(appA)
+	ret, err = msg.run(context.Background(), appA)
 	require.NoError(t, err)
 
 	expectedHost, err := appB.P2p.Host.Addrs()[0].ValueForProtocol(4)
@@ -710,17 +1165,17 @@ func TestRemoveStreamHandlerMsg(t *testing.T) {
 		Protocol: newProtocol,
 	}
 
-	ret, err := addMsg.run(appA)
+	ret, err := addMsg.run(context.Background(), appA)
 	require.NoError(t, err)
 	require.Equal(t, "addStreamHandler success", ret)
-	ret, err = addMsg.run(appB)
+	ret, err = addMsg.run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, "addStreamHandler success", ret)
 
 	removeMsg := &removeStreamHandlerMsg{
 		Protocol: newProtocol,
 	}
-	ret, err = removeMsg.run(appB)
+	ret, err = removeMsg.run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, "removeStreamHandler success", ret)
 
@@ -734,14 +1189,14 @@ func TestRemoveStreamHandlerMsg(t *testing.T) {
 		seqs <- 2
 	}()
 
-	_, err = msg.run(appA)
+	_, err = msg.run(context.Background(), appA)
 	require.Equal(t, "protocol not supported", err.(wrappedError).Unwrap().Error())
 }
 
 func TestListeningAddrsMsg(t *testing.T) {
 	testApp := newTestApp(t, nil)
 
-	ret, err := (&listeningAddrsMsg{}).run(testApp)
+	ret, err := (&listeningAddrsMsg{}).run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, testApp.P2p.Host.Addrs(), ret)
 }
@@ -757,7 +1212,7 @@ func TestAddPeerMsg(t *testing.T) {
 		Multiaddr: fmt.Sprintf("%s/p2p/%s", appAInfos[0].Addrs[0], appAInfos[0].ID),
 	}
 
-	ret, err := msg.run(appB)
+	ret, err := msg.run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, "addPeer success", ret)
 
@@ -776,7 +1231,7 @@ func TestFindPeerMsg(t *testing.T) {
 		Multiaddr: fmt.Sprintf("%s/p2p/%s", appAInfos[0].Addrs[0], appAInfos[0].ID),
 	}
 
-	ret, err := msg.run(appB)
+	ret, err := msg.run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, "addPeer success", ret)
 
@@ -796,7 +1251,7 @@ func TestFindPeerMsg(t *testing.T) {
 		PeerID:     appA.P2p.Host.ID().String(),
 	}
 
-	ret, err = findMsg.run(appB)
+	ret, err = findMsg.run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, expected, ret)
 }
@@ -812,7 +1267,7 @@ func TestListPeersMsg(t *testing.T) {
 		Multiaddr: fmt.Sprintf("%s/p2p/%s", appAInfos[0].Addrs[0], appAInfos[0].ID),
 	}
 
-	ret, err := msg.run(appB)
+	ret, err := msg.run(context.Background(), appB)
 	require.NoError(t, err)
 	require.Equal(t, "addPeer success", ret)
 
@@ -826,9 +1281,10 @@ func TestListPeersMsg(t *testing.T) {
 		Libp2pPort: expectedPort,
 		Host:       expectedHost,
 		PeerID:     appA.P2p.Host.ID().String(),
+		Direction:  "outbound",
 	}
 
-	ret, err = (&listPeersMsg{}).run(appB)
+	ret, err = (&listPeersMsg{}).run(context.Background(), appB)
 	require.NoError(t, err)
 	infos := ret.([]codaPeerInfo)
 	require.Equal(t, 1, len(infos))
@@ -853,26 +1309,266 @@ func TestSetGatingConfigMsg(t *testing.T) {
 		TrustedIPs:     []string{"7.8.9.0"},
 	}
 
-	ret, err := msg.run(testApp)
+	ret, err := msg.run(context.Background(), testApp)
 	require.NoError(t, err)
 	require.Equal(t, "ok", ret)
 
-	ok := testApp.P2p.GatingState.InterceptPeerDial(peer.ID(bannedID))
+	bannedPeer, err := peer.Decode(bannedID)
+	require.NoError(t, err)
+	allowedPeer, err := peer.Decode(allowedID)
+	require.NoError(t, err)
+
+	ok := testApp.P2p.GatingState.InterceptPeerDial(bannedPeer)
 	require.False(t, ok)
 
-	ok = testApp.P2p.GatingState.InterceptPeerDial(peer.ID(allowedID))
+	ok = testApp.P2p.GatingState.InterceptPeerDial(allowedPeer)
 	require.True(t, ok)
 
-	ok = testApp.P2p.GatingState.InterceptAddrDial(peer.ID(bannedID), bannedMultiaddr)
+	ok = testApp.P2p.GatingState.InterceptAddrDial(bannedPeer, bannedMultiaddr)
 	require.False(t, ok)
 
-	ok = testApp.P2p.GatingState.InterceptAddrDial(peer.ID(bannedID), allowedMultiaddr)
+	ok = testApp.P2p.GatingState.InterceptAddrDial(bannedPeer, allowedMultiaddr)
 	require.False(t, ok)
 
-	ok = testApp.P2p.GatingState.InterceptAddrDial(peer.ID(allowedID), allowedMultiaddr)
+	ok = testApp.P2p.GatingState.InterceptAddrDial(allowedPeer, allowedMultiaddr)
 	require.True(t, ok)
 }
 
+func TestSetGatingConfigMsg_CIDR(t *testing.T) {
+	testApp := newTestApp(t, nil)
+
+	msg := &setGatingConfigMsg{
+		BannedIPs:  []string{"1.2.3.0/24", "2001:db8::/32"},
+		TrustedIPs: []string{"1.2.3.4", "2001:db8::1"},
+	}
+	_, err := msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+
+	id, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+
+	for addr, allowed := range map[string]bool{
+		"/ip4/1.2.3.4/tcp/7000":        true,
+		"/ip4/1.2.3.5/tcp/7000":        false,
+		"/ip4/1.2.4.5/tcp/7000":        true,
+		"/ip6/2001:db8::1/tcp/7000":    true,
+		"/ip6/2001:db8::2/tcp/7000":    false,
+		"/ip6/2001:db9::2/tcp/7000":    true,
+		"/ip6/::ffff:1.2.3.5/tcp/7000": false,
+	} {
+		maddr, err := ma.NewMultiaddr(addr)
+		require.NoError(t, err)
+		require.Equal(t, allowed, testApp.P2p.GatingState.InterceptAddrDial(id, maddr), addr)
+	}
+
+	for _, ip := range []string{"1.2.3.4/33", "2001:db8::/129", "1.2.3", "example.com"} {
+		msg := &setGatingConfigMsg{BannedIPs: []string{ip}}
+		_, err := msg.run(context.Background(), testApp)
+		require.Equal(t, codanet.ErrCodeBadInput, codeOf(err), ip)
+	}
+}
+
+func TestListBansMsg(t *testing.T) {
+	testApp := newTestApp(t, nil)
+	testApp.NoUpcalls = false
+	testApp.OutQueue = newOutQueue(defaultOutQueueSize, overflowBlock)
+	testApp.P2p.GatingState.OnBanExpired = testApp.banExpired
+
+	id, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+
+	expires := time.Now().Add(time.Hour)
+	msg := &setGatingConfigMsg{
+		BannedIPs: []string{"1.2.3.4"},
+		TimedBans: []banJson{
+			{PeerID: peer.Encode(id), ExpiresAtMs: expires.UnixNano() / int64(time.Millisecond)},
+			{IP: "5.6.7.0/24", ExpiresAtMs: time.Now().Add(time.Second).UnixNano() / int64(time.Millisecond)},
+		},
+	}
+	_, err = msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+
+	ret, err := (&listBansMsg{}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	bans := ret.([]banJson)
+	require.Len(t, bans, 3)
+	for _, ban := range bans {
+		switch {
+		case ban.PeerID == peer.Encode(id):
+			require.InDelta(t, time.Hour/time.Millisecond, ban.RemainingMs, float64(time.Minute/time.Millisecond))
+		case ban.IP == "1.2.3.4/32":
+			require.Zero(t, ban.ExpiresAtMs)
+			require.Zero(t, ban.RemainingMs)
+		default:
+			require.Equal(t, "5.6.7.0/24", ban.IP)
+		}
+	}
+
+	maddr, err := ma.NewMultiaddr("/ip4/5.6.7.8/tcp/7000")
+	require.NoError(t, err)
+	require.False(t, testApp.P2p.GatingState.InterceptAddrDial(id, maddr))
+
+	// the IP ban is lifted on its own, but the peer stays banned
+	require.Equal(t, banExpiredUpcall{Upcall: "banExpired", IP: "5.6.7.0/24"}, nextMsg(t, testApp))
+	require.False(t, testApp.P2p.GatingState.InterceptAddrDial(id, maddr))
+
+	msg.TimedBans = []banJson{{PeerID: peer.Encode(id)}}
+	_, err = msg.run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+}
+
+func TestGetGatingEventsMsg(t *testing.T) {
+	testApp := newTestApp(t, nil)
+
+	msg := &setGatingConfigMsg{
+		BannedIPs: []string{"1.2.3.4"},
+		Isolate:   true,
+	}
+	_, err := msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+
+	id, err := peer.IDFromPrivateKey(newTestKey(t))
+	require.NoError(t, err)
+	for _, addr := range []string{"/ip4/1.2.3.4/tcp/7000", "/ip4/5.6.7.8/tcp/7000"} {
+		maddr, err := ma.NewMultiaddr(addr)
+		require.NoError(t, err)
+		require.False(t, testApp.P2p.GatingState.InterceptAddrDial(id, maddr))
+	}
+
+	ret, err := (&getGatingEventsMsg{Limit: 2}).run(context.Background(), testApp)
+	require.NoError(t, err)
+
+	events := ret.([]gatingEventJson)
+	require.Len(t, events, 2)
+	require.Equal(t, "/ip4/1.2.3.4/tcp/7000", events[0].Addr)
+	require.Equal(t, "banned_ip", events[0].Rule)
+	require.Equal(t, "/ip4/5.6.7.8/tcp/7000", events[1].Addr)
+	require.Equal(t, "isolate", events[1].Rule)
+	for _, event := range events {
+		require.Equal(t, "addr_dial", event.Stage)
+		require.False(t, event.Allowed)
+		require.Equal(t, peer.Encode(id), event.PeerID)
+	}
+}
+
+func TestSetGatingConfigMsg_BanAfterConnect(t *testing.T) {
+	appA := newTestApp(t, nil)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, nil)
+	appBInfos, err := addrInfos(appB.P2p.Host)
+	require.NoError(t, err)
+
+	err = appB.P2p.Host.Connect(appB.Ctx, appAInfos[0])
+	require.NoError(t, err)
+
+	msg := &setGatingConfigMsg{BannedPeerIDs: []string{appB.P2p.Host.ID().String()}}
+	_, err = msg.run(context.Background(), appA)
+	require.NoError(t, err)
+
+	// the ban applies to the connection made before it
+	require.Eventually(t, func() bool {
+		return len(appB.P2p.Host.Network().ConnsToPeer(appA.P2p.Host.ID())) == 0
+	}, testTimeout, 10*time.Millisecond)
+
+	// and to new ones, in both directions
+	err = appA.P2p.Host.Connect(appA.Ctx, appBInfos[0])
+	require.Equal(t, codanet.ErrCodeGated, codanet.ClassifyError(err))
+
+	_ = appB.P2p.Host.Connect(appB.Ctx, appAInfos[0])
+	require.Empty(t, appA.P2p.Host.Network().ConnsToPeer(appB.P2p.Host.ID()))
+}
+
+func TestSetGatingConfigMsg_UpgradePolicy(t *testing.T) {
+	appA := newTestApp(t, nil)
+	appA.NoUpcalls = false
+	appA.OutQueue = newOutQueue(defaultOutQueueSize, overflowBlock)
+	appA.P2p.GatingState.OnUpgradeRejected = appA.upgradeRejected
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, nil)
+
+	msg := &setGatingConfigMsg{MaxConnsPerIP: -1}
+	_, err = msg.run(context.Background(), appA)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+
+	// appB offers noise before tls
+	msg = &setGatingConfigMsg{TrustedIPs: []string{"127.0.0.1"}, AllowedSecurity: []string{"/tls/1.0.0"}}
+	_, err = msg.run(context.Background(), appA)
+	require.NoError(t, err)
+
+	// the daemon never heard of appB, so it isn't told appB disconnected
+	_ = appB.P2p.Host.Connect(appB.Ctx, appAInfos[0])
+	require.Empty(t, appA.P2p.Host.Network().ConnsToPeer(appB.P2p.Host.ID()))
+	require.Empty(t, appA.OutQueue.drain())
+
+	// nor is it when a second connection of a peer it knows as connected is
+	// rejected
+	msg = &setGatingConfigMsg{TrustedIPs: []string{"127.0.0.1"}}
+	_, err = msg.run(context.Background(), appA)
+	require.NoError(t, err)
+	require.NoError(t, appB.P2p.Host.Connect(appB.Ctx, appAInfos[0]))
+	require.Eventually(t, func() bool {
+		return appA.P2p.ConnectionManager.IsReported(appB.P2p.Host.ID())
+	}, testTimeout, 10*time.Millisecond)
+	// as beginAdvertising would
+	appA.P2p.ConnectionManager.OnDisconnect = func(_ net.Network, c net.Conn, reason string) {
+		appA.writeMsg(peerConnectionUpcall{ID: peer.Encode(c.RemotePeer()), Upcall: "peerDisconnected", Reason: reason})
+	}
+
+	msg = &setGatingConfigMsg{TrustedIPs: []string{"127.0.0.1"}, AllowedSecurity: []string{"/tls/1.0.0"}}
+	_, err = msg.run(context.Background(), appA)
+	require.NoError(t, err)
+	// the host only makes one connection to a peer, so appB dials another
+	// through its transport
+	addr := appAInfos[0].Addrs[0]
+	tpt := appB.P2p.Host.Network().(*swarm.Swarm).TransportForDialing(addr)
+	rejected, err := tpt.Dial(appB.Ctx, addr, appA.P2p.Host.ID())
+	require.Eventually(t, func() bool {
+		for _, event := range appA.P2p.GatingState.Events() {
+			if event.Stage == codanet.StageUpgraded && !event.Allowed {
+				return true
+			}
+		}
+		return false
+	}, testTimeout, 10*time.Millisecond)
+	if err == nil {
+		_ = rejected.Close()
+	}
+	conns := appA.P2p.Host.Network().ConnsToPeer(appB.P2p.Host.ID())
+	require.Len(t, conns, 1)
+	appA.upgradeRejected(conns[0], codanet.DisconnectSecurityNotAllowed)
+	require.Empty(t, appA.OutQueue.drain())
+
+	// once the peer's last connection is gone, the daemon is told it
+	// disconnected, by whichever of the rejection and the closed connection
+	// comes first
+	require.NoError(t, conns[0].Close())
+	appA.upgradeRejected(conns[0], codanet.DisconnectSecurityNotAllowed)
+	upcall, ok := nextMsg(t, appA).(peerConnectionUpcall)
+	require.True(t, ok)
+	require.Equal(t, "peerDisconnected", upcall.Upcall)
+	require.Equal(t, peer.Encode(appB.P2p.Host.ID()), upcall.ID)
+	require.False(t, appA.P2p.ConnectionManager.IsReported(appB.P2p.Host.ID()))
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, appA.OutQueue.drain())
+}
+
+func TestSetGatingConfigMsg_InboundLimits(t *testing.T) {
+	testApp := newTestApp(t, nil)
+
+	msg := &setGatingConfigMsg{MaxInboundPerIP: 2, MaxInboundPerSubnet: 8}
+	_, err := msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Equal(t, codanet.InboundLimits{PerIP: 2, PerSubnet: 8}, testApp.P2p.GatingState.InboundLimits)
+
+	msg = &setGatingConfigMsg{MaxInboundPerSubnet: -1}
+	_, err = msg.run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+}
+
 func TestGetPeerMessage(t *testing.T) {
 	codanet.NoDHT = true
 	defer func() {
@@ -955,7 +1651,354 @@ func TestGetNodeStatus(t *testing.T) {
 		PeerMultiaddr: maStrs[0].String(),
 	}
 
-	ret, err := msg.run(appC)
+	ret, err := msg.run(context.Background(), appC)
 	require.NoError(t, err)
 	require.Equal(t, appA.P2p.NodeStatus, ret)
 }
+
+func TestShutdownMsg(t *testing.T) {
+	var err error
+	appA := newTestApp(t, nil)
+	appA.P2p.Pubsub, err = pubsub.NewGossipSub(appA.Ctx, appA.P2p.Host)
+	require.NoError(t, err)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, appAInfos)
+	err = appB.P2p.Host.Connect(appB.Ctx, appAInfos[0])
+	require.NoError(t, err)
+
+	_, err = (&subscribeMsg{Topic: "testtopic", Subscription: 0}).run(context.Background(), appA)
+	require.NoError(t, err)
+
+	go func() {
+		seqs <- 1
+	}()
+	_, err = (&openStreamMsg{Peer: appB.P2p.Host.ID().String(), ProtocolID: string(testProtocol)}).run(context.Background(), appA)
+	require.NoError(t, err)
+
+	ret, err := (&shutdownMsg{}).run(context.Background(), appA)
+	require.NoError(t, err)
+	require.Equal(t, "shutdown success", ret)
+
+	require.Empty(t, appA.Subs)
+	require.Empty(t, appA.SubValidators)
+	require.Empty(t, appA.Topics)
+	require.Empty(t, appA.Streams)
+	require.Empty(t, appA.P2p.Host.Network().Conns())
+	require.Eventually(t, func() bool {
+		return len(appB.P2p.Host.Network().ConnsToPeer(appA.P2p.Host.ID())) == 0
+	}, testTimeout, 10*time.Millisecond)
+}
+
+// TestUpcallNames checks that upcallNames, which hello hands the daemon,
+// covers every upcall the helper's code sends
+func TestUpcallNames(t *testing.T) {
+	consts := map[string]string{
+		"upcallValidateBatch": upcallValidateBatch,
+		"upcallShutdown":      upcallShutdown,
+		"upcallBanExpired":    upcallBanExpired,
+	}
+
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	require.NoError(t, err)
+
+	sent := make(map[string]bool)
+	for _, pkg := range pkgs {
+		ast.Inspect(pkg, func(node ast.Node) bool {
+			kv, ok := node.(*ast.KeyValueExpr)
+			if !ok {
+				return true
+			}
+			if key, ok := kv.Key.(*ast.Ident); !ok || key.Name != "Upcall" {
+				return true
+			}
+			switch value := kv.Value.(type) {
+			case *ast.BasicLit:
+				name, err := strconv.Unquote(value.Value)
+				require.NoError(t, err)
+				sent[name] = true
+			case *ast.Ident:
+				name, ok := consts[value.Name]
+				require.True(t, ok, value.Name)
+				sent[name] = true
+			default:
+				t.Fatalf("can't tell which upcall %s sends", fset.Position(kv.Pos()))
+			}
+			return true
+		})
+	}
+
+	var names []string
+	for name := range sent {
+		names = append(names, name)
+	}
+	require.ElementsMatch(t, names, upcallNames())
+}
+
+func TestHelloMsg(t *testing.T) {
+	testApp := newApp()
+
+	msg := &helloMsg{
+		ProtocolVersion: protocolVersion,
+		Methods:         []string{"configure", "publish"},
+		Upcalls:         requiredUpcalls,
+	}
+
+	ret, err := msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+	res, ok := ret.(helloResult)
+	require.True(t, ok)
+	require.Equal(t, protocolVersion, res.ProtocolVersion)
+	require.Contains(t, res.Methods, "hello")
+	require.Contains(t, res.Methods, "getPeerNodeStatus")
+	require.Contains(t, res.Upcalls, "peerConnected")
+	require.Contains(t, res.Upcalls, upcallValidateBatch)
+
+	// the optional upcalls are only sent to a daemon that handles them
+	require.False(t, testApp.handles(upcallShutdown))
+	_, err = (&shutdownMsg{}).run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	msg.Upcalls = upcallNames()
+	_, err = msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.True(t, testApp.handles(upcallShutdown))
+
+	// but the daemon must handle every required one
+	msg.Upcalls = []string{"validate"}
+	_, err = msg.run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeUnknownMethod, codeOf(err))
+	require.Contains(t, err.Error(), "peerConnected")
+	msg.Upcalls = requiredUpcalls
+
+	msg.ProtocolVersion = protocolVersion + 1
+	_, err = msg.run(context.Background(), testApp)
+	require.Error(t, err)
+
+	msg.ProtocolVersion = protocolVersion
+	msg.Methods = []string{"configure", "teleport"}
+	_, err = msg.run(context.Background(), testApp)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "teleport")
+}
+
+func TestServeRequiresHello(t *testing.T) {
+	for _, mode := range wireModes {
+		testApp := newApp()
+
+		headers := []string{
+			`{"seqno":1,"method":"generateKeypair","body":{}}`,
+			fmt.Sprintf(`{"seqno":2,"method":"hello","body":%s}`, helloBody("generateKeypair")),
+			`{"seqno":3,"method":"generateKeypair","body":{}}`,
+		}
+		requests, _ := newCodec(mode, encodeRequests(t, mode, headers), bufio.NewWriter(ioutil.Discard))
+		require.NoError(t, serve(testApp, requests), mode.String())
+
+		var refused errorResult
+		roundTrip(t, mode, nextMsg(t, testApp), &refused)
+		require.Equal(t, 1, refused.Seqno, mode.String())
+		require.Contains(t, refused.Errorr, "hello must be the first call", mode.String())
+
+		var greeted successResult
+		roundTrip(t, mode, nextMsg(t, testApp), &greeted)
+		require.Equal(t, 2, greeted.Seqno, mode.String())
+
+		var keypair struct {
+			Seqno   int              `json:"seqno"`
+			Success generatedKeypair `json:"success"`
+		}
+		roundTrip(t, mode, nextMsg(t, testApp), &keypair)
+		require.Equal(t, 3, keypair.Seqno, mode.String())
+		require.NotEmpty(t, keypair.Success.PeerID, mode.String())
+	}
+}
+
+func TestParseRequestErrors(t *testing.T) {
+	for _, tc := range []struct {
+		header string
+		seqno  int
+		code   codanet.ErrorCode
+	}{
+		{`{"seqno":1,"method":"teleport","body":{}}`, 1, codanet.ErrCodeUnknownMethod},
+		{`{"seqno":2,"method":"closeStream","body":{"stream_idx":"one"}}`, 2, codanet.ErrCodeBadInput},
+		{`{"seqno":3,"method":"closeStream"}`, 3, codanet.ErrCodeBadInput},
+		{`{"seqno":4,"method":7,"body":{}}`, 4, codanet.ErrCodeBadInput},
+		{`{"seqno":5,"method":"closeStream","body":`, 0, codanet.ErrCodeBadInput},
+		{`[]`, 0, codanet.ErrCodeBadInput},
+		{`{"seqno":6,"method":"listPeers","body":{},"deadline_ms":-1}`, 6, codanet.ErrCodeBadInput},
+	} {
+		env, msg, err := parseRequest(&request{Header: []byte(tc.header)})
+		require.Error(t, err, tc.header)
+		require.Nil(t, msg)
+		require.Equal(t, tc.seqno, env.Seqno, tc.header)
+		require.Equal(t, tc.code, codeOf(err), tc.header)
+	}
+}
+
+func TestErrorCodes(t *testing.T) {
+	unconfigured := newApp()
+	for _, msg := range []action{
+		&listenMsg{},
+		&publishMsg{},
+		&closeStreamMsg{},
+		&setNodeStatusMsg{},
+		&getPeerNodeStatusMsg{},
+	} {
+		_, err := msg.run(context.Background(), unconfigured)
+		require.Equal(t, codanet.ErrCodeNotConfigured, codeOf(err), "%T", msg)
+	}
+
+	app := newTestApp(t, nil)
+	for _, tc := range []struct {
+		msg  action
+		code codanet.ErrorCode
+	}{
+		{&closeStreamMsg{StreamIdx: 42}, codanet.ErrCodeUnknownStream},
+		{&resetStreamMsg{StreamIdx: 42}, codanet.ErrCodeUnknownStream},
+		{&sendStreamMsgMsg{StreamIdx: 42, Data: []byte("hi")}, codanet.ErrCodeUnknownStream},
+		{&unsubscribeMsg{Subscription: 42}, codanet.ErrCodeUnknownSubscription},
+		{&validationCompleteMsg{Seqno: 42, Valid: "accept"}, codanet.ErrCodeUnknownValidation},
+		{&findPeerMsg{PeerID: "not a peer id"}, codanet.ErrCodeBadInput},
+		{&helloMsg{ProtocolVersion: protocolVersion + 1}, codanet.ErrCodeVersionMismatch},
+	} {
+		_, err := tc.msg.run(context.Background(), app)
+		require.Error(t, err, "%T", tc.msg)
+		require.Equal(t, tc.code, codeOf(err), "%T", tc.msg)
+	}
+
+	// the peer's transport is no fault of the caller
+	_, err := parseMultiaddrWithID(ma.StringCast("/dns4/example.com/tcp/8302"), app.P2p.Me)
+	require.Equal(t, codanet.ErrCodeLibp2p, codeOf(err))
+	_, err = parseMultiaddrWithID(ma.StringCast("/ip4/127.0.0.1/udp/8302"), app.P2p.Me)
+	require.Equal(t, codanet.ErrCodeLibp2p, codeOf(err))
+
+	require.Equal(t, codanet.ErrCodeInternal, codeOf(errors.New("uncategorized")))
+}
+
+// nextMsg returns the next result or upcall the app writes
+func nextMsg(t *testing.T, app *app) interface{} {
+	ch := make(chan interface{}, 1)
+	go func() {
+		ch <- app.OutQueue.pop()
+	}()
+
+	select {
+	case msg := <-ch:
+		return msg
+	case <-time.After(testTimeout):
+		t.Fatal("no result or upcall written")
+		return nil
+	}
+}
+
+// blockingMsg runs until its request is cancelled
+type blockingMsg struct {
+	started chan struct{}
+}
+
+func (m *blockingMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	close(m.started)
+	<-ctx.Done()
+	return nil, badp2p(ctx.Err())
+}
+
+func TestCancelRequestMsg(t *testing.T) {
+	for _, mode := range wireModes {
+		app := newApp()
+
+		msg := &blockingMsg{started: make(chan struct{})}
+		go handleRequest(app, envelope{Seqno: 1}, msg)
+		<-msg.started
+
+		ret, err := (&cancelRequestMsg{Seqno: 1}).run(context.Background(), app)
+		require.NoError(t, err)
+		require.Equal(t, "cancelRequest success", ret)
+
+		var res errorResult
+		roundTrip(t, mode, nextMsg(t, app), &res)
+		require.Equal(t, 1, res.Seqno, mode.String())
+		require.Equal(t, codanet.ErrCodeCancelled, res.Code, mode.String())
+
+		require.Eventually(t, func() bool {
+			app.PendingMutex.Lock()
+			defer app.PendingMutex.Unlock()
+			return len(app.Pending) == 0
+		}, testTimeout, 10*time.Millisecond)
+
+		_, err = (&cancelRequestMsg{Seqno: 1}).run(context.Background(), app)
+		require.Equal(t, codanet.ErrCodeUnknownRequest, codeOf(err))
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	for _, mode := range wireModes {
+		requests, _ := newCodec(mode, encodeRequests(t, mode, []string{`{"seqno":2,"method":"listPeers","body":{},"deadline_ms":50}`}), bufio.NewWriter(ioutil.Discard))
+		req, err := requests.next()
+		require.NoError(t, err)
+		env, _, err := parseRequest(req)
+		require.NoError(t, err)
+		require.Equal(t, 50*time.Millisecond, env.timeout(), mode.String())
+
+		app := newApp()
+		msg := &blockingMsg{started: make(chan struct{})}
+		go handleRequest(app, env, msg)
+
+		var res errorResult
+		roundTrip(t, mode, nextMsg(t, app), &res)
+		require.Equal(t, 2, res.Seqno, mode.String())
+		require.Equal(t, codanet.ErrCodeTimeout, res.Code, mode.String())
+	}
+}
+
+// TestParseRequestFuzz feeds randomly mutated envelopes through the parser
+// and the main loop, which must neither panic nor stop serving.
+func TestParseRequestFuzz(t *testing.T) {
+	seeds := []string{
+		`{"seqno":1,"method":"generateKeypair","body":{}}`,
+		`{"seqno":2,"method":"publish","body":{"topic":"test","data":"dGVzdA=="}}`,
+		`{"seqno":3,"method":"subscribe","body":{"topic":"test","subscription_idx":0}}`,
+		`{"seqno":4,"method":"setGatingConfig","body":{"banned_ips":["1.2.3.4"],"banned_peers":[],"trusted_peers":[],"trusted_ips":[],"isolate":false}}`,
+		`{"seqno":5,"method":"validationComplete","body":{"seqno":1,"is_valid":"accept"}}`,
+	}
+
+	rng := rand.New(rand.NewSource(1))
+	mutate := func(b []byte) []byte {
+		b = append([]byte(nil), b...)
+		for n := rng.Intn(4) + 1; n > 0 && len(b) > 0; n-- {
+			i := rng.Intn(len(b))
+			switch rng.Intn(4) {
+			case 0:
+				b[i] = byte(rng.Intn(256))
+			case 1:
+				b = b[:i]
+			case 2:
+				b = append(b[:i], b[i+1:]...)
+			case 3:
+				b = append(b[:i], append([]byte{"{}[]\":,0"[rng.Intn(8)]}, b[i:]...)...)
+			}
+		}
+		return b
+	}
+
+	// greet first so that mutated calls which still parse get dispatched too
+	headers := []string{fmt.Sprintf(`{"seqno":0,"method":"hello","body":%s}`, helloBody())}
+	for i := 0; i < 5000; i++ {
+		input := mutate([]byte(seeds[rng.Intn(len(seeds))]))
+		require.NotPanics(t, func() {
+			_, _, _ = parseRequest(&request{Header: input})
+		}, "input %q", input)
+		if !bytes.ContainsRune(input, '\n') {
+			headers = append(headers, string(input))
+		}
+	}
+
+	for _, mode := range wireModes {
+		testApp := newApp()
+		testApp.NoUpcalls = true
+		requests, _ := newCodec(mode, encodeRequests(t, mode, headers), bufio.NewWriter(ioutil.Discard))
+		require.NoError(t, serve(testApp, requests), mode.String())
+	}
+}
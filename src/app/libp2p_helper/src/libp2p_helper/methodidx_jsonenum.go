@@ -9,51 +9,81 @@ import (
 
 var (
 	_methodIdxNameToValue = map[string]methodIdx{
-		"configure":            configure,
-		"listen":               listen,
-		"publish":              publish,
-		"subscribe":            subscribe,
-		"unsubscribe":          unsubscribe,
-		"validationComplete":   validationComplete,
-		"generateKeypair":      generateKeypair,
-		"openStream":           openStream,
-		"closeStream":          closeStream,
-		"resetStream":          resetStream,
-		"sendStreamMsg":        sendStreamMsg,
-		"removeStreamHandler":  removeStreamHandler,
-		"addStreamHandler":     addStreamHandler,
-		"listeningAddrs":       listeningAddrs,
-		"addPeer":              addPeer,
-		"beginAdvertising":     beginAdvertising,
-		"findPeer":             findPeer,
-		"listPeers":            listPeers,
-		"setGatingConfig":      setGatingConfig,
-		"setNodeStatus":        setNodeStatus,
-		"getPeerNodeStatus":    getPeerNodeStatus,
+		"configure":                  configure,
+		"listen":                     listen,
+		"publish":                    publish,
+		"subscribe":                  subscribe,
+		"unsubscribe":                unsubscribe,
+		"validationComplete":         validationComplete,
+		"generateKeypair":            generateKeypair,
+		"openStream":                 openStream,
+		"closeStream":                closeStream,
+		"resetStream":                resetStream,
+		"sendStreamMsg":              sendStreamMsg,
+		"removeStreamHandler":        removeStreamHandler,
+		"addStreamHandler":           addStreamHandler,
+		"listeningAddrs":             listeningAddrs,
+		"addPeer":                    addPeer,
+		"beginAdvertising":           beginAdvertising,
+		"findPeer":                   findPeer,
+		"listPeers":                  listPeers,
+		"setGatingConfig":            setGatingConfig,
+		"setNodeStatus":              setNodeStatus,
+		"getPeerNodeStatus":          getPeerNodeStatus,
+		"hello":                      hello,
+		"cancelRequest":              cancelRequest,
+		"shutdown":                   shutdown,
+		"reconfigure":                reconfigure,
+		"listBans":                   listBans,
+		"getGatingEvents":            getGatingEvents,
+		"getConnectionManagerStatus": getConnectionManagerStatus,
+		"protectPeer":                protectPeer,
+		"unprotectPeer":              unprotectPeer,
+		"tagPeer":                    tagPeer,
+		"untagPeer":                  untagPeer,
+		"registerDecayingTag":        registerDecayingTag,
+		"bumpDecayingTag":            bumpDecayingTag,
+		"getPeerScores":              getPeerScores,
+		"validationCompleteBatch":    validationCompleteBatch,
 	}
 
 	_methodIdxValueToName = map[methodIdx]string{
-		configure:            "configure",
-		listen:               "listen",
-		publish:              "publish",
-		subscribe:            "subscribe",
-		unsubscribe:          "unsubscribe",
-		validationComplete:   "validationComplete",
-		generateKeypair:      "generateKeypair",
-		openStream:           "openStream",
-		closeStream:          "closeStream",
-		resetStream:          "resetStream",
-		sendStreamMsg:        "sendStreamMsg",
-		removeStreamHandler:  "removeStreamHandler",
-		addStreamHandler:     "addStreamHandler",
-		listeningAddrs:       "listeningAddrs",
-		addPeer:              "addPeer",
-		beginAdvertising:     "beginAdvertising",
-		findPeer:             "findPeer",
-		listPeers:            "listPeers",
-		setGatingConfig:      "setGatingConfig",
-		setNodeStatus:        "setNodeStatus",
-		getPeerNodeStatus:    "getPeerNodeStatus",
+		configure:                  "configure",
+		listen:                     "listen",
+		publish:                    "publish",
+		subscribe:                  "subscribe",
+		unsubscribe:                "unsubscribe",
+		validationComplete:         "validationComplete",
+		generateKeypair:            "generateKeypair",
+		openStream:                 "openStream",
+		closeStream:                "closeStream",
+		resetStream:                "resetStream",
+		sendStreamMsg:              "sendStreamMsg",
+		removeStreamHandler:        "removeStreamHandler",
+		addStreamHandler:           "addStreamHandler",
+		listeningAddrs:             "listeningAddrs",
+		addPeer:                    "addPeer",
+		beginAdvertising:           "beginAdvertising",
+		findPeer:                   "findPeer",
+		listPeers:                  "listPeers",
+		setGatingConfig:            "setGatingConfig",
+		setNodeStatus:              "setNodeStatus",
+		getPeerNodeStatus:          "getPeerNodeStatus",
+		hello:                      "hello",
+		cancelRequest:              "cancelRequest",
+		shutdown:                   "shutdown",
+		reconfigure:                "reconfigure",
+		listBans:                   "listBans",
+		getGatingEvents:            "getGatingEvents",
+		getConnectionManagerStatus: "getConnectionManagerStatus",
+		protectPeer:                "protectPeer",
+		unprotectPeer:              "unprotectPeer",
+		tagPeer:                    "tagPeer",
+		untagPeer:                  "untagPeer",
+		registerDecayingTag:        "registerDecayingTag",
+		bumpDecayingTag:            "bumpDecayingTag",
+		getPeerScores:              "getPeerScores",
+		validationCompleteBatch:    "validationCompleteBatch",
 	}
 )
 
@@ -61,27 +91,42 @@ func init() {
 	var v methodIdx
 	if _, ok := interface{}(v).(fmt.Stringer); ok {
 		_methodIdxNameToValue = map[string]methodIdx{
-			interface{}(configure).(fmt.Stringer).String():            configure,
-			interface{}(listen).(fmt.Stringer).String():               listen,
-			interface{}(publish).(fmt.Stringer).String():              publish,
-			interface{}(subscribe).(fmt.Stringer).String():            subscribe,
-			interface{}(unsubscribe).(fmt.Stringer).String():          unsubscribe,
-			interface{}(validationComplete).(fmt.Stringer).String():   validationComplete,
-			interface{}(generateKeypair).(fmt.Stringer).String():      generateKeypair,
-			interface{}(openStream).(fmt.Stringer).String():           openStream,
-			interface{}(closeStream).(fmt.Stringer).String():          closeStream,
-			interface{}(resetStream).(fmt.Stringer).String():          resetStream,
-			interface{}(sendStreamMsg).(fmt.Stringer).String():        sendStreamMsg,
-			interface{}(removeStreamHandler).(fmt.Stringer).String():  removeStreamHandler,
-			interface{}(addStreamHandler).(fmt.Stringer).String():     addStreamHandler,
-			interface{}(listeningAddrs).(fmt.Stringer).String():       listeningAddrs,
-			interface{}(addPeer).(fmt.Stringer).String():              addPeer,
-			interface{}(beginAdvertising).(fmt.Stringer).String():     beginAdvertising,
-			interface{}(findPeer).(fmt.Stringer).String():             findPeer,
-			interface{}(listPeers).(fmt.Stringer).String():            listPeers,
-			interface{}(setGatingConfig).(fmt.Stringer).String():      setGatingConfig,
-			interface{}(setNodeStatus).(fmt.Stringer).String():        setNodeStatus,
-			interface{}(getPeerNodeStatus).(fmt.Stringer).String():    getPeerNodeStatus,
+			interface{}(configure).(fmt.Stringer).String():                  configure,
+			interface{}(listen).(fmt.Stringer).String():                     listen,
+			interface{}(publish).(fmt.Stringer).String():                    publish,
+			interface{}(subscribe).(fmt.Stringer).String():                  subscribe,
+			interface{}(unsubscribe).(fmt.Stringer).String():                unsubscribe,
+			interface{}(validationComplete).(fmt.Stringer).String():         validationComplete,
+			interface{}(generateKeypair).(fmt.Stringer).String():            generateKeypair,
+			interface{}(openStream).(fmt.Stringer).String():                 openStream,
+			interface{}(closeStream).(fmt.Stringer).String():                closeStream,
+			interface{}(resetStream).(fmt.Stringer).String():                resetStream,
+			interface{}(sendStreamMsg).(fmt.Stringer).String():              sendStreamMsg,
+			interface{}(removeStreamHandler).(fmt.Stringer).String():        removeStreamHandler,
+			interface{}(addStreamHandler).(fmt.Stringer).String():           addStreamHandler,
+			interface{}(listeningAddrs).(fmt.Stringer).String():             listeningAddrs,
+			interface{}(addPeer).(fmt.Stringer).String():                    addPeer,
+			interface{}(beginAdvertising).(fmt.Stringer).String():           beginAdvertising,
+			interface{}(findPeer).(fmt.Stringer).String():                   findPeer,
+			interface{}(listPeers).(fmt.Stringer).String():                  listPeers,
+			interface{}(setGatingConfig).(fmt.Stringer).String():            setGatingConfig,
+			interface{}(setNodeStatus).(fmt.Stringer).String():              setNodeStatus,
+			interface{}(getPeerNodeStatus).(fmt.Stringer).String():          getPeerNodeStatus,
+			interface{}(hello).(fmt.Stringer).String():                      hello,
+			interface{}(cancelRequest).(fmt.Stringer).String():              cancelRequest,
+			interface{}(shutdown).(fmt.Stringer).String():                   shutdown,
+			interface{}(reconfigure).(fmt.Stringer).String():                reconfigure,
+			interface{}(listBans).(fmt.Stringer).String():                   listBans,
+			interface{}(getGatingEvents).(fmt.Stringer).String():            getGatingEvents,
+			interface{}(getConnectionManagerStatus).(fmt.Stringer).String(): getConnectionManagerStatus,
+			interface{}(protectPeer).(fmt.Stringer).String():                protectPeer,
+			interface{}(unprotectPeer).(fmt.Stringer).String():              unprotectPeer,
+			interface{}(tagPeer).(fmt.Stringer).String():                    tagPeer,
+			interface{}(untagPeer).(fmt.Stringer).String():                  untagPeer,
+			interface{}(registerDecayingTag).(fmt.Stringer).String():        registerDecayingTag,
+			interface{}(bumpDecayingTag).(fmt.Stringer).String():            bumpDecayingTag,
+			interface{}(getPeerScores).(fmt.Stringer).String():              getPeerScores,
+			interface{}(validationCompleteBatch).(fmt.Stringer).String():    validationCompleteBatch,
 		}
 	}
 }
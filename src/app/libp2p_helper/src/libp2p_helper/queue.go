@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Results and upcalls wait in an outQueue until they are written to the
+// daemon. If the daemon is slow to read, the queue makes sure the messages
+// the helper is blocked on (RPC results, validation requests) overtake bulk
+// stream data, and its overflow policy decides what gives when it fills up.
+
+type msgPriority int
+
+const (
+	// results and validation requests, which goroutines are waiting on
+	priorityHigh msgPriority = iota
+	// other upcalls, e.g. about peers and new streams
+	priorityNormal
+	// stream data, along with the upcalls that end a stream and the results
+	// of calls on a stream (see pushResult) so that those never overtake its
+	// data
+	priorityStream
+
+	numPriorities
+)
+
+func (p msgPriority) String() string {
+	switch p {
+	case priorityHigh:
+		return "high"
+	case priorityNormal:
+		return "normal"
+	case priorityStream:
+		return "stream"
+	default:
+		return fmt.Sprintf("%d", int(p))
+	}
+}
+
+func priorityOf(msg interface{}) msgPriority {
+	switch msg.(type) {
+	case successResult, errorResult, *validateUpcall, *validateBatchUpcall:
+		return priorityHigh
+	case *incomingMsgUpcall, streamLostUpcall, streamReadCompleteUpcall:
+		return priorityStream
+	default:
+		return priorityNormal
+	}
+}
+
+// streamOf returns the index of the stream msg is about, if any
+func streamOf(msg interface{}) (int, bool) {
+	switch m := msg.(type) {
+	case *incomingMsgUpcall:
+		return m.StreamIdx, true
+	case streamLostUpcall:
+		return m.StreamIdx, true
+	case streamReadCompleteUpcall:
+		return m.StreamIdx, true
+	default:
+		return 0, false
+	}
+}
+
+type overflowPolicy string
+
+const (
+	// writers wait for the daemon to catch up
+	overflowBlock overflowPolicy = "block"
+	// the stream with the oldest queued data is reset, its queued data
+	// dropped and a streamLost upcall sent in its place. If no stream data is
+	// queued, writers wait as with overflowBlock.
+	overflowDropOldestStreamData overflowPolicy = "drop-oldest-stream-data"
+)
+
+const defaultOutQueueSize = 4096
+
+var outQueueDepthMetric = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "out_queue_depth",
+	Help: "Number of results and upcalls waiting to be written to the daemon, by priority.",
+}, []string{"priority"})
+
+func init() {
+	prometheus.MustRegister(outQueueDepthMetric)
+}
+
+type outQueue struct {
+	mutex    sync.Mutex
+	nonEmpty *sync.Cond
+	nonFull  *sync.Cond
+	queues   [numPriorities][]interface{}
+	size     int
+	capacity int
+	policy   overflowPolicy
+	// streams whose data was dropped; any further upcalls about them are
+	// too, until the end of their reads
+	lost map[int]bool
+	// called, without the queue locked, with the index of each stream whose
+	// data was dropped
+	onStreamDropped func(streamIdx int)
+}
+
+func newOutQueue(capacity int, policy overflowPolicy) *outQueue {
+	q := &outQueue{
+		capacity:        capacity,
+		policy:          policy,
+		lost:            make(map[int]bool),
+		onStreamDropped: func(int) {},
+	}
+	q.nonEmpty = sync.NewCond(&q.mutex)
+	q.nonFull = sync.NewCond(&q.mutex)
+	return q
+}
+
+// configure changes the capacity (if positive) and the overflow policy
+func (q *outQueue) configure(capacity int, policy overflowPolicy) error {
+	if policy != overflowBlock && policy != overflowDropOldestStreamData {
+		return fmt.Errorf("unknown out queue policy %q", policy)
+	}
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if capacity > 0 {
+		q.capacity = capacity
+	}
+	q.policy = policy
+	q.nonFull.Broadcast()
+	return nil
+}
+
+func (q *outQueue) push(msg interface{}) {
+	q.pushBehind(msg, nil)
+}
+
+// pushResult queues msg, the result of a call on stream streamIdx. Should
+// data of that stream still be queued, the result waits behind it, so that
+// e.g. the daemon never sees a stream closed before its last data.
+func (q *outQueue) pushResult(msg interface{}, streamIdx int) {
+	q.pushBehind(msg, &streamIdx)
+}
+
+func (q *outQueue) pushBehind(msg interface{}, stream *int) {
+	var dropped []int
+	defer func() {
+		for _, idx := range dropped {
+			q.onStreamDropped(idx)
+		}
+	}()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if idx, ok := streamOf(msg); ok && q.lost[idx] {
+		// nothing follows the end of a stream's reads, so there is no
+		// need to remember it any longer
+		if _, ok := msg.(streamReadCompleteUpcall); ok {
+			delete(q.lost, idx)
+		}
+		return
+	}
+
+	for q.size >= q.capacity {
+		if q.policy == overflowDropOldestStreamData {
+			if idx, ok := q.dropOldestStream(); ok {
+				dropped = append(dropped, idx)
+				continue
+			}
+		}
+		q.nonFull.Wait()
+	}
+
+	p := priorityOf(msg)
+	if stream != nil && q.hasStreamData(*stream) {
+		p = priorityStream
+	}
+	q.enqueue(p, msg)
+}
+
+// hasStreamData reports whether anything about stream idx is queued. The
+// caller must hold the lock.
+func (q *outQueue) hasStreamData(idx int) bool {
+	for _, msg := range q.queues[priorityStream] {
+		if i, ok := streamOf(msg); ok && i == idx {
+			return true
+		}
+	}
+	return false
+}
+
+// dropOldestStream drops all queued data of the stream with the oldest queued
+// data, replacing it with a streamLost upcall. The caller must hold the lock.
+func (q *outQueue) dropOldestStream() (int, bool) {
+	var victim int
+	found := false
+	for _, msg := range q.queues[priorityStream] {
+		if m, ok := msg.(*incomingMsgUpcall); ok {
+			victim, found = m.StreamIdx, true
+			break
+		}
+	}
+	if !found {
+		return 0, false
+	}
+
+	kept := q.queues[priorityStream][:0]
+	readsDone := false
+	for _, msg := range q.queues[priorityStream] {
+		if idx, ok := streamOf(msg); ok && idx == victim {
+			if _, ok := msg.(streamReadCompleteUpcall); ok {
+				readsDone = true
+			}
+			continue
+		}
+		kept = append(kept, msg)
+	}
+	q.size -= len(q.queues[priorityStream]) - len(kept)
+	q.queues[priorityStream] = kept
+	// once its reads are done nothing more about the stream will come
+	if !readsDone {
+		q.lost[victim] = true
+	}
+
+	// the notice may take the queue slightly over capacity, since there is
+	// at most one per stream
+	q.enqueue(priorityStream, streamLostUpcall{
+		Upcall:    "streamLost",
+		StreamIdx: victim,
+		Reason:    "dropped stream data because the daemon is not keeping up",
+	})
+	return victim, true
+}
+
+func (q *outQueue) enqueue(p msgPriority, msg interface{}) {
+	q.queues[p] = append(q.queues[p], msg)
+	q.size++
+	q.updateMetrics()
+	q.nonEmpty.Signal()
+}
+
+// pop blocks until a message is queued and returns the one to write next
+func (q *outQueue) pop() interface{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.size == 0 {
+		q.nonEmpty.Wait()
+	}
+
+	for p := range q.queues {
+		if len(q.queues[p]) == 0 {
+			continue
+		}
+		msg := q.queues[p][0]
+		q.queues[p][0] = nil
+		q.queues[p] = q.queues[p][1:]
+		q.size--
+		q.updateMetrics()
+		q.nonFull.Signal()
+		return msg
+	}
+	panic("out queue size is out of sync with its contents")
+}
+
+// drain empties the queue without blocking, returning its messages in the
+// order pop would have
+func (q *outQueue) drain() []interface{} {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var msgs []interface{}
+	for p := range q.queues {
+		msgs = append(msgs, q.queues[p]...)
+		q.queues[p] = nil
+	}
+	q.size = 0
+	q.updateMetrics()
+	q.nonFull.Broadcast()
+	return msgs
+}
+
+func (q *outQueue) updateMetrics() {
+	for p := range q.queues {
+		outQueueDepthMetric.WithLabelValues(msgPriority(p).String()).Set(float64(len(q.queues[p])))
+	}
+}
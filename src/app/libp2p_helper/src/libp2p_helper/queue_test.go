@@ -0,0 +1,131 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func streamData(idx int) *incomingMsgUpcall {
+	return &incomingMsgUpcall{Upcall: "incomingStreamMsg", StreamIdx: idx, Data: []byte{byte(idx)}}
+}
+
+func TestOutQueuePriorities(t *testing.T) {
+	q := newOutQueue(16, overflowBlock)
+
+	q.push(streamData(1))
+	q.push(peerConnectionUpcall{ID: "peer", Upcall: "peerConnected"})
+	q.push(streamReadCompleteUpcall{Upcall: "streamReadComplete", StreamIdx: 1})
+	q.push(successResult{Seqno: 1})
+	q.push(&validateUpcall{Seqno: 2, Upcall: "validate"})
+	q.push(&validateBatchUpcall{Upcall: "validateBatch", Idx: 3})
+
+	require.Equal(t, successResult{Seqno: 1}, q.pop())
+	require.Equal(t, &validateUpcall{Seqno: 2, Upcall: "validate"}, q.pop())
+	require.Equal(t, &validateBatchUpcall{Upcall: "validateBatch", Idx: 3}, q.pop())
+	require.Equal(t, peerConnectionUpcall{ID: "peer", Upcall: "peerConnected"}, q.pop())
+	// the end of a stream never overtakes its data
+	require.Equal(t, streamData(1), q.pop())
+	require.Equal(t, streamReadCompleteUpcall{Upcall: "streamReadComplete", StreamIdx: 1}, q.pop())
+}
+
+func TestOutQueueDrain(t *testing.T) {
+	q := newOutQueue(2, overflowBlock)
+	q.push(streamData(1))
+	q.push(successResult{Seqno: 1})
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(shutdownUpcall{Upcall: "shutdown"})
+		close(pushed)
+	}()
+
+	require.Equal(t, []interface{}{successResult{Seqno: 1}, streamData(1)}, q.drain())
+	<-pushed
+	require.Equal(t, []interface{}{shutdownUpcall{Upcall: "shutdown"}}, q.drain())
+	require.Empty(t, q.drain())
+}
+
+func TestOutQueueBlock(t *testing.T) {
+	q := newOutQueue(2, overflowBlock)
+	q.push(streamData(1))
+	q.push(streamData(2))
+
+	pushed := make(chan struct{})
+	go func() {
+		q.push(successResult{Seqno: 1})
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("push into a full queue did not block")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Equal(t, streamData(1), q.pop())
+	<-pushed
+	require.Equal(t, successResult{Seqno: 1}, q.pop())
+	require.Equal(t, streamData(2), q.pop())
+}
+
+func TestOutQueueDropOldestStreamData(t *testing.T) {
+	q := newOutQueue(3, overflowBlock)
+	require.NoError(t, q.configure(0, overflowDropOldestStreamData))
+	require.Error(t, q.configure(0, overflowPolicy("drop-everything")))
+
+	var dropped []int
+	q.onStreamDropped = func(idx int) { dropped = append(dropped, idx) }
+
+	q.push(streamData(1))
+	q.push(streamData(2))
+	q.push(streamData(1))
+	// full: stream 1 has the oldest data, so it's the one to go
+	q.push(successResult{Seqno: 1})
+	// stream 1 is lost, so anything else about it is dropped too
+	q.push(streamData(1))
+	q.push(streamReadCompleteUpcall{Upcall: "streamReadComplete", StreamIdx: 1})
+
+	require.Equal(t, []int{1}, dropped)
+	require.Equal(t, successResult{Seqno: 1}, q.pop())
+	require.Equal(t, streamData(2), q.pop())
+	lost, ok := q.pop().(streamLostUpcall)
+	require.True(t, ok)
+	require.Equal(t, 1, lost.StreamIdx)
+}
+
+func TestOutQueueStreamResults(t *testing.T) {
+	q := newOutQueue(16, overflowBlock)
+
+	q.push(streamData(1))
+	q.pushResult(successResult{Seqno: 1}, 1)
+	q.pushResult(successResult{Seqno: 2}, 2)
+
+	// a stream's results wait behind its data, other streams' don't
+	require.Equal(t, successResult{Seqno: 2}, q.pop())
+	require.Equal(t, streamData(1), q.pop())
+	require.Equal(t, successResult{Seqno: 1}, q.pop())
+}
+
+func TestOutQueueForgetsLostStreams(t *testing.T) {
+	q := newOutQueue(3, overflowDropOldestStreamData)
+
+	q.push(streamData(1))
+	q.push(streamReadCompleteUpcall{Upcall: "streamReadComplete", StreamIdx: 1})
+	q.push(streamData(2))
+	q.push(successResult{Seqno: 1})
+	// stream 1's reads were already done, so nothing more can come about it
+	require.Empty(t, q.lost)
+	for i := 0; i < 3; i++ {
+		q.pop()
+	}
+
+	q.push(streamData(2))
+	q.push(streamData(2))
+	q.push(streamData(2))
+	q.push(successResult{Seqno: 2})
+	require.Equal(t, map[int]bool{2: true}, q.lost)
+	q.push(streamReadCompleteUpcall{Upcall: "streamReadComplete", StreamIdx: 2})
+	require.Empty(t, q.lost)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-core/peer"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// GossipSub scores its peers by how they behave on each topic: time in the
+// mesh, first and mesh message deliveries, and invalid messages, which are
+// those the daemon rejects in validationComplete. Peers whose score drops
+// below the thresholds stop getting gossip from us, stop getting our
+// messages, and then have their own messages ignored. The helper only scores
+// peers when configure is given peer_score. Messages the daemon doesn't
+// validate in time are then ignored rather than rejected, so that a slow
+// daemon doesn't score down the peers that sent them.
+
+// how often the scores getPeerScores returns are refreshed
+const peerScoreInspectInterval = time.Second
+
+type peerScoreThresholdsJson struct {
+	Gossip             float64 `json:"gossip"`
+	Publish            float64 `json:"publish"`
+	Graylist           float64 `json:"graylist"`
+	AcceptPX           float64 `json:"accept_px"`
+	OpportunisticGraft float64 `json:"opportunistic_graft"`
+}
+
+// topicScoreParamsJson mirrors pubsub.TopicScoreParams, with durations in ms
+type topicScoreParamsJson struct {
+	TopicWeight float64 `json:"topic_weight"`
+
+	TimeInMeshWeight    float64 `json:"time_in_mesh_weight"`
+	TimeInMeshQuantumMs int     `json:"time_in_mesh_quantum_ms"`
+	TimeInMeshCap       float64 `json:"time_in_mesh_cap"`
+
+	FirstMessageDeliveriesWeight float64 `json:"first_message_deliveries_weight"`
+	FirstMessageDeliveriesDecay  float64 `json:"first_message_deliveries_decay"`
+	FirstMessageDeliveriesCap    float64 `json:"first_message_deliveries_cap"`
+
+	MeshMessageDeliveriesWeight       float64 `json:"mesh_message_deliveries_weight"`
+	MeshMessageDeliveriesDecay        float64 `json:"mesh_message_deliveries_decay"`
+	MeshMessageDeliveriesCap          float64 `json:"mesh_message_deliveries_cap"`
+	MeshMessageDeliveriesThreshold    float64 `json:"mesh_message_deliveries_threshold"`
+	MeshMessageDeliveriesWindowMs     int     `json:"mesh_message_deliveries_window_ms"`
+	MeshMessageDeliveriesActivationMs int     `json:"mesh_message_deliveries_activation_ms"`
+
+	MeshFailurePenaltyWeight float64 `json:"mesh_failure_penalty_weight"`
+	MeshFailurePenaltyDecay  float64 `json:"mesh_failure_penalty_decay"`
+
+	InvalidMessageDeliveriesWeight float64 `json:"invalid_message_deliveries_weight"`
+	InvalidMessageDeliveriesDecay  float64 `json:"invalid_message_deliveries_decay"`
+}
+
+// peerScoreConfig mirrors pubsub.PeerScoreParams, with durations in ms. A
+// zero decay interval or decay-to-zero takes the GossipSub default.
+type peerScoreConfig struct {
+	Thresholds                  peerScoreThresholdsJson         `json:"thresholds"`
+	Topics                      map[string]topicScoreParamsJson `json:"topics"`
+	TopicScoreCap               float64                         `json:"topic_score_cap"`
+	IPColocationFactorWeight    float64                         `json:"ip_colocation_factor_weight"`
+	IPColocationFactorThreshold int                             `json:"ip_colocation_factor_threshold"`
+	BehaviourPenaltyWeight      float64                         `json:"behaviour_penalty_weight"`
+	BehaviourPenaltyDecay       float64                         `json:"behaviour_penalty_decay"`
+	DecayIntervalMs             int                             `json:"decay_interval_ms"`
+	DecayToZero                 float64                         `json:"decay_to_zero"`
+	RetainScoreMs               int                             `json:"retain_score_ms"`
+}
+
+func msToDuration(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+func (p *topicScoreParamsJson) params() *pubsub.TopicScoreParams {
+	return &pubsub.TopicScoreParams{
+		TopicWeight: p.TopicWeight,
+
+		TimeInMeshWeight:  p.TimeInMeshWeight,
+		TimeInMeshQuantum: msToDuration(p.TimeInMeshQuantumMs),
+		TimeInMeshCap:     p.TimeInMeshCap,
+
+		FirstMessageDeliveriesWeight: p.FirstMessageDeliveriesWeight,
+		FirstMessageDeliveriesDecay:  p.FirstMessageDeliveriesDecay,
+		FirstMessageDeliveriesCap:    p.FirstMessageDeliveriesCap,
+
+		MeshMessageDeliveriesWeight:     p.MeshMessageDeliveriesWeight,
+		MeshMessageDeliveriesDecay:      p.MeshMessageDeliveriesDecay,
+		MeshMessageDeliveriesCap:        p.MeshMessageDeliveriesCap,
+		MeshMessageDeliveriesThreshold:  p.MeshMessageDeliveriesThreshold,
+		MeshMessageDeliveriesWindow:     msToDuration(p.MeshMessageDeliveriesWindowMs),
+		MeshMessageDeliveriesActivation: msToDuration(p.MeshMessageDeliveriesActivationMs),
+
+		MeshFailurePenaltyWeight: p.MeshFailurePenaltyWeight,
+		MeshFailurePenaltyDecay:  p.MeshFailurePenaltyDecay,
+
+		InvalidMessageDeliveriesWeight: p.InvalidMessageDeliveriesWeight,
+		InvalidMessageDeliveriesDecay:  p.InvalidMessageDeliveriesDecay,
+	}
+}
+
+// options returns the GossipSub options that turn peer scoring on, keeping
+// app.PeerScores up to date. GossipSub checks the parameters when it's
+// created.
+func (c *peerScoreConfig) options(app *app) []pubsub.Option {
+	params := &pubsub.PeerScoreParams{
+		Topics:                      make(map[string]*pubsub.TopicScoreParams, len(c.Topics)),
+		TopicScoreCap:               c.TopicScoreCap,
+		AppSpecificScore:            func(peer.ID) float64 { return 0 },
+		IPColocationFactorWeight:    c.IPColocationFactorWeight,
+		IPColocationFactorThreshold: c.IPColocationFactorThreshold,
+		BehaviourPenaltyWeight:      c.BehaviourPenaltyWeight,
+		BehaviourPenaltyDecay:       c.BehaviourPenaltyDecay,
+		DecayInterval:               pubsub.DefaultDecayInterval,
+		DecayToZero:                 pubsub.DefaultDecayToZero,
+		RetainScore:                 msToDuration(c.RetainScoreMs),
+	}
+	for topic, topicParams := range c.Topics {
+		params.Topics[topic] = topicParams.params()
+	}
+	if c.DecayIntervalMs != 0 {
+		params.DecayInterval = msToDuration(c.DecayIntervalMs)
+	}
+	if c.DecayToZero != 0 {
+		params.DecayToZero = c.DecayToZero
+	}
+
+	thresholds := &pubsub.PeerScoreThresholds{
+		GossipThreshold:             c.Thresholds.Gossip,
+		PublishThreshold:            c.Thresholds.Publish,
+		GraylistThreshold:           c.Thresholds.Graylist,
+		AcceptPXThreshold:           c.Thresholds.AcceptPX,
+		OpportunisticGraftThreshold: c.Thresholds.OpportunisticGraft,
+	}
+
+	return []pubsub.Option{
+		pubsub.WithPeerScore(params, thresholds),
+		pubsub.WithPeerScoreInspect(pubsub.PeerScoreInspectFn(app.updatePeerScores), peerScoreInspectInterval),
+	}
+}
+
+func (app *app) updatePeerScores(scores map[peer.ID]float64) {
+	app.PeerScoresMutex.Lock()
+	defer app.PeerScoresMutex.Unlock()
+
+	app.PeerScores = scores
+}
+
+type getPeerScoresMsg struct {
+	// only return the scores of these peers, if given
+	PeerIDs []string `json:"peer_ids"`
+}
+
+type peerScoreJson struct {
+	PeerID string  `json:"peer_id"`
+	Score  float64 `json:"score"`
+}
+
+func (m *getPeerScoresMsg) run(ctx context.Context, app *app) (interface{}, error) {
+	if app.P2p == nil {
+		return nil, needsConfigure()
+	}
+	if config := app.config(); config == nil || config.PeerScore == nil {
+		return nil, badRequest(errors.New("peer scoring is not enabled"))
+	}
+
+	var only map[peer.ID]bool
+	if m.PeerIDs != nil {
+		only = make(map[peer.ID]bool, len(m.PeerIDs))
+		for _, encoded := range m.PeerIDs {
+			id, err := peer.Decode(encoded)
+			if err != nil {
+				return nil, badRPC(err)
+			}
+			only[id] = true
+		}
+	}
+
+	app.PeerScoresMutex.Lock()
+	defer app.PeerScoresMutex.Unlock()
+
+	result := make([]peerScoreJson, 0, len(app.PeerScores))
+	for id, score := range app.PeerScores {
+		if only != nil && !only[id] {
+			continue
+		}
+		result = append(result, peerScoreJson{PeerID: peer.Encode(id), Score: score})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].PeerID < result[j].PeerID })
+
+	return result, nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	crand "crypto/rand"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"codanet"
+
+	"github.com/libp2p/go-libp2p-core/crypto"
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	"github.com/stretchr/testify/require"
+)
+
+func testPeerScoreConfig(topic string) *peerScoreConfig {
+	return &peerScoreConfig{
+		Thresholds: peerScoreThresholdsJson{Gossip: -10, Publish: -20, Graylist: -30},
+		Topics: map[string]topicScoreParamsJson{
+			topic: {
+				TopicWeight:                    1,
+				TimeInMeshQuantumMs:            1000,
+				InvalidMessageDeliveriesWeight: -10,
+				InvalidMessageDeliveriesDecay:  0.9,
+			},
+		},
+	}
+}
+
+func TestGetPeerScoresMsg(t *testing.T) {
+	var err error
+	topic := "testtopic"
+
+	appA := newTestApp(t, nil)
+	appA.NoUpcalls = false
+	appA.OutQueue = newOutQueue(defaultOutQueueSize, overflowBlock)
+	appA.Config.PeerScore = testPeerScoreConfig(topic)
+	appA.P2p.Pubsub, err = pubsub.NewGossipSub(appA.Ctx, appA.P2p.Host, appA.Config.PeerScore.options(appA)...)
+	require.NoError(t, err)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+
+	appB := newTestApp(t, appAInfos)
+	appB.P2p.Pubsub, err = pubsub.NewGossipSub(appB.Ctx, appB.P2p.Host)
+	require.NoError(t, err)
+	require.NoError(t, appB.P2p.Host.Connect(appB.Ctx, appAInfos[0]))
+
+	_, err = (&subscribeMsg{Topic: topic, Subscription: 0}).run(context.Background(), appA)
+	require.NoError(t, err)
+	topicB, err := appB.P2p.Pubsub.Join(topic)
+	require.NoError(t, err)
+	require.Eventually(t, func() bool {
+		return len(topicB.ListPeers()) == 1
+	}, testTimeout, 10*time.Millisecond)
+
+	go func() {
+		seqs <- 1
+	}()
+	require.NoError(t, topicB.Publish(appB.Ctx, []byte("invalid block")))
+
+	upcall, ok := nextMsg(t, appA).(*validateUpcall)
+	require.True(t, ok)
+	_, err = (&validationCompleteMsg{Seqno: upcall.Seqno, Valid: rejectResult}).run(context.Background(), appA)
+	require.NoError(t, err)
+
+	// the rejected message counts against the peer that sent it
+	idB := appB.P2p.Host.ID().String()
+	require.Eventually(t, func() bool {
+		ret, err := (&getPeerScoresMsg{PeerIDs: []string{idB}}).run(context.Background(), appA)
+		require.NoError(t, err)
+		scores := ret.([]peerScoreJson)
+		return len(scores) == 1 && scores[0].PeerID == idB && scores[0].Score < 0
+	}, testTimeout, 100*time.Millisecond)
+
+	// without scoring there are no scores to get
+	_, err = (&getPeerScoresMsg{}).run(context.Background(), appB)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+}
+
+func TestConfigurePeerScore(t *testing.T) {
+	testApp := newApp()
+
+	dir, err := ioutil.TempDir("", "mina_test_*")
+	require.NoError(t, err)
+	key, _, err := crypto.GenerateEd25519Key(crand.Reader)
+	require.NoError(t, err)
+	keyBytes, err := key.Bytes()
+	require.NoError(t, err)
+
+	msg := &configureMsg{
+		Statedir:            dir,
+		Privk:               codaEncode(keyBytes),
+		NetworkID:           string(testProtocol),
+		ListenOn:            []string{"/ip4/127.0.0.1/tcp/0"},
+		External:            "/ip4/127.0.0.1/tcp/0",
+		ValidationQueueSize: 16,
+		PeerScore:           testPeerScoreConfig("testtopic"),
+	}
+
+	// GossipSub checks the parameters
+	msg.PeerScore.Thresholds.Gossip = 1
+	_, err = msg.run(context.Background(), testApp)
+	require.Equal(t, codanet.ErrCodeBadInput, codeOf(err))
+	require.Nil(t, testApp.P2p)
+
+	msg.PeerScore.Thresholds.Gossip = -10
+	_, err = msg.run(context.Background(), testApp)
+	require.NoError(t, err)
+	defer func() {
+		_ = testApp.P2p.Close()
+	}()
+
+	ret, err := (&getPeerScoresMsg{}).run(context.Background(), testApp)
+	require.NoError(t, err)
+	require.Empty(t, ret)
+}
+
+func TestTimedOutResult(t *testing.T) {
+	testApp := newTestApp(t, nil)
+
+	// without peer scoring, a message the daemon didn't validate in time is
+	// rejected
+	require.Equal(t, pubsub.ValidationReject, testApp.timedOutResult())
+
+	// with it, the sender isn't scored down for the daemon being slow
+	config := *testApp.config()
+	config.PeerScore = testPeerScoreConfig("testtopic")
+	testApp.setConfig(&config)
+	require.Equal(t, pubsub.ValidationIgnore, testApp.timedOutResult())
+
+	testApp.UnsafeNoTrustIP = true
+	require.Equal(t, pubsub.ValidationAccept, testApp.timedOutResult())
+}
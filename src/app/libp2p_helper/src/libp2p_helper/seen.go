@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/crypto/blake2b"
+)
+
+// GossipSub identifies messages by sender and seqno by default, so the same
+// payload published by different peers passes validation once for each. With
+// the blake2b message ID, GossipSub itself drops the copies of a payload it
+// started validating. The seen cache works with either message ID, and
+// across topics: the topic validators ignore payloads that were handed to
+// the daemon within the TTL, without asking it again. A payload counts as
+// handed over from the moment a validator claims it, and stops counting if
+// the validator gives up on it before queueing the upcall or the daemon
+// doesn't answer in time, so that such a copy doesn't keep the later copies
+// from being validated. A TTL of 0
+// disables the cache; GossipSub remembers message IDs for 2 minutes, which
+// makes for a sensible TTL.
+
+const (
+	messageIDSenderSeqno = "sender_seqno"
+	messageIDBlake2b     = "blake2b"
+)
+
+func blake2bMessageID(msg *pb.Message) string {
+	hash := blake2b.Sum256(msg.GetData())
+	return string(hash[:])
+}
+
+// messageIDOptions returns the GossipSub options for the message ID function
+// named name
+func messageIDOptions(name string) ([]pubsub.Option, error) {
+	switch name {
+	case "", messageIDSenderSeqno:
+		return nil, nil
+	case messageIDBlake2b:
+		return []pubsub.Option{pubsub.WithMessageIdFn(blake2bMessageID)}, nil
+	default:
+		return nil, fmt.Errorf("unknown message_id %q", name)
+	}
+}
+
+// seenCache remembers the payloads handed to the daemon for validation
+type seenCache struct {
+	mutex     sync.Mutex
+	ttl       time.Duration
+	seen      map[[blake2b.Size256]byte]time.Time
+	lastSweep time.Time
+}
+
+func newSeenCache(ttl time.Duration) *seenCache {
+	return &seenCache{ttl: ttl, seen: make(map[[blake2b.Size256]byte]time.Time), lastSweep: time.Now()}
+}
+
+// setTTL changes the TTL, forgetting everything if it is 0
+func (c *seenCache) setTTL(ttl time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.ttl = ttl
+	if ttl <= 0 {
+		c.seen = make(map[[blake2b.Size256]byte]time.Time)
+	}
+}
+
+// claim remembers data as handed to the daemon now, unless it already was
+// within the TTL. Only the validator that claims a payload hands it over, so
+// copies validated at the same time aren't all handed to the daemon.
+func (c *seenCache) claim(data []byte) bool {
+	key := blake2b.Sum256(data)
+	now := time.Now()
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.ttl <= 0 {
+		return true
+	}
+
+	if now.Sub(c.lastSweep) > c.ttl {
+		for other, at := range c.seen {
+			if now.Sub(at) > c.ttl {
+				delete(c.seen, other)
+			}
+		}
+		c.lastSweep = now
+	}
+
+	if at, ok := c.seen[key]; ok && now.Sub(at) <= c.ttl {
+		seenCacheHitsMetric.Inc()
+		return false
+	}
+	c.seen[key] = now
+	return true
+}
+
+// remove forgets that data was handed to the daemon
+func (c *seenCache) remove(data []byte) {
+	key := blake2b.Sum256(data)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	delete(c.seen, key)
+}
+
+var seenCacheHitsMetric = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "seen_cache_hits",
+	Help: "Number of pubsub messages not handed to the daemon for validation because the daemon was recently handed the same payload.",
+})
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+	pb "github.com/libp2p/go-libp2p-pubsub/pb"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSeenCache(t *testing.T) {
+	cache := newSeenCache(100 * time.Millisecond)
+	hits := testutil.ToFloat64(seenCacheHitsMetric)
+
+	require.True(t, cache.claim([]byte("block")))
+	require.False(t, cache.claim([]byte("block")))
+	require.True(t, cache.claim([]byte("other block")))
+	require.Equal(t, hits+1, testutil.ToFloat64(seenCacheHitsMetric))
+
+	time.Sleep(150 * time.Millisecond)
+	require.True(t, cache.claim([]byte("block")))
+
+	// a payload the daemon didn't validate in time is forgotten
+	cache.remove([]byte("block"))
+	require.True(t, cache.claim([]byte("block")))
+
+	// and a TTL of 0 disables the cache
+	cache.setTTL(0)
+	require.True(t, cache.claim([]byte("block")))
+	require.True(t, cache.claim([]byte("block")))
+
+	// of copies claimed at the same time, only one gets through
+	cache.setTTL(time.Minute)
+	var claimed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if cache.claim([]byte("block")) {
+				atomic.AddInt32(&claimed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), claimed)
+}
+
+func TestMessageIDOptions(t *testing.T) {
+	opts, err := messageIDOptions("")
+	require.NoError(t, err)
+	require.Empty(t, opts)
+	opts, err = messageIDOptions(messageIDBlake2b)
+	require.NoError(t, err)
+	require.Len(t, opts, 1)
+	_, err = messageIDOptions("sha1")
+	require.Error(t, err)
+
+	// the ID only depends on the payload
+	a := blake2bMessageID(&pb.Message{From: []byte("a"), Data: []byte("block"), Seqno: []byte{1}})
+	b := blake2bMessageID(&pb.Message{From: []byte("b"), Data: []byte("block"), Seqno: []byte{2}})
+	require.Equal(t, a, b)
+}
+
+func TestDuplicatePayloadsValidatedOnce(t *testing.T) {
+	var err error
+	topic := "testtopic"
+
+	// MakeHelper sets the mplex message size limit, which running hosts
+	// read, so all apps are made up front
+	appA := newTestApp(t, nil)
+	appAInfos, err := addrInfos(appA.P2p.Host)
+	require.NoError(t, err)
+	var producers []*app
+	for i := 0; i < 4; i++ {
+		producers = append(producers, newTestApp(t, appAInfos))
+	}
+
+	appA.NoUpcalls = false
+	appA.OutQueue = newOutQueue(defaultOutQueueSize, overflowBlock)
+	appA.SeenCache = newSeenCache(time.Minute)
+	// with the default message ID, the copies are different messages to
+	// GossipSub
+	appA.P2p.Pubsub, err = pubsub.NewGossipSub(appA.Ctx, appA.P2p.Host)
+	require.NoError(t, err)
+
+	_, err = (&subscribeMsg{Topic: topic, Subscription: 0}).run(context.Background(), appA)
+	require.NoError(t, err)
+
+	// the producers publish the same block
+	var topics []*pubsub.Topic
+	for _, producer := range producers {
+		producer.P2p.Pubsub, err = pubsub.NewGossipSub(producer.Ctx, producer.P2p.Host)
+		require.NoError(t, err)
+		require.NoError(t, producer.P2p.Host.Connect(producer.Ctx, appAInfos[0]))
+		producerTopic, err := producer.P2p.Pubsub.Join(topic)
+		require.NoError(t, err)
+		require.Eventually(t, func() bool {
+			return len(producerTopic.ListPeers()) == 1
+		}, testTimeout, 10*time.Millisecond)
+		topics = append(topics, producerTopic)
+	}
+
+	go func() {
+		seqs <- 1
+	}()
+	hits := testutil.ToFloat64(seenCacheHitsMetric)
+
+	// all at once, so that the copies are validated at the same time
+	var wg sync.WaitGroup
+	for _, producerTopic := range topics {
+		wg.Add(1)
+		go func(producerTopic *pubsub.Topic) {
+			defer wg.Done()
+			require.NoError(t, producerTopic.Publish(context.Background(), []byte("block")))
+		}(producerTopic)
+	}
+	wg.Wait()
+
+	upcall, ok := nextMsg(t, appA).(*validateUpcall)
+	require.True(t, ok)
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(seenCacheHitsMetric) == hits+float64(len(topics)-1)
+	}, testTimeout, 10*time.Millisecond)
+	// the daemon is only handed one of them
+	require.Empty(t, appA.OutQueue.drain())
+
+	_, err = (&validationCompleteMsg{Seqno: upcall.Seqno, Valid: acceptResult}).run(context.Background(), appA)
+	require.NoError(t, err)
+}
@@ -0,0 +1,115 @@
+package codanet
+
+import (
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+)
+
+// The connection manager trims the connections of the peers with the lowest
+// tag values first, so peers we have outbound connections to are tagged to
+// have the surplus inbound connections go before them. On top of that, a
+// number of connection slots is reserved for outbound connections: inbound
+// connections beyond the rest of the slots are closed, and that many of the
+// peers we dialled are protected from trimming, so that a node flooded with
+// inbound connections keeps some peers it chose itself.
+
+const (
+	outboundTag         = "coda-outbound"
+	outboundTagWeight   = 100
+	reservedOutboundTag = "coda-reserved-outbound"
+)
+
+// ConnCounts counts the connections of net by direction
+func ConnCounts(net network.Network) (inbound int, outbound int) {
+	for _, c := range net.Conns() {
+		switch c.Stat().Direction {
+		case network.DirInbound:
+			inbound++
+		case network.DirOutbound:
+			outbound++
+		}
+	}
+	return
+}
+
+func hasOutboundConn(net network.Network, p peer.ID) bool {
+	for _, c := range net.ConnsToPeer(p) {
+		if c.Stat().Direction == network.DirOutbound {
+			return true
+		}
+	}
+	return false
+}
+
+// ReservedOutbound returns how many connection slots are reserved for
+// outbound connections
+func (cm *CodaConnectionManager) ReservedOutbound() int {
+	cm.outboundMutex.Lock()
+	defer cm.outboundMutex.Unlock()
+
+	return cm.reservedOutbound
+}
+
+// SetReservedOutbound reserves n connection slots for outbound connections.
+// Inbound connections already open beyond the remaining slots are left to
+// the next trim.
+func (cm *CodaConnectionManager) SetReservedOutbound(net network.Network, n int) {
+	cm.outboundMutex.Lock()
+	defer cm.outboundMutex.Unlock()
+
+	cm.reservedOutbound = n
+	cm.updateReservations(net)
+}
+
+// updateReservations protects as many of the peers we have outbound
+// connections to as there are reserved slots. outboundMutex must be held.
+func (cm *CodaConnectionManager) updateReservations(net network.Network) {
+	for p := range cm.reserved {
+		if hasOutboundConn(net, p) && len(cm.reserved) <= cm.reservedOutbound {
+			continue
+		}
+		delete(cm.reserved, p)
+		cm.Unprotect(p, reservedOutboundTag)
+	}
+
+	for _, p := range net.Peers() {
+		if len(cm.reserved) >= cm.reservedOutbound {
+			return
+		}
+		if !cm.reserved[p] && hasOutboundConn(net, p) {
+			cm.reserved[p] = true
+			cm.Protect(p, reservedOutboundTag)
+		}
+	}
+}
+
+// trackOutbound updates the outbound tag of the peer c is to and the
+// reservations, after c was opened or closed
+func (cm *CodaConnectionManager) trackOutbound(net network.Network, c network.Conn) {
+	cm.outboundMutex.Lock()
+	defer cm.outboundMutex.Unlock()
+
+	p := c.RemotePeer()
+	if hasOutboundConn(net, p) {
+		cm.TagPeer(p, outboundTag, outboundTagWeight)
+	} else {
+		cm.UntagPeer(p, outboundTag)
+	}
+	cm.updateReservations(net)
+}
+
+// inboundSurplus checks if c is an inbound connection taking up a slot
+// reserved for outbound connections. Connections of protected peers never are.
+func (cm *CodaConnectionManager) inboundSurplus(net network.Network, c network.Conn, highWater int) bool {
+	if c.Stat().Direction != network.DirInbound || cm.IsProtected(c.RemotePeer(), "") {
+		return false
+	}
+
+	reserved := cm.ReservedOutbound()
+	if reserved <= 0 {
+		return false
+	}
+
+	inbound, _ := ConnCounts(net)
+	return inbound > highWater-reserved
+}
@@ -0,0 +1,229 @@
+package codanet
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/libp2p/go-libp2p-core/control"
+	"github.com/libp2p/go-libp2p-core/mux"
+	"github.com/libp2p/go-libp2p-core/network"
+	"github.com/libp2p/go-libp2p-core/peer"
+	"github.com/libp2p/go-libp2p-core/sec"
+	manet "github.com/multiformats/go-multiaddr/net"
+)
+
+// The network.Conn that InterceptUpgraded gets doesn't tell which muxer and
+// security protocol were negotiated for it, so MakeHelper wraps the muxer and
+// security transports to note them down in the gating state's upgrade table,
+// keyed by the remote address of the connection, where InterceptUpgraded
+// picks them up. The local address can't be part of the key: connections
+// accepted by a listener on an unspecified address report the listen address
+// as theirs.
+
+// UpgradePolicy restricts the connections InterceptUpgraded allows. Empty
+// lists and a zero MaxConnsPerIP don't restrict anything.
+type UpgradePolicy struct {
+	// the muxer protocol IDs connections may use
+	AllowedMuxers []string
+	// the security protocol IDs connections may use
+	AllowedSecurity []string
+	// how many connections may be open to a single IP, trusted peers and
+	// IPs aside
+	MaxConnsPerIP int
+}
+
+// The reasons InterceptUpgraded rejects connections for
+const (
+	DisconnectMuxerNotAllowed control.DisconnectReason = iota + 1
+	DisconnectSecurityNotAllowed
+	DisconnectTooManyConnsPerIP
+)
+
+var disconnectReasonRules = map[control.DisconnectReason]GatingRule{
+	DisconnectMuxerNotAllowed:    RuleMuxerNotAllowed,
+	DisconnectSecurityNotAllowed: RuleSecurityNotAllowed,
+	DisconnectTooManyConnsPerIP:  RuleTooManyConnsPerIP,
+}
+
+// DisconnectReasonRule returns the gating rule a connection was rejected by
+// for reason
+func DisconnectReasonRule(reason control.DisconnectReason) GatingRule {
+	if rule, ok := disconnectReasonRules[reason]; ok {
+		return rule
+	}
+	return RuleDefault
+}
+
+// negotiated is what the upgrader settled on for a connection
+type negotiated struct {
+	muxer    string
+	security string
+}
+
+// upgradeTable holds what was negotiated for the connections that are being
+// upgraded
+type upgradeTable struct {
+	mutex sync.Mutex
+	conns map[string]negotiated
+}
+
+func newUpgradeTable() *upgradeTable {
+	return &upgradeTable{conns: make(map[string]negotiated)}
+}
+
+func (t *upgradeTable) add(key string, n negotiated) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.conns[key] = n
+}
+
+// take removes the entry for key and returns it
+func (t *upgradeTable) take(key string) (negotiated, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	n, ok := t.conns[key]
+	delete(t.conns, key)
+	return n, ok
+}
+
+func (t *upgradeTable) remove(key string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	delete(t.conns, key)
+}
+
+// taggedSecurity is a security transport whose connections tell its
+// protocol ID
+type taggedSecurity struct {
+	sec.SecureTransport
+	id string
+}
+
+type taggedSecureConn struct {
+	sec.SecureConn
+	id string
+}
+
+func (t *taggedSecurity) SecureInbound(ctx context.Context, insecure net.Conn) (sec.SecureConn, error) {
+	c, err := t.SecureTransport.SecureInbound(ctx, insecure)
+	if err != nil {
+		return nil, err
+	}
+	return &taggedSecureConn{SecureConn: c, id: t.id}, nil
+}
+
+func (t *taggedSecurity) SecureOutbound(ctx context.Context, insecure net.Conn, p peer.ID) (sec.SecureConn, error) {
+	c, err := t.SecureTransport.SecureOutbound(ctx, insecure, p)
+	if err != nil {
+		return nil, err
+	}
+	return &taggedSecureConn{SecureConn: c, id: t.id}, nil
+}
+
+// taggedMuxer is a muxer that notes down what was negotiated for each
+// connection it sets up in an upgrade table
+type taggedMuxer struct {
+	mux.Multiplexer
+	id    string
+	table *upgradeTable
+}
+
+type taggedMuxedConn struct {
+	mux.MuxedConn
+	key   string
+	table *upgradeTable
+}
+
+func (m *taggedMuxer) NewConn(c net.Conn, isServer bool) (mux.MuxedConn, error) {
+	mc, err := m.Multiplexer.NewConn(c, isServer)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := manet.FromNetAddr(c.RemoteAddr())
+	if err != nil {
+		return mc, nil
+	}
+
+	n := negotiated{muxer: m.id}
+	if sc, ok := c.(*taggedSecureConn); ok {
+		n.security = sc.id
+	}
+	key := remote.String()
+	m.table.add(key, n)
+
+	return &taggedMuxedConn{MuxedConn: mc, key: key, table: m.table}, nil
+}
+
+// Close drops the table entry, in case the connection was closed before
+// InterceptUpgraded got to it
+func (c *taggedMuxedConn) Close() error {
+	c.table.remove(c.key)
+	return c.MuxedConn.Close()
+}
+
+// tagSecurity wraps a security transport so that InterceptUpgraded knows
+// when it was negotiated
+func (gs *CodaGatingState) tagSecurity(id string, tpt sec.SecureTransport) sec.SecureTransport {
+	return &taggedSecurity{SecureTransport: tpt, id: id}
+}
+
+// tagMuxer wraps a muxer so that InterceptUpgraded knows when it was
+// negotiated
+func (gs *CodaGatingState) tagMuxer(id string, tpt mux.Multiplexer) mux.Multiplexer {
+	return &taggedMuxer{Multiplexer: tpt, id: id, table: gs.upgrades}
+}
+
+func contains(list []string, s string) bool {
+	for _, entry := range list {
+		if entry == s {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeRule checks c against the upgrade policy. Connections that were
+// set up without the tagged transports pass the muxer and security checks.
+func (gs *CodaGatingState) upgradeRule(c network.Conn) (bool, control.DisconnectReason) {
+	policy := gs.UpgradePolicy
+
+	n, ok := gs.upgrades.take(c.RemoteMultiaddr().String())
+	if ok {
+		if len(policy.AllowedMuxers) > 0 && !contains(policy.AllowedMuxers, n.muxer) {
+			return false, DisconnectMuxerNotAllowed
+		}
+		if len(policy.AllowedSecurity) > 0 && !contains(policy.AllowedSecurity, n.security) {
+			return false, DisconnectSecurityNotAllowed
+		}
+	}
+
+	if policy.MaxConnsPerIP <= 0 || gs.network == nil {
+		return true, 0
+	}
+	if gs.isPeerTrusted(c.RemotePeer()) || gs.isAddrTrusted(c.RemoteMultiaddr()) {
+		return true, 0
+	}
+
+	ip, err := manet.ToIP(c.RemoteMultiaddr())
+	if err != nil {
+		return true, 0
+	}
+
+	// c itself isn't among the network's connections yet
+	count := 0
+	for _, other := range gs.network.Conns() {
+		otherIP, err := manet.ToIP(other.RemoteMultiaddr())
+		if err == nil && otherIP.Equal(ip) {
+			count++
+		}
+	}
+	if count >= policy.MaxConnsPerIP {
+		return false, DisconnectTooManyConnsPerIP
+	}
+	return true, 0
+}
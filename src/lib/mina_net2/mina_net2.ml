@@ -70,9 +70,10 @@ module Validation_callback = struct
       Ivar.fill cb.signal result )
 end
 
-(** simple types for yojson to derive, later mapped into a Peer.t *)
+(** simple types for yojson to derive, later mapped into a Peer.t. peer_info
+    isn't strict, as listPeers results also give each connection's direction. *)
 type peer_info = {libp2p_port: int; host: string; peer_id: string}
-[@@deriving yojson]
+[@@deriving yojson {strict= false}]
 
 type connection_gating =
   {banned_peers: Peer.t list; trusted_peers: Peer.t list; isolate: bool}
@@ -535,6 +536,53 @@ module Helper = struct
 
       let name = "findPeer"
     end
+
+    module Hello = struct
+      type input =
+        {protocol_version: int; methods: string list; upcalls: string list}
+      [@@deriving yojson]
+
+      type output = input [@@deriving yojson]
+
+      let name = "hello"
+
+      (* Must match protocolVersion in the helper. *)
+      let protocol_version = 2
+
+      let methods =
+        [ Send_stream_msg.name
+        ; Remove_stream_handler.name
+        ; Generate_keypair.name
+        ; Publish.name
+        ; Subscribe.name
+        ; Unsubscribe.name
+        ; Set_gater_config.name
+        ; Configure.name
+        ; Listen.name
+        ; Listening_addrs.name
+        ; Reset_stream.name
+        ; Add_stream_handler.name
+        ; Open_stream.name
+        ; Validation_complete.name
+        ; Add_peer.name
+        ; Begin_advertising.name
+        ; List_peers.name
+        ; Set_node_status.name
+        ; Get_peer_node_status.name
+        ; Find_peer.name ]
+
+      let upcalls =
+        [ "validate"
+        ; "validateBatch"
+        ; "incomingStream"
+        ; "peerConnected"
+        ; "peerDisconnected"
+        ; "incomingStreamMsg"
+        ; "streamLost"
+        ; "streamReadComplete"
+        ; "banExpired"
+        ; "shutdown" ]
+    end
   end
 
   let gating_config_to_helper_format (config : connection_gating) =
@@ -584,6 +632,9 @@ module Helper = struct
           ; ("method", `String M.name)
           ; ("body", M.input_to_yojson body) ]
       in
+      (* The helper also offers a framed wire mode that spares blobs the
+         base64, but Child_processes only hands us its stdout line by line,
+         so we stick to JSON lines. *)
       let rpc = Yojson.Safe.to_string actual_obj in
       [%log' spam t.logger] "sending line to libp2p_helper: $line"
         ~metadata:
@@ -819,6 +870,15 @@ module Helper = struct
       [@@deriving yojson]
     end
 
+    module Validate_batch = struct
+      type message =
+        {sender: peer_info option; data: Data.t; expiration: int64; seqno: int}
+      [@@deriving yojson]
+
+      type t = {upcall: string; subscription_idx: int; messages: message list}
+      [@@deriving yojson]
+    end
+
     module Stream_lost = struct
       type t = {upcall: string; stream_idx: int; reason: string}
       [@@deriving yojson]
@@ -844,7 +904,22 @@ module Helper = struct
     end
 
     module Peer_disconnected = struct
-      type t = {upcall: string; peer_id: string} [@@deriving yojson]
+      (* The reason is only given when the helper dropped the connection. *)
+      type t =
+        {upcall: string; peer_id: string; reason: string option [@default None]}
+      [@@deriving yojson]
+    end
+
+    module Ban_expired = struct
+      type t =
+        { upcall: string
+        ; peer_id: string option [@default None]
+        ; ip: string option [@default None] }
+      [@@deriving yojson]
+    end
+
+    module Shutdown = struct
+      type t = {upcall: string} [@@deriving yojson]
     end
 
     let or_error (t : ('a, string) Result.t) =
@@ -882,6 +957,80 @@ module Helper = struct
       | None ->
           Envelope.Incoming.local data
     in
+    (* Hands a message received on a subscription to its validator, and
+       tells the helper what the validator decided. *)
+    let validate ~idx ~seqno ~sender ~data ~expiration =
+      match Hashtbl.find t.subscriptions idx with
+      | Some sub ->
+          (let open Deferred.Let_syntax in
+          let raw_data = Data.to_string data in
+          let decoded = sub.decode raw_data in
+          let%bind action_opt =
+            match decoded with
+            | Ok data ->
+                let expiration_time =
+                  Int63.of_int64_exn expiration
+                  |> Time_ns.Span.of_int63_ns |> Time_ns.of_span_since_epoch
+                in
+                let validation_callback =
+                  Validation_callback.create expiration_time
+                in
+                let%bind () =
+                  sub.validator (wrap sender data) validation_callback
+                in
+                Validation_callback.await validation_callback
+            | Error e ->
+                ( match sub.on_decode_failure with
+                | `Ignore ->
+                    ()
+                | `Call f ->
+                    f (wrap sender raw_data) e ) ;
+                [%log' error t.logger]
+                  "failed to decode message published on subscription \
+                   $topic ($idx): $error"
+                  ~metadata:
+                    [ ("topic", `String sub.topic)
+                    ; ("idx", `Int idx)
+                    ; ("error", Error_json.error_to_yojson e) ] ;
+                return (Some `Reject)
+          in
+          match action_opt with
+          | None ->
+              [%log' warn t.logger]
+                "validation callback timed out before we could respond" ;
+              Deferred.unit
+          | Some action -> (
+              match%map
+                do_rpc t
+                  (module Rpcs.Validation_complete)
+                  { seqno
+                  ; is_valid=
+                      ( match action with
+                      | `Accept ->
+                          "accept"
+                      | `Reject ->
+                          "reject"
+                      | `Ignore ->
+                          "ignore" ) }
+              with
+              | Ok "validationComplete success" ->
+                  ()
+              | Ok v ->
+                  failwithf
+                    "helper broke RPC protocol: validationComplete got %s" v
+                    ()
+              | Error e ->
+                  [%log' error t.logger]
+                    "error during validationComplete, ignoring and \
+                     continuing: $error"
+                    ~metadata:[("error", Error_json.error_to_yojson e)] ))
+          |> don't_wait_for ;
+          Ok ()
+      | None ->
+          Or_error.errorf
+            "asked to validate message for unregistered subscription idx %d"
+            idx
+    in
     match member "upcall" v |> to_string with
     (* Message published on one of our subscriptions *)
     | "publish" -> (
@@ -948,80 +1097,17 @@ module Helper = struct
             Or_error.errorf
               "message published with inactive subsubscription %d" idx )
     (* Validate a message received on a subscription *)
-    | "validate" -> (
+    | "validate" ->
         let%bind m = Validate.of_yojson v |> or_error in
-        let idx = m.subscription_idx in
-        let seqno = m.seqno in
-        match Hashtbl.find t.subscriptions idx with
-        | Some sub ->
-            (let open Deferred.Let_syntax in
-            let raw_data = Data.to_string m.data in
-            let decoded = sub.decode raw_data in
-            let%bind action_opt =
-              match decoded with
-              | Ok data ->
-                  let expiration_time =
-                    Int63.of_int64_exn m.expiration
-                    |> Time_ns.Span.of_int63_ns |> Time_ns.of_span_since_epoch
-                  in
-                  let validation_callback =
-                    Validation_callback.create expiration_time
-                  in
-                  let%bind () =
-                    sub.validator (wrap m.sender data) validation_callback
-                  in
-                  Validation_callback.await validation_callback
-              | Error e ->
-                  ( match sub.on_decode_failure with
-                  | `Ignore ->
-                      ()
-                  | `Call f ->
-                      f (wrap m.sender raw_data) e ) ;
-                  [%log' error t.logger]
-                    "failed to decode message published on subscription \
-                     $topic ($idx): $error"
-                    ~metadata:
-                      [ ("topic", `String sub.topic)
-                      ; ("idx", `Int idx)
-                      ; ("error", Error_json.error_to_yojson e) ] ;
-                  return (Some `Reject)
-            in
-            match action_opt with
-            | None ->
-                [%log' warn t.logger]
-                  "validation callback timed out before we could respond" ;
-                Deferred.unit
-            | Some action -> (
-                match%map
-                  do_rpc t
-                    (module Rpcs.Validation_complete)
-                    { seqno
-                    ; is_valid=
-                        ( match action with
-                        | `Accept ->
-                            "accept"
-                        | `Reject ->
-                            "reject"
-                        | `Ignore ->
-                            "ignore" ) }
-                with
-                | Ok "validationComplete success" ->
-                    ()
-                | Ok v ->
-                    failwithf
-                      "helper broke RPC protocol: validationComplete got %s" v
-                      ()
-                | Error e ->
-                    [%log' error t.logger]
-                      "error during validationComplete, ignoring and \
-                       continuing: $error"
-                      ~metadata:[("error", Error_json.error_to_yojson e)] ))
-            |> don't_wait_for ;
-            Ok ()
-        | None ->
-            Or_error.errorf
-              "asked to validate message for unregistered subscription idx %d"
-              idx )
+        validate ~idx:m.subscription_idx ~seqno:m.seqno ~sender:m.sender
+          ~data:m.data ~expiration:m.expiration
+    (* Validate a batch of messages received on a subscription *)
+    | "validateBatch" ->
+        let%bind m = Validate_batch.of_yojson v |> or_error in
+        List.map m.messages ~f:(fun (msg : Validate_batch.message) ->
+            validate ~idx:m.subscription_idx ~seqno:msg.seqno
+              ~sender:msg.sender ~data:msg.data ~expiration:msg.expiration )
+        |> Or_error.combine_errors_unit
     (* A new inbound stream was opened *)
     | "incomingStream" -> (
         let%bind m = Incoming_stream.of_yojson v |> or_error in
@@ -1075,7 +1161,22 @@ module Helper = struct
         Option.iter t.peer_connected_callback ~f:(fun cb -> cb p.peer_id)
     | "peerDisconnected" ->
         let%map p = Peer_disconnected.of_yojson v |> or_error in
+        Option.iter p.reason ~f:(fun reason ->
+            [%log' debug t.logger]
+              "helper dropped connection to $peer: $reason"
+              ~metadata:
+                [("peer", `String p.peer_id); ("reason", `String reason)] ) ;
         Option.iter t.peer_disconnected_callback ~f:(fun cb -> cb p.peer_id)
+    | "banExpired" ->
+        let%map b = Ban_expired.of_yojson v |> or_error in
+        [%log' info t.logger] "ban expired"
+          ~metadata:
+            (List.filter_opt
+               [ Option.map b.peer_id ~f:(fun p -> ("peer", `String p))
+               ; Option.map b.ip ~f:(fun ip -> ("ip", `String ip)) ])
+    | "shutdown" ->
+        let%map _ = Shutdown.of_yojson v |> or_error in
+        [%log' info t.logger] "helper shut down"
     (* Received a message on some stream *)
     | "incomingStreamMsg" -> (
         let%bind m = Incoming_stream_msg.of_yojson v |> or_error in
@@ -1701,7 +1802,17 @@ let create ~on_unexpected_termination ~logger ~conf_dir =
                   ; ("err", Error_json.error_to_yojson e) ] ) ;
           Deferred.unit )
       |> don't_wait_for ;
-      Deferred.Or_error.return t
+      (* The helper refuses every other call until it accepted our hello. *)
+      Helper.do_rpc t
+        (module Helper.Rpcs.Hello)
+        Helper.Rpcs.Hello.{protocol_version; methods; upcalls}
+      |> Deferred.Or_error.map ~f:(fun (_ : Helper.Rpcs.Hello.output) -> t)
+      |> Deferred.map
+           ~f:
+             (Or_error.tag
+                ~tag:
+                  "libp2p_helper refused the hello handshake; is it out of \
+                   date?")
 
 let%test_module "coda network tests" =
   ( module struct